@@ -0,0 +1,145 @@
+package nozzle
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// AlertKind is the kind of SlowConsumerAlert.
+type AlertKind int
+
+const (
+	// AlertOther is the kind of alert which is detected by
+	// user defined DetectPolicy.
+	AlertOther AlertKind = iota
+
+	// AlertTruncated is the kind of alert which is notified when doppler
+	// dropped messages from its queue (TruncatingBuffer.DroppedMessages).
+	AlertTruncated
+
+	// AlertPolicyViolation is the kind of alert which is notified when
+	// websocket is closed with ClosePolicyViolation (1008).
+	AlertPolicyViolation
+
+	// AlertDroppedRate is the kind of alert which is notified when doppler
+	// dropped more messages than threshold in the window.
+	AlertDroppedRate
+
+	// AlertLatency is the kind of alert which is notified when nozzle
+	// lags behind more than threshold.
+	AlertLatency
+
+	// AlertLocalDropped is the kind of alert which is notified when
+	// nozzle itself dropped envelopes because its buffer is full
+	// (Config.BufferSize and Config.OverflowPolicy).
+	AlertLocalDropped
+)
+
+// String returns the name of kind.
+func (k AlertKind) String() string {
+	switch k {
+	case AlertTruncated:
+		return "Truncated"
+	case AlertPolicyViolation:
+		return "PolicyViolation"
+	case AlertDroppedRate:
+		return "DroppedRate"
+	case AlertLatency:
+		return "Latency"
+	case AlertLocalDropped:
+		return "LocalDropped"
+	default:
+		return "Other"
+	}
+}
+
+// SlowConsumerAlert is notified via Consumer.Detects() when slow consumer
+// is detected. It implements error interface so that it can be handled
+// as error like before (Detects() returns error channel). To get details,
+// use type assertion,
+//
+//	if alert, ok := err.(*nozzle.SlowConsumerAlert); ok {
+//		log.Printf("%s: dropped %d messages", alert.Kind, alert.Dropped)
+//	}
+type SlowConsumerAlert struct {
+	// Kind is the kind of the alert.
+	Kind AlertKind
+
+	// Origin, Deployment, Job, Index and IP are the information of the
+	// component which reports the alert (e.g., doppler). These are empty
+	// when the alert is not detected from envelope (e.g., PolicyViolation).
+	Origin     string
+	Deployment string
+	Job        string
+	Index      string
+	IP         string
+
+	// Dropped is the number of dropped messages. It's the delta of
+	// TruncatingBuffer.DroppedMessages counter (or sum of them in
+	// the window for AlertDroppedRate). For AlertLocalDropped, it's
+	// the number of envelopes dropped by nozzle itself.
+	Dropped uint64
+
+	// Latency is how much nozzle lags behind. It's only set for AlertLatency.
+	Latency time.Duration
+
+	// Time is the time when the alert is detected.
+	Time time.Time
+
+	// Message is the description of the alert.
+	Message string
+
+	// Err is the original error which causes the alert (e.g., websocket
+	// close error or error returned by user defined DetectPolicy).
+	Err error
+}
+
+// Error returns the description of the alert.
+func (a *SlowConsumerAlert) Error() string {
+	return a.Message
+}
+
+// newEnvelopeAlert constructs SlowConsumerAlert from envelope.
+func newEnvelopeAlert(kind AlertKind, e *events.Envelope, message string) *SlowConsumerAlert {
+	return &SlowConsumerAlert{
+		Kind:       kind,
+		Origin:     e.GetOrigin(),
+		Deployment: e.GetDeployment(),
+		Job:        e.GetJob(),
+		Index:      e.GetIndex(),
+		IP:         e.GetIp(),
+		Time:       time.Now(),
+		Message:    message,
+	}
+}
+
+// newEnvelopeV2Alert constructs SlowConsumerAlert from V2 envelope.
+func newEnvelopeV2Alert(kind AlertKind, e *loggregator_v2.Envelope, message string) *SlowConsumerAlert {
+	tags := e.GetTags()
+	return &SlowConsumerAlert{
+		Kind:       kind,
+		Origin:     tags["origin"],
+		Deployment: tags["deployment"],
+		Job:        tags["job"],
+		Index:      tags["index"],
+		IP:         tags["ip"],
+		Time:       time.Now(),
+		Message:    message,
+	}
+}
+
+// toAlert converts error returned by DetectPolicy to SlowConsumerAlert.
+func toAlert(err error) *SlowConsumerAlert {
+	if alert, ok := err.(*SlowConsumerAlert); ok {
+		return alert
+	}
+
+	return &SlowConsumerAlert{
+		Kind:    AlertOther,
+		Time:    time.Now(),
+		Message: err.Error(),
+		Err:     err,
+	}
+}
@@ -0,0 +1,104 @@
+package nozzle
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestAlertKind_String(t *testing.T) {
+	cases := []struct {
+		in     AlertKind
+		expect string
+	}{
+		{in: AlertTruncated, expect: "Truncated"},
+		{in: AlertPolicyViolation, expect: "PolicyViolation"},
+		{in: AlertDroppedRate, expect: "DroppedRate"},
+		{in: AlertLatency, expect: "Latency"},
+		{in: AlertOther, expect: "Other"},
+	}
+
+	for i, tc := range cases {
+		if got := tc.in.String(); got != tc.expect {
+			t.Fatalf("#%d expects %q to be eq %q", i, got, tc.expect)
+		}
+	}
+}
+
+func TestSlowConsumerAlert_error(t *testing.T) {
+	var err error = &SlowConsumerAlert{
+		Message: "nozzle is slow",
+	}
+
+	if err.Error() != "nozzle is slow" {
+		t.Fatalf("expect %q to be eq %q", err.Error(), "nozzle is slow")
+	}
+}
+
+func TestToAlert(t *testing.T) {
+	// User defined error is wrapped
+	err := errors.New("custom policy")
+	alert := toAlert(err)
+	if alert.Kind != AlertOther || alert.Err != err || alert.Message != "custom policy" {
+		t.Fatalf("expect error to be wrapped: %#v", alert)
+	}
+
+	// SlowConsumerAlert is returned as it is
+	in := &SlowConsumerAlert{Kind: AlertLatency}
+	if got := toAlert(in); got != in {
+		t.Fatalf("expect %#v to be eq %#v", got, in)
+	}
+}
+
+func TestDetectTruncated_alert(t *testing.T) {
+	event := newTruncatedEvent(42)
+	event.Deployment = proto.String("cf")
+	event.Job = proto.String("doppler")
+	event.Index = proto.String("0")
+	event.Ip = proto.String("10.0.0.1")
+
+	err := DetectTruncated().CheckEnvelope(event)
+	alert, ok := err.(*SlowConsumerAlert)
+	if !ok {
+		t.Fatalf("expect %#v to be *SlowConsumerAlert", err)
+	}
+
+	expect := SlowConsumerAlert{
+		Kind:       AlertTruncated,
+		Origin:     "doppler",
+		Deployment: "cf",
+		Job:        "doppler",
+		Index:      "0",
+		IP:         "10.0.0.1",
+		Dropped:    42,
+	}
+
+	if alert.Kind != expect.Kind || alert.Origin != expect.Origin ||
+		alert.Deployment != expect.Deployment || alert.Job != expect.Job ||
+		alert.Index != expect.Index || alert.IP != expect.IP ||
+		alert.Dropped != expect.Dropped {
+		t.Fatalf("expect %#v to be eq %#v", alert, expect)
+	}
+
+	if alert.Time.IsZero() {
+		t.Fatalf("expect time to be set")
+	}
+
+	// V2 envelope is reported in the same way
+	err = DetectTruncated().(DetectPolicyV2).CheckEnvelopeV2(ToV2(event))
+	alertV2, ok := err.(*SlowConsumerAlert)
+	if !ok {
+		t.Fatalf("expect %#v to be *SlowConsumerAlert", err)
+	}
+
+	if alertV2.Origin != expect.Origin || alertV2.Dropped != expect.Dropped ||
+		alertV2.IP != expect.IP {
+		t.Fatalf("expect %#v to be eq %#v", alertV2, expect)
+	}
+
+	if err := DetectTruncated().CheckEnvelope(&events.Envelope{}); err != nil {
+		t.Fatalf("expect %v to be nil", err)
+	}
+}
@@ -0,0 +1,486 @@
+package nozzle
+
+import (
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// OverflowPolicy defines what to do when the buffer (Config.BufferSize)
+// is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks receiving from upstream until the buffer has
+	// space. It's same as the behavior without the buffer (backpressure
+	// goes to the connection and doppler may truncate messages).
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropOldest drops the oldest envelope in the buffer.
+	OverflowDropOldest
+
+	// OverflowDropNewest drops the received envelope.
+	OverflowDropNewest
+
+	// OverflowDropByPriority drops the envelope by the priority of its
+	// event type (Config.DropOrder). The oldest envelope of the lowest
+	// priority is dropped first.
+	OverflowDropByPriority
+)
+
+// String returns the name of the policy.
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "Block"
+	case OverflowDropOldest:
+		return "DropOldest"
+	case OverflowDropNewest:
+		return "DropNewest"
+	case OverflowDropByPriority:
+		return "DropByPriority"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+// dropAlertInterval is the minimum interval of AlertLocalDropped alerts.
+// Drops in the interval are reported as one alert.
+const dropAlertInterval = 1 * time.Second
+
+// DefaultDropOrder returns the order of event types to drop used by
+// OverflowDropByPriority by default. Metrics are dropped first and
+// LogMessage is kept as long as possible.
+func DefaultDropOrder() []events.Envelope_EventType {
+	return []events.Envelope_EventType{
+		events.Envelope_ValueMetric,
+		events.Envelope_ContainerMetric,
+		events.Envelope_CounterEvent,
+		events.Envelope_HttpStartStop,
+		events.Envelope_Error,
+		events.Envelope_LogMessage,
+	}
+}
+
+// bufferItem is an envelope (V1 or V2) in ringBuffer.
+type bufferItem struct {
+	value interface{}
+
+	// rank is the priority of the item. The item with lower rank
+	// is dropped first.
+	rank int
+}
+
+// ringBuffer is a bounded FIFO queue. It's not goroutine safe.
+//
+// Items are kept in fixed slots which are linked in arrival order. They
+// are also linked per rank, so the oldest item of the lowest rank (the
+// head of the lowest non-empty rank) is dropped by OverflowDropByPriority
+// without scanning the buffer. The number of ranks is bounded by the
+// number of event types.
+type ringBuffer struct {
+	slots []bufferSlot
+
+	// free is the stack of unused slots.
+	free []int
+
+	// head and tail are the oldest and the newest slots (-1 if empty).
+	head, tail int
+	n          int
+
+	// ranks are the queues of slots per rank. They are grown when an
+	// item of new rank is pushed.
+	ranks []rankQueue
+
+	policy OverflowPolicy
+}
+
+// bufferSlot is a slot of ringBuffer.
+type bufferSlot struct {
+	item bufferItem
+
+	// prev and next are the neighbor slots in arrival order.
+	prev, next int
+
+	// rankNext is the next slot of the same rank.
+	rankNext int
+}
+
+// rankQueue is the queue of slots of the same rank (-1 if empty).
+type rankQueue struct {
+	head, tail int
+}
+
+func newRingBuffer(size int, policy OverflowPolicy) *ringBuffer {
+	b := &ringBuffer{
+		slots:  make([]bufferSlot, size),
+		free:   make([]int, size),
+		head:   -1,
+		tail:   -1,
+		policy: policy,
+	}
+
+	for i := range b.free {
+		b.free[i] = size - 1 - i
+	}
+	return b
+}
+
+func (b *ringBuffer) len() int {
+	return b.n
+}
+
+func (b *ringBuffer) full() bool {
+	return b.n == len(b.slots)
+}
+
+// front returns the oldest item. The buffer must not be empty.
+func (b *ringBuffer) front() bufferItem {
+	return b.slots[b.head].item
+}
+
+// pop removes the oldest item.
+func (b *ringBuffer) pop() {
+	b.remove(b.head)
+}
+
+// remove removes the item in the slot. It must be the oldest one of
+// its rank.
+func (b *ringBuffer) remove(i int) {
+	slot := &b.slots[i]
+
+	if slot.prev >= 0 {
+		b.slots[slot.prev].next = slot.next
+	} else {
+		b.head = slot.next
+	}
+
+	if slot.next >= 0 {
+		b.slots[slot.next].prev = slot.prev
+	} else {
+		b.tail = slot.prev
+	}
+
+	q := &b.ranks[slot.item.rank]
+	q.head = slot.rankNext
+	if q.head < 0 {
+		q.tail = -1
+	}
+
+	*slot = bufferSlot{}
+	b.free = append(b.free, i)
+	b.n--
+}
+
+// lowest returns the slot of the oldest item with the lowest rank.
+// The buffer must not be empty.
+func (b *ringBuffer) lowest() int {
+	for _, q := range b.ranks {
+		if q.head >= 0 {
+			return q.head
+		}
+	}
+	return b.head
+}
+
+// push adds the item. If the buffer is full, an item is dropped by
+// the policy and it returns true. With OverflowBlock, the caller must
+// not push when the buffer is full.
+func (b *ringBuffer) push(item bufferItem) bool {
+	dropped := false
+	if b.full() {
+		switch b.policy {
+		case OverflowDropNewest:
+			return true
+		case OverflowDropByPriority:
+			min := b.lowest()
+			if item.rank < b.slots[min].item.rank {
+				return true
+			}
+			b.remove(min)
+		default:
+			b.pop()
+		}
+		dropped = true
+	}
+
+	for len(b.ranks) <= item.rank {
+		b.ranks = append(b.ranks, rankQueue{head: -1, tail: -1})
+	}
+
+	i := b.free[len(b.free)-1]
+	b.free = b.free[:len(b.free)-1]
+	b.slots[i] = bufferSlot{item: item, prev: b.tail, next: -1, rankNext: -1}
+
+	if b.tail >= 0 {
+		b.slots[b.tail].next = i
+	} else {
+		b.head = i
+	}
+	b.tail = i
+
+	q := &b.ranks[item.rank]
+	if q.tail >= 0 {
+		b.slots[q.tail].rankNext = i
+	} else {
+		q.head = i
+	}
+	q.tail = i
+
+	b.n++
+	return dropped
+}
+
+// dropRanks returns the rank of event types from the drop order.
+// Event types which are not in the order are dropped last.
+func dropRanks(order []events.Envelope_EventType) map[events.Envelope_EventType]int {
+	if len(order) == 0 {
+		order = DefaultDropOrder()
+	}
+
+	ranks := make(map[events.Envelope_EventType]int, len(order))
+	for i, t := range order {
+		ranks[t] = i
+	}
+	return ranks
+}
+
+// rank returns the rank of the event type.
+func rank(ranks map[events.Envelope_EventType]int, t events.Envelope_EventType) int {
+	if r, ok := ranks[t]; ok {
+		return r
+	}
+	return len(ranks)
+}
+
+// eventTypeV2 returns V1 event type corresponding to the V2 envelope.
+func eventTypeV2(e *loggregator_v2.Envelope) events.Envelope_EventType {
+	switch e.GetMessage().(type) {
+	case *loggregator_v2.Envelope_Log:
+		return events.Envelope_LogMessage
+	case *loggregator_v2.Envelope_Counter:
+		return events.Envelope_CounterEvent
+	case *loggregator_v2.Envelope_Gauge:
+		return events.Envelope_ValueMetric
+	case *loggregator_v2.Envelope_Timer:
+		return events.Envelope_HttpStartStop
+	default:
+		return 0
+	}
+}
+
+// dropReporter counts local drops and reports them as AlertLocalDropped
+// at most once in dropAlertInterval.
+type dropReporter struct {
+	stats *stats
+
+	// pending is the number of drops which are not reported yet.
+	pending uint64
+	last    time.Time
+	timer   *time.Timer
+}
+
+// add counts drops.
+func (r *dropReporter) add(n uint64) {
+	r.stats.addLocalDropped(n)
+	r.pending += n
+}
+
+// ready returns alertCh if the alert can be sent now, otherwise nil
+// (then it can be used in select to disable sending). The returned
+// time channel is notified when the alert can be sent.
+func (r *dropReporter) ready(alertCh chan<- error) (chan<- error, <-chan time.Time) {
+	if r.pending == 0 {
+		return nil, nil
+	}
+
+	wait := dropAlertInterval - time.Since(r.last)
+	if wait <= 0 {
+		return alertCh, nil
+	}
+
+	if r.timer == nil {
+		r.timer = time.NewTimer(wait)
+	}
+	return nil, r.timer.C
+}
+
+// alert returns the alert of pending drops.
+func (r *dropReporter) alert(size int, policy OverflowPolicy) *SlowConsumerAlert {
+	return &SlowConsumerAlert{
+		Kind:    AlertLocalDropped,
+		Dropped: r.pending,
+		Time:    time.Now(),
+		Message: fmt.Sprintf("nozzle dropped %d envelopes because its buffer (size %d) is full (%s)",
+			r.pending, size, policy),
+	}
+}
+
+// sent resets pending drops after the alert is sent.
+func (r *dropReporter) sent() {
+	r.stats.addAlert(AlertLocalDropped)
+	r.pending = 0
+	r.last = time.Now()
+}
+
+// woken is called when the timer of ready is fired.
+func (r *dropReporter) woken() {
+	r.timer = nil
+}
+
+func (r *dropReporter) stop() {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
+
+// buffer passes events from upstream to downstream through ringBuffer.
+// Local drops are reported to the returned alert channel.
+func (c *consumer) buffer(eventCh <-chan *events.Envelope) (<-chan *events.Envelope, <-chan error) {
+	eventCh_, alertCh := make(chan *events.Envelope), make(chan error)
+	ranks := dropRanks(c.dropOrder)
+
+	go func() {
+		defer close(eventCh_)
+
+		buf := newRingBuffer(c.bufferSize, c.overflowPolicy)
+		reporter := &dropReporter{stats: c.stats}
+		defer reporter.stop()
+
+		in := eventCh
+		for in != nil || buf.len() > 0 {
+			var out chan<- *events.Envelope
+			var next *events.Envelope
+			if buf.len() > 0 {
+				out, next = eventCh_, buf.front().value.(*events.Envelope)
+			}
+
+			// Stop receiving while the buffer is full (OverflowBlock).
+			recv := in
+			if c.overflowPolicy == OverflowBlock && buf.full() {
+				recv = nil
+			}
+
+			sendAlert, wakeCh := reporter.ready(alertCh)
+			var alert error
+			if sendAlert != nil {
+				alert = reporter.alert(c.bufferSize, c.overflowPolicy)
+			}
+
+			select {
+			case event, ok := <-recv:
+				if !ok {
+					in = nil
+					continue
+				}
+
+				item := bufferItem{value: event, rank: rank(ranks, event.GetEventType())}
+				if buf.push(item) {
+					reporter.add(1)
+				}
+			case out <- next:
+				buf.pop()
+			case sendAlert <- alert:
+				reporter.sent()
+			case <-wakeCh:
+				reporter.woken()
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return eventCh_, alertCh
+}
+
+// bufferV2 is same as buffer but for V2 envelopes.
+func (c *consumer) bufferV2(eventCh <-chan *loggregator_v2.Envelope) (<-chan *loggregator_v2.Envelope, <-chan error) {
+	eventCh_, alertCh := make(chan *loggregator_v2.Envelope), make(chan error)
+	ranks := dropRanks(c.dropOrder)
+
+	go func() {
+		defer close(eventCh_)
+
+		buf := newRingBuffer(c.bufferSize, c.overflowPolicy)
+		reporter := &dropReporter{stats: c.stats}
+		defer reporter.stop()
+
+		in := eventCh
+		for in != nil || buf.len() > 0 {
+			var out chan<- *loggregator_v2.Envelope
+			var next *loggregator_v2.Envelope
+			if buf.len() > 0 {
+				out, next = eventCh_, buf.front().value.(*loggregator_v2.Envelope)
+			}
+
+			recv := in
+			if c.overflowPolicy == OverflowBlock && buf.full() {
+				recv = nil
+			}
+
+			sendAlert, wakeCh := reporter.ready(alertCh)
+			var alert error
+			if sendAlert != nil {
+				alert = reporter.alert(c.bufferSize, c.overflowPolicy)
+			}
+
+			select {
+			case event, ok := <-recv:
+				if !ok {
+					in = nil
+					continue
+				}
+
+				item := bufferItem{value: event, rank: rank(ranks, eventTypeV2(event))}
+				if buf.push(item) {
+					reporter.add(1)
+				}
+			case out <- next:
+				buf.pop()
+			case sendAlert <- alert:
+				reporter.sent()
+			case <-wakeCh:
+				reporter.woken()
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return eventCh_, alertCh
+}
+
+// mergeDetects merges alerts from SlowDetector and the buffer.
+func (c *consumer) mergeDetects(detectCh, alertCh <-chan error) <-chan error {
+	detectCh_ := make(chan error)
+	go func() {
+		for detectCh != nil || alertCh != nil {
+			var alert error
+			var ok bool
+			select {
+			case alert, ok = <-detectCh:
+				if !ok {
+					detectCh = nil
+					continue
+				}
+			case alert, ok = <-alertCh:
+				if !ok {
+					alertCh = nil
+					continue
+				}
+			case <-c.doneCh:
+				return
+			}
+
+			select {
+			case detectCh_ <- alert:
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return detectCh_
+}
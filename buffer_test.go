@@ -0,0 +1,210 @@
+package nozzle
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestOverflowPolicy_String(t *testing.T) {
+	cases := []struct {
+		policy OverflowPolicy
+		expect string
+	}{
+		{OverflowBlock, "Block"},
+		{OverflowDropOldest, "DropOldest"},
+		{OverflowDropNewest, "DropNewest"},
+		{OverflowDropByPriority, "DropByPriority"},
+		{OverflowPolicy(10), "OverflowPolicy(10)"},
+	}
+
+	for i, tc := range cases {
+		if got := tc.policy.String(); got != tc.expect {
+			t.Fatalf("#%d expects %q to be eq %q", i, got, tc.expect)
+		}
+	}
+}
+
+func TestRingBuffer_push(t *testing.T) {
+	cases := []struct {
+		policy  OverflowPolicy
+		ranks   []int
+		expect  []int
+		dropped int
+	}{
+		{
+			policy:  OverflowDropOldest,
+			ranks:   []int{0, 1, 2, 3, 4},
+			expect:  []int{2, 3, 4},
+			dropped: 2,
+		},
+		{
+			policy:  OverflowDropNewest,
+			ranks:   []int{0, 1, 2, 3, 4},
+			expect:  []int{0, 1, 2},
+			dropped: 2,
+		},
+		{
+			// The oldest item of the lowest rank is dropped first.
+			policy:  OverflowDropByPriority,
+			ranks:   []int{1, 0, 2, 0, 1},
+			expect:  []int{1, 2, 1},
+			dropped: 2,
+		},
+		{
+			// The received item is dropped if its rank is the lowest.
+			policy:  OverflowDropByPriority,
+			ranks:   []int{2, 1, 2, 0, 0},
+			expect:  []int{2, 1, 2},
+			dropped: 2,
+		},
+	}
+
+	for i, tc := range cases {
+		buf := newRingBuffer(3, tc.policy)
+
+		dropped := 0
+		for _, r := range tc.ranks {
+			if buf.push(bufferItem{rank: r}) {
+				dropped++
+			}
+		}
+
+		if dropped != tc.dropped {
+			t.Fatalf("#%d expects %d to be eq %d", i, dropped, tc.dropped)
+		}
+
+		if buf.len() != len(tc.expect) {
+			t.Fatalf("#%d expects %d to be eq %d", i, buf.len(), len(tc.expect))
+		}
+
+		for j, r := range tc.expect {
+			if got := buf.front().rank; got != r {
+				t.Fatalf("#%d expects item %d to be eq %d (got %d)", i, j, r, got)
+			}
+			buf.pop()
+		}
+	}
+}
+
+func TestRingBuffer_dropByPriority(t *testing.T) {
+	buf := newRingBuffer(8, OverflowDropByPriority)
+
+	// expect is the naive model of the buffer which scans all items
+	// to find the one to drop.
+	var expect []bufferItem
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		if r.Intn(3) == 0 && len(expect) > 0 {
+			if got := buf.front(); got != expect[0] {
+				t.Fatalf("#%d expects %v to be eq %v", i, got, expect[0])
+			}
+			buf.pop()
+			expect = expect[1:]
+			continue
+		}
+
+		item := bufferItem{value: i, rank: r.Intn(4)}
+		dropped := buf.push(item)
+
+		expectDropped := false
+		if len(expect) == len(buf.slots) {
+			min := 0
+			for j := range expect {
+				if expect[j].rank < expect[min].rank {
+					min = j
+				}
+			}
+
+			expectDropped = true
+			if item.rank < expect[min].rank {
+				item.value = nil
+			} else {
+				expect = append(expect[:min], expect[min+1:]...)
+			}
+		}
+
+		if item.value != nil {
+			expect = append(expect, item)
+		}
+
+		if dropped != expectDropped || buf.len() != len(expect) {
+			t.Fatalf("#%d expects (%v, %d) to be eq (%v, %d)", i, dropped, buf.len(), expectDropped, len(expect))
+		}
+	}
+}
+
+func TestDropRanks(t *testing.T) {
+	ranks := dropRanks(nil)
+	if rank(ranks, events.Envelope_ValueMetric) >= rank(ranks, events.Envelope_LogMessage) {
+		t.Fatalf("expects ValueMetric to be dropped before LogMessage")
+	}
+
+	ranks = dropRanks([]events.Envelope_EventType{events.Envelope_LogMessage})
+	if rank(ranks, events.Envelope_LogMessage) >= rank(ranks, events.Envelope_ValueMetric) {
+		t.Fatalf("expects LogMessage to be dropped before unlisted ValueMetric")
+	}
+}
+
+func TestConsumer_buffer(t *testing.T) {
+	rc := &replayRawConsumer{}
+	for i := int64(0); i < 5; i++ {
+		rc.Events = append(rc.Events, &events.Envelope{
+			Origin:    proto.String("fake-origin"),
+			EventType: events.Envelope_LogMessage.Enum(),
+			Timestamp: proto.Int64(i),
+		})
+	}
+
+	consumer, err := NewConsumer(&Config{
+		RawConsumer:    rc,
+		BufferSize:     2,
+		OverflowPolicy: OverflowDropNewest,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	// Events are not received until the drop is alerted.
+	err = <-consumer.Detects()
+	alert, ok := err.(*SlowConsumerAlert)
+	if !ok || alert.Kind != AlertLocalDropped {
+		t.Fatalf("expects %#v to be LocalDropped alert", err)
+	}
+
+	// Wait until all envelopes are received by the buffer.
+	timeout := time.After(3 * time.Second)
+	for consumer.Stats().LocalDropped < 3 {
+		select {
+		case <-timeout:
+			t.Fatalf("expects %d to be eq 3", consumer.Stats().LocalDropped)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	var timestamps []int64
+	for event := range consumer.Events() {
+		timestamps = append(timestamps, event.GetTimestamp())
+	}
+
+	if len(timestamps) != 2 || timestamps[0] != 0 || timestamps[1] != 1 {
+		t.Fatalf("expects %v to be eq [0 1]", timestamps)
+	}
+
+	st := consumer.Stats()
+	if st.LocalDropped != 3 {
+		t.Fatalf("expects %d to be eq 3", st.LocalDropped)
+	}
+
+	if st.AlertsByKind[AlertLocalDropped] != 1 {
+		t.Fatalf("expects %d to be eq 1", st.AlertsByKind[AlertLocalDropped])
+	}
+}
@@ -1,12 +1,19 @@
 package nozzle
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
 	noaaConsumer "github.com/cloudfoundry/noaa/consumer"
+	noaaErrors "github.com/cloudfoundry/noaa/errors"
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
@@ -17,8 +24,14 @@ type Consumer interface {
 	// rawConsumer(by default Noaa).
 	Events() <-chan *events.Envelope
 
+	// EventsV2 returns the read channel for the events as loggregator
+	// V2 envelopes. It's only used when Config.EnvelopeV2 is true (then
+	// Events is not used).
+	EventsV2() <-chan *loggregator_v2.Envelope
+
 	// Detects returns the read channel that is notified slowConsumerAlerts
-	// handled by SlowDetector.
+	// handled by SlowDetector. By default, the notified error is
+	// *SlowConsumerAlert which has the details of the alert.
 	Detects() <-chan error
 
 	// Error returns the read channel of erros that occured during consuming.
@@ -28,19 +41,92 @@ type Consumer interface {
 	// If any, returns error.
 	Start() error
 
+	// StartContext is same as Start but the lifetime of consuming is tied
+	// to the given context. When the context is done, connection with
+	// firehose and SlowDetector are closed (same as calling Close).
+	// If the context is already done, it returns ctx.Err().
+	StartContext(ctx context.Context) error
+
 	// Close stop consuming upstream events by RawConsumer and stop SlowDetector.
 	// If any, returns error.
 	Close() error
+
+	// CloseContext is same as Close but it stops waiting for closing
+	// when the context is done and returns ctx.Err().
+	CloseContext(ctx context.Context) error
+
+	// Stats returns the snapshot of statistics of consuming.
+	// It's safe to call it while consuming.
+	Stats() Stats
+
+	// State returns the current state of consumer.
+	State() State
+
+	// StateChanges returns the read channel that is notified when the
+	// state is changed. It's closed after the state becomes StateClosed.
+	// Changes are dropped if the channel is not read and its buffer is full.
+	StateChanges() <-chan StateChange
+}
+
+// AppStreamer is implemented by Consumer in stream mode
+// (Config.AppGUIDs). Type-assert Consumer to it to add and remove
+// applications while consuming.
+type AppStreamer interface {
+	// AddApp starts streaming the application. It can be called
+	// while consuming.
+	AddApp(appGUID string) error
+
+	// RemoveApp stops streaming the application.
+	RemoveApp(appGUID string) error
+
+	// Apps returns the GUIDs of streamed applications.
+	Apps() []string
 }
 
 type consumer struct {
-	rawConsumer  rawConsumer
-	slowDetector slowDetector
+	rawConsumer  RawConsumer
+	slowDetector SlowDetector
 	logger       *log.Logger
 
-	eventCh  <-chan *events.Envelope
-	errCh    <-chan error
-	detectCh <-chan error
+	// v2 is true when consumer delivers V2 envelopes via EventsV2.
+	v2 bool
+
+	eventCh   <-chan *events.Envelope
+	eventV2Ch <-chan *loggregator_v2.Envelope
+	errCh     <-chan error
+	detectCh  <-chan error
+
+	// state is the state of consumer.
+	state stateMachine
+
+	// stats is shared with the default slowDetector.
+	stats *stats
+
+	// tokenCache refreshes the token in background while consuming.
+	tokenCache *tokenCache
+
+	// filter drops envelopes after slowDetector if it's set.
+	filter Filter
+
+	// bufferSize, overflowPolicy and dropOrder are used for the
+	// buffer between slowDetector and downstream.
+	bufferSize     int
+	overflowPolicy OverflowPolicy
+	dropOrder      []events.Envelope_EventType
+
+	// spool is used between slowDetector and the buffer if it's set.
+	// spoolDoneCh is closed after it's closed.
+	spool       *spool
+	spoolDoneCh chan struct{}
+
+	// mu serializes Start and Close.
+	mu sync.Mutex
+
+	// doneCh is closed when consumer is closed. It's used to stop
+	// watching the context given by StartContext.
+	doneCh    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
 }
 
 // Events returns the read channel for the events that consumed by rawConsumer
@@ -48,6 +134,11 @@ func (c *consumer) Events() <-chan *events.Envelope {
 	return c.eventCh
 }
 
+// EventsV2 returns the read channel for the V2 events
+func (c *consumer) EventsV2() <-chan *loggregator_v2.Envelope {
+	return c.eventV2Ch
+}
+
 // Detects returns the read channel that is notified slowConsumerAlerts
 func (c *consumer) Detects() <-chan error {
 	return c.detectCh
@@ -58,32 +149,358 @@ func (c *consumer) Errors() <-chan error {
 	return c.errCh
 }
 
+// State returns the current state of consumer.
+func (c *consumer) State() State {
+	return c.state.current()
+}
+
+// StateChanges returns the read channel that is notified state changes.
+func (c *consumer) StateChanges() <-chan StateChange {
+	return c.state.changes()
+}
+
+// Stats returns the snapshot of statistics.
+func (c *consumer) Stats() Stats {
+	return c.stats.snapshot()
+}
+
 // Start starts consuming & slowDetector
 func (c *consumer) Start() error {
-	// Start consuming events from firehose.
-	eventsCh, errCh := c.rawConsumer.Consume()
+	return c.StartContext(context.Background())
+}
 
-	// Construct default slowDetector
-	sd := &defaultSlowDetector{
-		logger: c.logger,
+// StartContext starts consuming & slowDetector. They are stopped
+// when the given context is done. It returns *StateError if it's
+// already started or closed.
+func (c *consumer) StartContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// Store slowDetector (for Close() fucntion)
-	c.slowDetector = sd
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// Start reading events from firehose and detect `slowConsumerAlert`.
+	if err := c.state.transition("Start", StateConnecting); err != nil {
+		return err
+	}
+
+	// doneCh is created before starting pipeline because
+	// it's also used to stop converting envelopes.
+	c.doneCh = make(chan struct{})
+
+	// Construct default slowDetector if it's not provided.
+	// It's stored for Close() fucntion.
+	if c.stats == nil {
+		c.stats = &stats{}
+	}
+
+	if c.slowDetector == nil {
+		c.slowDetector = &defaultSlowDetector{
+			logger: c.logger,
+			stats:  c.stats,
+		}
+	}
+
+	// Detector constructed by NewSlowDetector also counts stats.
+	if sd, ok := c.slowDetector.(*defaultSlowDetector); ok && sd.stats == nil {
+		sd.stats = c.stats
+	}
+	sd := c.slowDetector
+
+	// Start consuming events from firehose and detecting `slowConsumerAlert`.
 	// The detection is notified by detectCh.
-	c.eventCh, c.errCh, c.detectCh = sd.Detect(eventsCh, errCh)
+	if c.v2 {
+		eventsCh, errCh := c.observeV2(c.consumeV2(ctx))
+		c.eventV2Ch, c.errCh, c.detectCh = sd.DetectV2(eventsCh, errCh)
+	} else {
+		eventsCh, errCh := c.observe(c.consume(ctx))
+		c.eventCh, c.errCh, c.detectCh = sd.Detect(eventsCh, errCh)
+	}
+
+	// Filter envelopes after slowDetector saw them.
+	if c.filter != nil {
+		if c.v2 {
+			c.eventV2Ch = c.filterEventsV2(c.eventV2Ch)
+		} else {
+			c.eventCh = c.filterEvents(c.eventCh)
+		}
+	}
+
+	// Spool envelopes to disk not to block slowDetector by downstream.
+	if c.spool != nil {
+		if c.v2 {
+			c.eventV2Ch = c.spoolEventsV2(c.eventV2Ch)
+		} else {
+			c.eventCh = c.spoolEvents(c.eventCh)
+		}
+	}
+
+	// Buffer envelopes between slowDetector and downstream.
+	if c.bufferSize > 0 {
+		var alertCh <-chan error
+		if c.v2 {
+			c.eventV2Ch, alertCh = c.bufferV2(c.eventV2Ch)
+		} else {
+			c.eventCh, alertCh = c.buffer(c.eventCh)
+		}
+		c.detectCh = c.mergeDetects(c.detectCh, alertCh)
+	}
+
+	if c.tokenCache != nil {
+		c.tokenCache.start()
+	}
+
+	// Watch the context and close everything when it's done.
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.logger.Printf("[INFO] Context is done, stop consuming: %s", ctx.Err())
+			if err := c.Close(); err != nil {
+				c.logger.Printf("[ERROR] Failed to close consumer: %s", err)
+			}
+		case <-c.doneCh:
+		}
+	}()
 
-	// In current implementation no errors are happened.
-	//
-	// This is for preventing interfance change in future when
-	// we need to put some other function here and it returns error.
 	return nil
 }
 
+// consume starts consuming events by rawConsumer. If rawConsumer can
+// handle context by itself (e.g., cancel refreshing token), pass it.
+func (c *consumer) consume(ctx context.Context) (<-chan *events.Envelope, <-chan error) {
+	if rc, ok := c.rawConsumer.(RawContextConsumer); ok {
+		return rc.ConsumeContext(ctx)
+	}
+
+	return c.rawConsumer.Consume()
+}
+
+// consumeV2 starts consuming V2 events by rawConsumer. If rawConsumer
+// can't provide V2 envelopes, V1 envelopes are converted to V2.
+func (c *consumer) consumeV2(ctx context.Context) (<-chan *loggregator_v2.Envelope, <-chan error) {
+	if rc, ok := c.rawConsumer.(RawV2Consumer); ok {
+		return rc.ConsumeV2Context(ctx)
+	}
+
+	eventsCh, errCh := c.consume(ctx)
+	eventsV2Ch := make(chan *loggregator_v2.Envelope)
+	go func() {
+		defer close(eventsV2Ch)
+		for event := range eventsCh {
+			select {
+			case eventsV2Ch <- ToV2(event):
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return eventsV2Ch, errCh
+}
+
+// observe observes events and errors from upstream to track the state.
+// The state becomes StateStreaming when it receives an event and
+// StateDraining when upstream is finished.
+func (c *consumer) observe(eventCh <-chan *events.Envelope, errCh <-chan error) (<-chan *events.Envelope, <-chan error) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	eventCh_ := make(chan *events.Envelope)
+	go func() {
+		defer wg.Done()
+		defer close(eventCh_)
+		for event := range eventCh {
+			c.received()
+			select {
+			case eventCh_ <- event:
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	errCh_ := c.observeErrors(errCh, &wg)
+	go func() {
+		wg.Wait()
+		c.finished()
+	}()
+
+	return eventCh_, errCh_
+}
+
+// observeV2 is same as observe but for V2 envelopes.
+func (c *consumer) observeV2(eventCh <-chan *loggregator_v2.Envelope, errCh <-chan error) (<-chan *loggregator_v2.Envelope, <-chan error) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	eventCh_ := make(chan *loggregator_v2.Envelope)
+	go func() {
+		defer wg.Done()
+		defer close(eventCh_)
+		for event := range eventCh {
+			c.received()
+			select {
+			case eventCh_ <- event:
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	errCh_ := c.observeErrors(errCh, &wg)
+	go func() {
+		wg.Wait()
+		c.finished()
+	}()
+
+	return eventCh_, errCh_
+}
+
+// observeErrors passes errors from upstream to downstream.
+// wg.Done is called when it's finished.
+func (c *consumer) observeErrors(errCh <-chan error, wg *sync.WaitGroup) <-chan error {
+	errCh_ := make(chan error)
+	go func() {
+		defer wg.Done()
+		defer close(errCh_)
+		for err := range errCh {
+			select {
+			case errCh_ <- err:
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return errCh_
+}
+
+// received is called when an event is received from upstream.
+func (c *consumer) received() {
+	c.state.transitionIf(StateStreaming, StateConnecting, StateReconnecting)
+}
+
+// finished is called when upstream is finished.
+func (c *consumer) finished() {
+	if c.state.transitionIf(StateDraining, StateConnecting, StateStreaming, StateReconnecting) {
+		c.logger.Printf("[INFO] Consuming is finished, waiting for Close")
+	}
+}
+
+// observeHooks returns hooks which track the state and stats of
+// consumer and then call the given hooks.
+func (c *consumer) observeHooks(hooks Hooks) Hooks {
+	onConnect, onRetry, onReconnect := hooks.OnConnect, hooks.OnRetry, hooks.OnReconnect
+	onDisconnect, onTokenRefresh := hooks.OnDisconnect, hooks.OnTokenRefresh
+
+	hooks.OnConnect = func(e ConnectEvent) {
+		c.state.transitionIf(StateStreaming, StateConnecting, StateReconnecting)
+		c.stats.endpointConnected(e.Addr, e.Time)
+		if onConnect != nil {
+			onConnect(e)
+		}
+	}
+
+	hooks.OnRetry = func(e RetryEvent) {
+		c.state.transitionIf(StateReconnecting, StateConnecting, StateStreaming)
+		c.stats.addRetry()
+		c.stats.endpointFailed(e.Addr, e.Time, e.Err)
+		if onRetry != nil {
+			onRetry(e)
+		}
+	}
+
+	hooks.OnDisconnect = func(e DisconnectEvent) {
+		if e.Err != nil {
+			c.stats.endpointFailed(e.Addr, e.Time, e.Err)
+		} else {
+			c.stats.endpointClosed(e.Addr)
+		}
+		if onDisconnect != nil {
+			onDisconnect(e)
+		}
+	}
+
+	hooks.OnReconnect = func(e ReconnectEvent) {
+		c.state.transitionIf(StateReconnecting, StateConnecting, StateStreaming)
+		c.stats.addReconnect()
+		if onReconnect != nil {
+			onReconnect(e)
+		}
+	}
+
+	hooks.OnTokenRefresh = func(e TokenRefreshEvent) {
+		c.stats.addTokenRefresh()
+		c.stats.setTokenExpiry(e.Expiry)
+		if onTokenRefresh != nil {
+			onTokenRefresh(e)
+		}
+	}
+
+	return hooks
+}
+
 // Close closes connection with firehose and stop slowDetector.
+// It's safe to call Close more than once, it returns the result
+// of the first call. If it's called before Start, nothing is closed
+// and it just moves the state to StateClosed.
 func (c *consumer) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		// Not started yet.
+		if err := c.state.transition("Close", StateClosed); err == nil {
+			if c.spool != nil {
+				c.closeErr = c.spool.close()
+			}
+			return
+		}
+
+		// It may be already draining (upstream is finished).
+		c.state.transitionIf(StateDraining, StateConnecting, StateStreaming, StateReconnecting)
+
+		close(c.doneCh)
+		c.closeErr = c.close()
+
+		if c.tokenCache != nil {
+			c.tokenCache.stop()
+		}
+
+		// Wait until the read position is saved.
+		if c.spoolDoneCh != nil {
+			<-c.spoolDoneCh
+		}
+
+		if err := c.state.transition("Close", StateClosed); err != nil {
+			c.logger.Printf("[ERROR] Failed to change state: %s", err)
+		}
+	})
+
+	return c.closeErr
+}
+
+// CloseContext closes connection with firehose and stop slowDetector.
+// If the context is done before finishing, it returns ctx.Err().
+func (c *consumer) CloseContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Close()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *consumer) close() error {
 	if err := c.rawConsumer.Close(); err != nil {
 		return err
 	}
@@ -91,21 +508,46 @@ func (c *consumer) Close() error {
 	return c.slowDetector.Stop()
 }
 
-// rawConsumer defines the interface for consuming events from doppler firehose.
+// RawConsumer defines the interface for consuming events from doppler firehose.
 // The events pulled by RawConsumer pass to slowDetector and check slowDetector.
 //
-// By default, it uses https://github.com/cloudfoundry/noaa
-type rawConsumer interface {
+// By default, it uses https://github.com/cloudfoundry/noaa (or
+// https://github.com/cloudfoundry/go-loggregator for RLP gateway).
+// You can plug your own source of events (e.g., replaying events from
+// file) by setting it to Config.RawConsumer.
+type RawConsumer interface {
 	// Consume starts cosuming firehose events. It must return 2 channel.
 	// The one is for sending the events from firehose
 	// and the other is for error occured while consuming.
 	// These channels are used donwstream process (SlowConsumer).
+	//
+	// Both channels should be closed when consuming is finished
+	// (e.g., after Close is called).
 	Consume() (<-chan *events.Envelope, <-chan error)
 
 	// Close closes connection with firehose. If any, returns error.
 	Close() error
 }
 
+// RawContextConsumer is implemented by RawConsumer which can bind
+// consuming to the context (e.g., to cancel refreshing token).
+// If RawConsumer implements this, ConsumeContext is used instead of Consume.
+type RawContextConsumer interface {
+	// ConsumeContext is same as Consume but it's canceled when
+	// the given context is done.
+	ConsumeContext(ctx context.Context) (<-chan *events.Envelope, <-chan error)
+}
+
+// RawV2Consumer is implemented by RawConsumer which can provide
+// loggregator V2 envelopes without conversion (e.g., RLP gateway).
+// It's used when consumer is V2 mode (Config.EnvelopeV2). If RawConsumer
+// doesn't implement this, V1 envelopes are converted to V2.
+type RawV2Consumer interface {
+	// ConsumeV2Context is same as ConsumeContext but it returns
+	// the channel of V2 envelopes.
+	ConsumeV2Context(ctx context.Context) (<-chan *loggregator_v2.Envelope, <-chan error)
+}
+
 type rawDefaultConsumer struct {
 	noaaConsumer *noaaConsumer.Consumer
 
@@ -113,10 +555,20 @@ type rawDefaultConsumer struct {
 	token          string
 	subscriptionID string
 	insecure       bool
+	tlsConfig      *tls.Config
+	proxy          func(*http.Request) (*url.URL, error)
 	debugPrinter   noaaConsumer.DebugPrinter
 	idleTimeout    time.Duration
 	retryCount     int
-	tokenRefresher tokenFetcher
+	tokenRefresher TokenSource
+	hooks          *Hooks
+
+	// doneCh is closed by Close to stop watching errors.
+	doneCh chan struct{}
+
+	// disconnectOnce ensures OnDisconnect hook is called only once
+	// (noaa gives up retrying and then Close is called).
+	disconnectOnce *sync.Once
 
 	logger *log.Logger
 }
@@ -124,15 +576,24 @@ type rawDefaultConsumer struct {
 // Consume consumes firehose events from doppler.
 // Retry function is handled in noaa library (It will retry 5 times).
 func (c *rawDefaultConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
+	return c.ConsumeContext(context.Background())
+}
+
+// ConsumeContext consumes firehose events from doppler. Refreshing token
+// by tokenRefresher is canceled when the given context is done.
+func (c *rawDefaultConsumer) ConsumeContext(ctx context.Context) (<-chan *events.Envelope, <-chan error) {
 	c.logger.Printf(
 		"[INFO] Start consuming firehose events from Doppler (%s) with subscription ID %q",
 		c.dopplerAddr, c.subscriptionID)
 
 	// Setup Noaa Consumer
-	tlsConfig := tls.Config{
-		InsecureSkipVerify: c.insecure,
+	tlsConfig := c.tlsConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{
+			InsecureSkipVerify: c.insecure,
+		}
 	}
-	nc := noaaConsumer.New(c.dopplerAddr, &tlsConfig, nil)
+	nc := noaaConsumer.New(c.dopplerAddr, tlsConfig, c.proxy)
 
 	if c.debugPrinter != nil {
 		nc.SetDebugPrinter(c.debugPrinter)
@@ -140,19 +601,85 @@ func (c *rawDefaultConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
 
 	nc.SetIdleTimeout(c.idleTimeout)
 
+	// The token may be refreshed in background after construction.
+	token := currentToken(c.tokenRefresher, c.token)
+
 	nc.SetMaxRetryCount(c.retryCount)
 	if c.tokenRefresher != nil {
-	    nc.RefreshTokenFrom(c.tokenRefresher)
+		nc.RefreshTokenFrom(&contextTokenRefresher{
+			ctx:     ctx,
+			fetcher: c.tokenRefresher,
+			token:   token,
+		})
 	}
 
+	// failures is the number of failures in a row. It's reset
+	// when noaa (re)connects to doppler.
+	var failures int32
+	nc.SetOnConnectCallback(func() {
+		c.logger.Printf("[DEBUG] Connected to Doppler (%s)", c.dopplerAddr)
+		atomic.StoreInt32(&failures, 0)
+		c.hooks.onConnect(ConnectEvent{
+			Addr:           c.dopplerAddr,
+			SubscriptionID: c.subscriptionID,
+			Time:           time.Now(),
+		})
+	})
+
 	// Start connection
-	eventChan, errChan := nc.Firehose(c.subscriptionID, c.token)
+	eventChan, errChan := nc.Firehose(c.subscriptionID, token)
 
 	// Store noaaConsumer in rawConsumer struct
 	// to close it from other function
 	c.noaaConsumer = nc
+	c.doneCh = make(chan struct{})
+	c.disconnectOnce = &sync.Once{}
+
+	return eventChan, c.watchErrors(errChan, &failures)
+}
+
+// watchErrors watches errors from noaa and calls hooks. noaa sends
+// the error every time it fails to connect and retries. After it gives
+// up retrying, it sends ErrMaxRetriesReached (or NonRetryableError).
+func (c *rawDefaultConsumer) watchErrors(errCh <-chan error, failures *int32) <-chan error {
+	errCh_ := make(chan error)
+	doneCh, once := c.doneCh, c.disconnectOnce
+	go func() {
+		defer close(errCh_)
+		for err := range errCh {
+			if _, ok := err.(noaaErrors.NonRetryableError); ok || err == noaaConsumer.ErrMaxRetriesReached {
+				c.disconnected(once, err)
+			} else {
+				c.hooks.onRetry(RetryEvent{
+					Addr:           c.dopplerAddr,
+					SubscriptionID: c.subscriptionID,
+					Time:           time.Now(),
+					Attempt:        int(atomic.AddInt32(failures, 1)),
+					Err:            err,
+				})
+			}
+
+			select {
+			case errCh_ <- err:
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+
+	return errCh_
+}
 
-	return eventChan, errChan
+// disconnected calls OnDisconnect hook once for each connection.
+func (c *rawDefaultConsumer) disconnected(once *sync.Once, err error) {
+	once.Do(func() {
+		c.hooks.onDisconnect(DisconnectEvent{
+			Addr:           c.dopplerAddr,
+			SubscriptionID: c.subscriptionID,
+			Time:           time.Now(),
+			Err:            err,
+		})
+	})
 }
 
 func (c *rawDefaultConsumer) Close() error {
@@ -161,7 +688,13 @@ func (c *rawDefaultConsumer) Close() error {
 		return fmt.Errorf("no connection with firehose")
 	}
 
-	return c.noaaConsumer.Close()
+	if err := c.noaaConsumer.Close(); err != nil {
+		return err
+	}
+
+	close(c.doneCh)
+	c.disconnected(c.disconnectOnce, nil)
+	return nil
 }
 
 // validate validates struct has requirement fields or not
@@ -183,16 +716,25 @@ func (c *rawDefaultConsumer) validate() error {
 
 // newRawConsumer constructs new rawConsumer.
 func newRawDefaultConsumer(config *Config) (*rawDefaultConsumer, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := config.Hooks
 	c := &rawDefaultConsumer{
 		dopplerAddr:    config.DopplerAddr,
 		token:          config.Token,
 		subscriptionID: config.SubscriptionID,
 		insecure:       config.Insecure,
+		tlsConfig:      tlsConfig,
+		proxy:          proxyFunc(config),
 		debugPrinter:   config.DebugPrinter,
 		logger:         config.Logger,
 		idleTimeout:    config.IdleTimeout,
 		retryCount:     config.RetryCount,
 		tokenRefresher: config.tokenFetcher,
+		hooks:          &hooks,
 	}
 
 	if err := c.validate(); err != nil {
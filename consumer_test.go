@@ -3,14 +3,21 @@ package nozzle
 import (
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	noaaConsumer "github.com/cloudfoundry/noaa/consumer"
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
-type testRawConsumer struct{}
+type testRawConsumer struct {
+	// CloseWait is duration to wait before Close() returns.
+	CloseWait time.Duration
+}
 
 func (c *testRawConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
 	eventCh, errCh := make(chan *events.Envelope), make(chan error)
@@ -18,6 +25,28 @@ func (c *testRawConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
 }
 
 func (c *testRawConsumer) Close() error {
+	time.Sleep(c.CloseWait)
+	return nil
+}
+
+// replayRawConsumer is RawConsumer which replays the given events.
+type replayRawConsumer struct {
+	Events []*events.Envelope
+}
+
+func (c *replayRawConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
+	eventCh, errCh := make(chan *events.Envelope), make(chan error)
+	go func() {
+		defer close(eventCh)
+		defer close(errCh)
+		for _, event := range c.Events {
+			eventCh <- event
+		}
+	}()
+	return eventCh, errCh
+}
+
+func (c *replayRawConsumer) Close() error {
 	return nil
 }
 
@@ -26,8 +55,8 @@ func TestConsumer_implement(t *testing.T) {
 }
 
 func TestRawConsumer_implement(t *testing.T) {
-	// Test rawConsumer implements consumer
-	var _ rawConsumer = &rawDefaultConsumer{}
+	// Test rawDefaultConsumer implements RawConsumer
+	var _ RawConsumer = &rawDefaultConsumer{}
 }
 
 func TestRawConsumer_consume(t *testing.T) {
@@ -129,3 +158,114 @@ func TestRawConsumer_validate(t *testing.T) {
 		t.Errorf("#%d expects err not to be nil", i)
 	}
 }
+
+func TestRawConsumer_hooks(t *testing.T) {
+	t.Parallel()
+
+	inputCh := make(chan []byte)
+	authToken := "n98ubNOIUog9gOPUbvqiur"
+
+	ts := NewDopplerServer(t, inputCh, authToken)
+	defer ts.Close()
+
+	connectCh := make(chan ConnectEvent, 1)
+	disconnectCh := make(chan DisconnectEvent, 1)
+	consumer := &rawDefaultConsumer{
+		dopplerAddr:    strings.Replace(ts.URL, "http:", "ws:", 1),
+		token:          authToken,
+		subscriptionID: "test-go-nozzle-A",
+		insecure:       true,
+		hooks: &Hooks{
+			OnConnect: func(e ConnectEvent) {
+				connectCh <- e
+			},
+			OnDisconnect: func(e DisconnectEvent) {
+				disconnectCh <- e
+			},
+		},
+		logger: log.New(ioutil.Discard, "", log.LstdFlags),
+	}
+	consumer.Consume()
+
+	select {
+	case e := <-connectCh:
+		if e.SubscriptionID != "test-go-nozzle-A" {
+			t.Fatalf("expect %q to be eq %q", e.SubscriptionID, "test-go-nozzle-A")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expects OnConnect to be called")
+	}
+
+	if err := consumer.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	select {
+	case e := <-disconnectCh:
+		if e.Err != nil {
+			t.Fatalf("expects %v to be nil", e.Err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expects OnDisconnect to be called")
+	}
+}
+
+func TestRawConsumer_hooks_retry(t *testing.T) {
+	t.Parallel()
+
+	// Server which always rejects websocket connection.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var attempts []int
+	disconnectCh := make(chan DisconnectEvent, 1)
+	consumer := &rawDefaultConsumer{
+		dopplerAddr:    strings.Replace(ts.URL, "http:", "ws:", 1),
+		token:          "n98ubNOIUog9gOPUbvqiur",
+		subscriptionID: "test-go-nozzle-A",
+		retryCount:     3,
+		hooks: &Hooks{
+			OnRetry: func(e RetryEvent) {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts = append(attempts, e.Attempt)
+			},
+			OnDisconnect: func(e DisconnectEvent) {
+				disconnectCh <- e
+			},
+		},
+		logger: log.New(ioutil.Discard, "", log.LstdFlags),
+	}
+
+	_, errCh := consumer.Consume()
+	go func() {
+		for range errCh {
+		}
+	}()
+
+	select {
+	case e := <-disconnectCh:
+		if e.Err != noaaConsumer.ErrMaxRetriesReached {
+			t.Fatalf("expect %v to be eq %v", e.Err, noaaConsumer.ErrMaxRetriesReached)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expects OnDisconnect to be called")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) == 0 || attempts[0] != 1 {
+		t.Fatalf("expects OnRetry to be called from attempt 1: %v", attempts)
+	}
+
+	// OnDisconnect must not be called again by Close.
+	consumer.Close()
+	select {
+	case e := <-disconnectCh:
+		t.Fatalf("expects OnDisconnect not to be called again: %v", e)
+	default:
+	}
+}
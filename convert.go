@@ -0,0 +1,28 @@
+package nozzle
+
+import (
+	"code.cloudfoundry.org/go-loggregator/conversion"
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// ToV1 converts loggregator V2 envelope to V1 (sonde-go) envelopes.
+// One V2 envelope can be converted to multiple V1 envelopes (e.g., gauge
+// with multiple metrics). It returns nil if the envelope can not be
+// converted (e.g., event envelope).
+//
+// Some information can be lost by the conversion (e.g., tags which
+// don't exist in V1 or timer fields). The returned envelopes may share
+// pointers with the given envelope.
+func ToV1(e *loggregator_v2.Envelope) []*events.Envelope {
+	return conversion.ToV1(e)
+}
+
+// ToV2 converts V1 (sonde-go) envelope to loggregator V2 envelope.
+// V1 fields like origin or deployment are set as V2 tags.
+//
+// The given envelope may be mutated and share pointers with the returned
+// envelope, so it should not be used after conversion.
+func ToV2(e *events.Envelope) *loggregator_v2.Envelope {
+	return conversion.ToV2(e, true)
+}
@@ -0,0 +1,74 @@
+package nozzle
+
+import (
+	"testing"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestToV2(t *testing.T) {
+	in := &events.Envelope{
+		Origin:     proto.String("doppler"),
+		EventType:  events.Envelope_ValueMetric.Enum(),
+		Timestamp:  proto.Int64(1234),
+		Deployment: proto.String("cf"),
+		Job:        proto.String("doppler"),
+		ValueMetric: &events.ValueMetric{
+			Name:  proto.String("numCPUS"),
+			Value: proto.Float64(4),
+			Unit:  proto.String("count"),
+		},
+	}
+
+	out := ToV2(in)
+	if out.GetTimestamp() != 1234 {
+		t.Fatalf("expect %d to be eq %d", out.GetTimestamp(), 1234)
+	}
+
+	if out.GetTags()["origin"] != "doppler" {
+		t.Fatalf("expect %q to be eq %q", out.GetTags()["origin"], "doppler")
+	}
+
+	metric := out.GetGauge().GetMetrics()["numCPUS"]
+	if metric.GetValue() != 4 || metric.GetUnit() != "count" {
+		t.Fatalf("expect gauge metric to be converted: %v", metric)
+	}
+}
+
+func TestToV1(t *testing.T) {
+	in := &loggregator_v2.Envelope{
+		Timestamp: 1234,
+		SourceId:  "my-app-guid",
+		Tags: map[string]string{
+			"origin": "fake-origin-1",
+		},
+		Message: &loggregator_v2.Envelope_Log{
+			Log: &loggregator_v2.Log{
+				Payload: []byte("Hello"),
+				Type:    loggregator_v2.Log_ERR,
+			},
+		},
+	}
+
+	out := ToV1(in)
+	if len(out) != 1 {
+		t.Fatalf("expect %d to be eq %d", len(out), 1)
+	}
+
+	if out[0].GetEventType() != events.Envelope_LogMessage {
+		t.Fatalf("expect %v to be eq %v", out[0].GetEventType(), events.Envelope_LogMessage)
+	}
+
+	if out[0].GetOrigin() != "fake-origin-1" {
+		t.Fatalf("expect %q to be eq %q", out[0].GetOrigin(), "fake-origin-1")
+	}
+
+	logMessage := out[0].GetLogMessage()
+	if string(logMessage.GetMessage()) != "Hello" ||
+		logMessage.GetMessageType() != events.LogMessage_ERR ||
+		logMessage.GetAppId() != "my-app-guid" {
+		t.Fatalf("expect log message to be converted: %v", logMessage)
+	}
+}
@@ -4,56 +4,92 @@ import (
 	"fmt"
 	"log"
 
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
 	"github.com/cloudfoundry/sonde-go/events"
-	"github.com/gorilla/websocket"
 )
 
 // SlowDetectCh is channel used to send `slowConsumerAlert` event.
-type slowDetectCh chan error
+type SlowDetectCh chan error
 
 // SlowDetector defines the interface for detecting `slowConsumerAlert`
 // event. By default, defaultSlowDetetor is used. It implements same detection
 // logic as https://github.com/cloudfoundry-incubator/datadog-firehose-nozzle.
-type slowDetector interface {
+//
+// To change the detection policies, construct it by NewSlowDetector
+// and set it to Config.SlowDetector.
+type SlowDetector interface {
 	// Detect detects `slowConsumerAlert`. It works as pipe.
 	// It receives events from upstream (RawConsumer) and inspects that events
 	// and pass it to to downstream without modification.
 	//
 	// It returns SlowDetectCh and notify `slowConsumerAlert` there.
-	Detect(<-chan *events.Envelope, <-chan error) (<-chan *events.Envelope, <-chan error, slowDetectCh)
+	// The notified error should be *SlowConsumerAlert.
+	Detect(<-chan *events.Envelope, <-chan error) (<-chan *events.Envelope, <-chan error, SlowDetectCh)
+
+	// DetectV2 is same as Detect but it handles loggregator V2 envelopes.
+	DetectV2(<-chan *loggregator_v2.Envelope, <-chan error) (<-chan *loggregator_v2.Envelope, <-chan error, SlowDetectCh)
 
 	// Stop stops slow consumer detection. If any returns error.
 	Stop() error
 }
 
+// NewSlowDetector constructs SlowDetector which detects `slowConsumerAlert`
+// by the given policies. If no policy is given, DefaultDetectPolicies
+// is used. If logger is nil, output is discarded.
+func NewSlowDetector(logger *log.Logger, policies ...DetectPolicy) SlowDetector {
+	if logger == nil {
+		logger = defaultLogger
+	}
+
+	return &defaultSlowDetector{
+		logger:   logger,
+		policies: policies,
+	}
+}
+
 // defaultSlowDetector implements SlowDetector interface
 type defaultSlowDetector struct {
 	doneCh chan struct{}
 	logger *log.Logger
+
+	// stats counts envelopes, errors and alerts. It's set by
+	// consumer. If it's nil, nothing is counted.
+	stats *stats
+
+	// policies are used for detection. If it's empty,
+	// DefaultDetectPolicies is used.
+	policies []DetectPolicy
 }
 
 // Detect start to detect `slowConsumerAlert` event.
-func (sd *defaultSlowDetector) Detect(eventCh <-chan *events.Envelope, errCh <-chan error) (<-chan *events.Envelope, <-chan error, slowDetectCh) {
+func (sd *defaultSlowDetector) Detect(eventCh <-chan *events.Envelope, errCh <-chan error) (<-chan *events.Envelope, <-chan error, SlowDetectCh) {
 	sd.logger.Println("[INFO] Start detecting slowConsumerAlert event")
 
 	// Create new channel to pass producer
 	eventCh_ := make(chan *events.Envelope)
-	errCh_ := make(chan error)
 
 	// doneCh is used to cancel sending data to
 	// downstream process.
 	sd.doneCh = make(chan struct{})
 
 	// deteCh is used to send `slowConsumerAlert` event
-	detectCh := make(slowDetectCh)
+	detectCh := make(SlowDetectCh)
+
+	policies := sd.detectPolicies()
 
 	// Detect from from trafficcontroller event messages
 	go func() {
 		defer close(eventCh_)
 		for event := range eventCh {
+			sd.stats.addEnvelope(event)
+
 			// Check nozzle can catch up firehose outputs speed.
-			if isTruncated(event) {
-				detectCh <- fmt.Errorf("doppler dropped messages from its queue because nozzle is slow")
+			for _, p := range policies {
+				if err := p.CheckEnvelope(event); err != nil {
+					if !sd.notify(detectCh, err) {
+						return
+					}
+				}
 			}
 
 			select {
@@ -67,26 +103,82 @@ func (sd *defaultSlowDetector) Detect(eventCh <-chan *events.Envelope, errCh <-c
 		}
 	}()
 
-	// Detect from websocket errors
+	return eventCh_, sd.detectErrors(policies, errCh, detectCh), detectCh
+}
+
+// DetectV2 is same as Detect but it handles loggregator V2 envelopes.
+// If policy doesn't implement DetectPolicyV2, the envelope is converted
+// to V1 for it.
+func (sd *defaultSlowDetector) DetectV2(eventCh <-chan *loggregator_v2.Envelope, errCh <-chan error) (<-chan *loggregator_v2.Envelope, <-chan error, SlowDetectCh) {
+	sd.logger.Println("[INFO] Start detecting slowConsumerAlert event")
+
+	eventCh_ := make(chan *loggregator_v2.Envelope)
+	sd.doneCh = make(chan struct{})
+	detectCh := make(SlowDetectCh)
+
+	policies := sd.detectPolicies()
+
+	go func() {
+		defer close(eventCh_)
+		for event := range eventCh {
+			sd.stats.addEnvelopeV2(event)
+
+			// v1Events is converted only once when it's needed.
+			var v1Events []*events.Envelope
+			converted := false
+
+			for _, p := range policies {
+				var errs []error
+				if pv2, ok := p.(DetectPolicyV2); ok {
+					if err := pv2.CheckEnvelopeV2(event); err != nil {
+						errs = append(errs, err)
+					}
+				} else {
+					if !converted {
+						v1Events, converted = ToV1(event), true
+					}
+					for _, e := range v1Events {
+						if err := p.CheckEnvelope(e); err != nil {
+							errs = append(errs, err)
+						}
+					}
+				}
+
+				for _, err := range errs {
+					if !sd.notify(detectCh, err) {
+						return
+					}
+				}
+			}
+
+			select {
+			case eventCh_ <- event:
+			case <-sd.doneCh:
+				return
+			}
+		}
+	}()
+
+	return eventCh_, sd.detectErrors(policies, errCh, detectCh), detectCh
+}
+
+// detectErrors detects `slowConsumerAlert` from errors of upstream
+// (e.g., websocket errors) and pass errors to downstream.
+func (sd *defaultSlowDetector) detectErrors(policies []DetectPolicy, errCh <-chan error, detectCh SlowDetectCh) <-chan error {
+	errCh_ := make(chan error)
 	go func() {
 		defer close(errCh_)
 		for err := range errCh {
-			switch t := err.(type) {
-			case *websocket.CloseError:
-				if t.Code == websocket.ClosePolicyViolation {
-					// ClosePolicyViolation (1008)
-					// indicates that an endpoint is terminating the connection
-					// because it has received a message that violates its policy.
-					//
-					// This is a generic status code that can be returned when there is no
-					// other more suitable status code (e.g., 1003 or 1009) or if there
-					// is a need to hide specific details about the policy.
-					//
-					// http://tools.ietf.org/html/rfc6455#section-11.7
-					detectCh <- fmt.Errorf(
-						"websocket terminates the connection because connection is too slow (ClosePolicyViolation)")
+			sd.stats.addError()
+
+			for _, p := range policies {
+				if alert := p.CheckError(err); alert != nil {
+					if !sd.notify(detectCh, alert) {
+						return
+					}
 				}
 			}
+
 			select {
 			case errCh_ <- err:
 			case <-sd.doneCh:
@@ -98,7 +190,29 @@ func (sd *defaultSlowDetector) Detect(eventCh <-chan *events.Envelope, errCh <-c
 		}
 	}()
 
-	return eventCh_, errCh_, detectCh
+	return errCh_
+}
+
+// notify sends `slowConsumerAlert` to detectCh as *SlowConsumerAlert.
+// It returns false if detector is stopped before sending.
+func (sd *defaultSlowDetector) notify(detectCh SlowDetectCh, err error) bool {
+	alert := toAlert(err)
+	select {
+	case detectCh <- alert:
+		sd.stats.addAlert(alert.Kind)
+		return true
+	case <-sd.doneCh:
+		return false
+	}
+}
+
+// detectPolicies returns the policies used for detection.
+func (sd *defaultSlowDetector) detectPolicies() []DetectPolicy {
+	if len(sd.policies) == 0 {
+		return DefaultDetectPolicies()
+	}
+
+	return sd.policies
 }
 
 func (sd *defaultSlowDetector) Stop() error {
@@ -111,6 +225,23 @@ func (sd *defaultSlowDetector) Stop() error {
 	return nil
 }
 
+// truncatedV1 returns V1 envelope converted from the V2 envelope if it's
+// truncation message. Otherwise, it returns nil.
+func truncatedV1(envelope *loggregator_v2.Envelope) *events.Envelope {
+	// Only counter can be truncation message. Skip converting others.
+	if envelope.GetCounter() == nil {
+		return nil
+	}
+
+	for _, e := range ToV1(envelope) {
+		if isTruncated(e) {
+			return e
+		}
+	}
+
+	return nil
+}
+
 // isTruncated detects message from the Doppler that the nozzle
 // could not consume messages as quickly as the firehose was sending them.
 func isTruncated(envelope *events.Envelope) bool {
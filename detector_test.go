@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gorilla/websocket"
 )
@@ -19,7 +20,7 @@ var (
 )
 
 func TestDefaultSlowDetector_implement(t *testing.T) {
-	var _ slowDetector = &defaultSlowDetector{}
+	var _ SlowDetector = &defaultSlowDetector{}
 }
 
 func TestDefaultSlowDetectorClose(t *testing.T) {
@@ -160,3 +161,97 @@ func TestIsTruncated(t *testing.T) {
 		}
 	}
 }
+
+func TestDefaultDetectV2_eventCh(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		Input  *loggregator_v2.Envelope
+		Expect bool
+	}{
+		{
+			Input: ToV2(&events.Envelope{
+				Origin:    &TR_Origin,
+				EventType: &TR_EventType,
+				CounterEvent: &events.CounterEvent{
+					Name: &TR_EventName,
+				},
+			}),
+			Expect: true,
+		},
+
+		{
+			Input:  &loggregator_v2.Envelope{},
+			Expect: false,
+		},
+	}
+
+	testDetector := &defaultSlowDetector{
+		logger: log.New(ioutil.Discard, "", log.LstdFlags),
+	}
+
+	eventCh := make(chan *loggregator_v2.Envelope)
+	errCh := make(chan error)
+	outCh, _, detectCh := testDetector.DetectV2(eventCh, errCh)
+
+	for _, tc := range cases {
+		// Send the events
+		go func() {
+			eventCh <- tc.Input
+		}()
+
+		select {
+		case <-detectCh:
+			if !tc.Expect {
+				t.Fatalf("expect not to be detected")
+			}
+			<-outCh
+		case <-outCh:
+			if tc.Expect {
+				t.Fatalf("expect to be detected")
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expect not timeout")
+		}
+	}
+}
+
+func TestNewSlowDetector(t *testing.T) {
+	t.Parallel()
+
+	// Detect only when 10 messages are dropped in window
+	detector := NewSlowDetector(nil, DetectDroppedRate(10, 1*time.Minute))
+
+	eventCh := make(chan *events.Envelope)
+	errCh := make(chan error)
+	outCh, _, detectCh := detector.Detect(eventCh, errCh)
+	defer detector.Stop()
+
+	cases := []struct {
+		Input  *events.Envelope
+		Expect bool
+	}{
+		{Input: newTruncatedEvent(5), Expect: false},
+		{Input: newTruncatedEvent(5), Expect: true},
+	}
+
+	for i, tc := range cases {
+		go func() {
+			eventCh <- tc.Input
+		}()
+
+		select {
+		case <-detectCh:
+			if !tc.Expect {
+				t.Fatalf("#%d expect not to be detected", i)
+			}
+			<-outCh
+		case <-outCh:
+			if tc.Expect {
+				t.Fatalf("#%d expect to be detected", i)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("#%d expect not timeout", i)
+		}
+	}
+}
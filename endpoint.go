@@ -0,0 +1,337 @@
+package nozzle
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// EndpointStrategy defines how to use multiple doppler endpoints
+// (Config.DopplerAddrs).
+type EndpointStrategy int
+
+const (
+	// EndpointFailover connects to the endpoints in order. It keeps
+	// using the current endpoint until its connection is lost (noaa
+	// gave up after RetryCount) and then switches to the next one.
+	EndpointFailover EndpointStrategy = iota
+
+	// EndpointRoundRobin switches to the next endpoint on every
+	// reconnect to spread connections across the endpoints.
+	EndpointRoundRobin
+
+	// EndpointAll connects to all endpoints at once and merges their
+	// envelopes into the same channel. Firehose distributes envelopes
+	// among the connections with the same SubscriptionID, so
+	// envelopes are not duplicated.
+	EndpointAll
+)
+
+func (s EndpointStrategy) String() string {
+	switch s {
+	case EndpointFailover:
+		return "Failover"
+	case EndpointRoundRobin:
+		return "RoundRobin"
+	case EndpointAll:
+		return "All"
+	default:
+		return fmt.Sprintf("EndpointStrategy(%d)", int(s))
+	}
+}
+
+// dopplerAddrs returns the doppler endpoints of the config. DopplerAddr
+// is the first one if it's set. Duplicates are removed.
+func dopplerAddrs(config *Config) []string {
+	addrs := make([]string, 0, len(config.DopplerAddrs)+1)
+	seen := make(map[string]struct{})
+	for _, addr := range append([]string{config.DopplerAddr}, config.DopplerAddrs...) {
+		if addr == "" {
+			continue
+		}
+
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+		seen[addr] = struct{}{}
+		addrs = append(addrs, addr)
+	}
+
+	return addrs
+}
+
+// endpointSelector selects the endpoint for the next connection.
+type endpointSelector struct {
+	addrs    []string
+	strategy EndpointStrategy
+
+	// mu protects next.
+	mu   sync.Mutex
+	next int
+}
+
+// pick returns the endpoint to connect.
+func (s *endpointSelector) pick() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addr := s.addrs[s.next]
+	if s.strategy == EndpointRoundRobin {
+		s.next = (s.next + 1) % len(s.addrs)
+	}
+	return addr
+}
+
+// failed is called when the connection to the endpoint is lost.
+func (s *endpointSelector) failed(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.strategy == EndpointFailover && s.addrs[s.next] == addr {
+		s.next = (s.next + 1) % len(s.addrs)
+	}
+}
+
+// rawEndpointConsumer implements RawConsumer. It consumes from multiple
+// doppler endpoints by the strategy. Connections to each endpoint are
+// created by newRawConsumer.
+//
+// It can be consumed again after Close (the selected endpoint is kept),
+// so it's reused by supervised mode.
+type rawEndpointConsumer struct {
+	// newRawConsumer creates new RawConsumer for the endpoint.
+	newRawConsumer func(addr string) (RawConsumer, error)
+
+	selector *endpointSelector
+	logger   *log.Logger
+
+	// mu protects the following fields.
+	mu      sync.Mutex
+	current map[string]RawConsumer
+	doneCh  chan struct{}
+	stopped bool
+}
+
+// Consume starts consuming from the endpoints.
+func (c *rawEndpointConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
+	return c.ConsumeContext(context.Background())
+}
+
+// ConsumeContext starts consuming from the endpoints. With
+// EndpointFailover and EndpointRoundRobin, it switches to the next
+// endpoint when the connection is lost and it finishes when all
+// endpoints are failed in a row. With EndpointAll, it finishes when
+// the connections to all endpoints are lost.
+func (c *rawEndpointConsumer) ConsumeContext(ctx context.Context) (<-chan *events.Envelope, <-chan error) {
+	eventCh, errCh := make(chan *events.Envelope), make(chan error)
+	doneCh := c.start()
+
+	var wg sync.WaitGroup
+	if c.selector.strategy == EndpointAll {
+		for _, addr := range c.selector.addrs {
+			addr := addr
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.run(ctx, eventCh, errCh, doneCh, func() string { return addr }, 1)
+			}()
+		}
+	} else {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.run(ctx, eventCh, errCh, doneCh, c.selector.pick, len(c.selector.addrs))
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(eventCh)
+		close(errCh)
+	}()
+
+	return eventCh, errCh
+}
+
+// start initializes doneCh and returns it.
+func (c *rawEndpointConsumer) start() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = make(map[string]RawConsumer)
+	c.doneCh = make(chan struct{})
+	c.stopped = false
+	return c.doneCh
+}
+
+// run connects to the endpoint returned by pick until the connections
+// are lost maxFailures times in a row. The count is reset when any
+// event is received by the connection.
+func (c *rawEndpointConsumer) run(ctx context.Context, eventCh chan<- *events.Envelope, errCh chan<- error, doneCh <-chan struct{}, pick func() string, maxFailures int) {
+	failures := 0
+	for failures < maxFailures {
+		addr := pick()
+
+		rc, err := c.newRawConsumer(addr)
+		if err != nil {
+			c.logger.Printf("[ERROR] Failed to create consumer for %s: %s", addr, err)
+			c.selector.failed(addr)
+			failures++
+			select {
+			case errCh <- err:
+			case <-doneCh:
+				return
+			}
+			continue
+		}
+
+		// Start consuming with the lock not to miss closing the
+		// connection by Close.
+		var upstream <-chan *events.Envelope
+		var upstreamErrCh <-chan error
+		c.mu.Lock()
+		if c.stopped {
+			c.mu.Unlock()
+			return
+		}
+		if cc, ok := rc.(RawContextConsumer); ok {
+			upstream, upstreamErrCh = cc.ConsumeContext(ctx)
+		} else {
+			upstream, upstreamErrCh = rc.Consume()
+		}
+		c.current[addr] = rc
+		c.mu.Unlock()
+
+		var received int32
+		forwardDoneCh := make(chan struct{})
+		go func() {
+			defer close(forwardDoneCh)
+			for event := range upstream {
+				atomic.StoreInt32(&received, 1)
+				select {
+				case eventCh <- event:
+				case <-doneCh:
+					return
+				}
+			}
+		}()
+
+		for err := range upstreamErrCh {
+			select {
+			case errCh <- err:
+			case <-doneCh:
+			}
+		}
+
+		// Connection is lost. Close it before switching (If it's
+		// stopped, it's already closed by Close).
+		c.mu.Lock()
+		stopped := c.stopped
+		if !stopped {
+			delete(c.current, addr)
+		}
+		c.mu.Unlock()
+
+		if !stopped {
+			if err := rc.Close(); err != nil {
+				c.logger.Printf("[DEBUG] Failed to close lost connection: %s", err)
+			}
+		}
+
+		// Wait until forwarding events is finished not to send
+		// events to closed channel.
+		<-forwardDoneCh
+
+		if stopped || ctx.Err() != nil {
+			return
+		}
+
+		if atomic.LoadInt32(&received) == 1 {
+			failures = 0
+		}
+		failures++
+		c.selector.failed(addr)
+
+		if failures < maxFailures {
+			c.logger.Printf("[INFO] Connection to %s is lost, switch to next endpoint", addr)
+		}
+	}
+
+	c.logger.Printf("[ERROR] Connections to endpoints are lost %d times in a row", failures)
+}
+
+// Close closes the connections to all endpoints.
+func (c *rawEndpointConsumer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.doneCh == nil || c.stopped {
+		return fmt.Errorf("no connection with firehose")
+	}
+
+	c.stopped = true
+	close(c.doneCh)
+
+	var firstErr error
+	for _, rc := range c.current {
+		if err := rc.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// supervise makes the connection to each endpoint supervised (it's
+// re-created when it's lost), so the other endpoints keep consuming
+// while one is reconnecting. It's used for EndpointAll with
+// Config.Reconnect.
+func (c *rawEndpointConsumer) supervise(config *Config) {
+	newRC := c.newRawConsumer
+	c.newRawConsumer = func(addr string) (RawConsumer, error) {
+		rc, err := newRC(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return newSupervisedRawConsumer(config, rc, func() (RawConsumer, error) {
+			return newRC(addr)
+		}), nil
+	}
+}
+
+// newRawEndpointConsumer constructs rawEndpointConsumer which connects
+// to the given doppler endpoints.
+func newRawEndpointConsumer(config *Config, addrs []string) (*rawEndpointConsumer, error) {
+	switch config.EndpointStrategy {
+	case EndpointFailover, EndpointRoundRobin, EndpointAll:
+	default:
+		return nil, fmt.Errorf("unknown EndpointStrategy: %s", config.EndpointStrategy)
+	}
+
+	newRC := func(addr string) (RawConsumer, error) {
+		endpointConfig := *config
+		endpointConfig.DopplerAddr = addr
+		endpointConfig.DopplerAddrs = nil
+		return newRawDefaultConsumer(&endpointConfig)
+	}
+
+	// Validate the config for all endpoints beforehand.
+	for _, addr := range addrs {
+		if _, err := newRC(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	return &rawEndpointConsumer{
+		newRawConsumer: newRC,
+		selector: &endpointSelector{
+			addrs:    addrs,
+			strategy: config.EndpointStrategy,
+		},
+		logger: config.Logger,
+	}, nil
+}
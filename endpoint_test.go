@@ -0,0 +1,252 @@
+package nozzle
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRawEndpointConsumer_implement(t *testing.T) {
+	var _ RawConsumer = &rawEndpointConsumer{}
+	var _ RawContextConsumer = &rawEndpointConsumer{}
+}
+
+func TestDopplerAddrs(t *testing.T) {
+	cases := []struct {
+		config *Config
+		expect []string
+	}{
+		{
+			config: &Config{},
+			expect: []string{},
+		},
+		{
+			config: &Config{DopplerAddr: "wss://a"},
+			expect: []string{"wss://a"},
+		},
+		{
+			config: &Config{DopplerAddrs: []string{"wss://a", "wss://b"}},
+			expect: []string{"wss://a", "wss://b"},
+		},
+		{
+			config: &Config{DopplerAddr: "wss://b", DopplerAddrs: []string{"wss://a", "", "wss://b"}},
+			expect: []string{"wss://b", "wss://a"},
+		},
+	}
+
+	for i, tc := range cases {
+		if got := dopplerAddrs(tc.config); !reflect.DeepEqual(got, tc.expect) {
+			t.Fatalf("#%d expects %v to be eq %v", i, got, tc.expect)
+		}
+	}
+}
+
+func TestEndpointSelector(t *testing.T) {
+	cases := []struct {
+		strategy EndpointStrategy
+		failed   []bool
+		expect   []string
+	}{
+		{
+			strategy: EndpointFailover,
+			failed:   []bool{false, false, true, false, true, true},
+			expect:   []string{"a", "a", "a", "b", "b", "c"},
+		},
+		{
+			strategy: EndpointRoundRobin,
+			failed:   []bool{false, true, false, false},
+			expect:   []string{"a", "b", "c", "a"},
+		},
+	}
+
+	for i, tc := range cases {
+		s := &endpointSelector{
+			addrs:    []string{"a", "b", "c"},
+			strategy: tc.strategy,
+		}
+
+		got := make([]string, 0, len(tc.expect))
+		for _, failed := range tc.failed {
+			addr := s.pick()
+			got = append(got, addr)
+			if failed {
+				s.failed(addr)
+			}
+		}
+
+		if !reflect.DeepEqual(got, tc.expect) {
+			t.Fatalf("#%d expects %v to be eq %v", i, got, tc.expect)
+		}
+	}
+}
+
+func TestNewConsumer_dopplerAddrs_invalid(t *testing.T) {
+	cases := []struct {
+		config *Config
+		errStr string
+	}{
+		{
+			config: &Config{
+				DopplerAddrs:     []string{"wss://a", "wss://b"},
+				EndpointStrategy: EndpointStrategy(10),
+			},
+			errStr: "unknown EndpointStrategy",
+		},
+		{
+			config: &Config{
+				DopplerAddrs: []string{"wss://a", "wss://b"},
+				AppGUIDs:     []string{"app-1"},
+			},
+			errStr: "AppGUIDs can not be used",
+		},
+		{
+			config: &Config{
+				DopplerAddrs: []string{"wss://a", "wss://b"},
+			},
+			errStr: "SubscriptionID must not be empty",
+		},
+		{
+			config: &Config{
+				DopplerAddrs:   []string{"wss://a", "wss://b"},
+				RLPGatewayAddr: "https://log-stream.example.com",
+				SubscriptionID: "go-nozzle",
+			},
+			errStr: "DopplerAddrs can not be used with RLPGatewayAddr",
+		},
+		{
+			config: &Config{
+				RLPGatewayAddr:   "https://log-stream.example.com",
+				EndpointStrategy: EndpointAll,
+				SubscriptionID:   "go-nozzle",
+			},
+			errStr: "EndpointStrategy can not be used with RLPGatewayAddr",
+		},
+	}
+
+	for i, tc := range cases {
+		tc.config.Token = "token"
+		_, err := NewConsumer(tc.config)
+		if err == nil || !strings.Contains(err.Error(), tc.errStr) {
+			t.Fatalf("#%d expects %v to contain %q", i, err, tc.errStr)
+		}
+	}
+}
+
+func TestConsumer_endpointFailover(t *testing.T) {
+	t.Parallel()
+
+	inputCh := make(chan []byte, 1)
+	authToken := "n98ubNOIUog9gOPUbvqiur"
+
+	ts := NewDopplerServer(t, inputCh, authToken)
+	defer ts.Close()
+
+	// The first endpoint is down.
+	down := httptest.NewServer(nil)
+	down.Close()
+
+	downAddr := strings.Replace(down.URL, "http:", "ws:", 1)
+	upAddr := strings.Replace(ts.URL, "http:", "ws:", 1)
+
+	consumer, err := NewConsumer(&Config{
+		DopplerAddrs:     []string{downAddr, upAddr},
+		EndpointStrategy: EndpointFailover,
+		Token:            authToken,
+		SubscriptionID:   "test-go-nozzle-A",
+		RetryCount:       2,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	go func() {
+		for range consumer.Errors() {
+		}
+	}()
+
+	eventBytes, err := NewEvent("Hello from secondary", time.Now().UnixNano())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	inputCh <- eventBytes
+
+	select {
+	case event := <-consumer.Events():
+		if got := string(event.GetLogMessage().Message); got != "Hello from secondary" {
+			t.Fatalf("expects %q to be eq %q", got, "Hello from secondary")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expects event to be received from secondary endpoint")
+	}
+
+	endpoints := consumer.Stats().Endpoints
+	if h := endpoints[downAddr]; h.Healthy || h.Failures == 0 || h.LastError == nil {
+		t.Fatalf("expects %s to be unhealthy: %#v", downAddr, h)
+	}
+
+	if h := endpoints[upAddr]; !h.Healthy || h.Connects != 1 {
+		t.Fatalf("expects %s to be healthy: %#v", upAddr, h)
+	}
+}
+
+func TestConsumer_endpointAll(t *testing.T) {
+	t.Parallel()
+
+	authToken := "n98ubNOIUog9gOPUbvqiur"
+
+	messages := []string{"Hello from A", "Hello from B"}
+	addrs := make([]string, 0, len(messages))
+	for _, message := range messages {
+		inputCh := make(chan []byte, 1)
+		ts := NewDopplerServer(t, inputCh, authToken)
+		defer ts.Close()
+
+		eventBytes, err := NewEvent(message, time.Now().UnixNano())
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		inputCh <- eventBytes
+
+		addrs = append(addrs, strings.Replace(ts.URL, "http:", "ws:", 1))
+	}
+
+	consumer, err := NewConsumer(&Config{
+		DopplerAddrs:     addrs,
+		EndpointStrategy: EndpointAll,
+		Token:            authToken,
+		SubscriptionID:   "test-go-nozzle-A",
+		Reconnect:        true,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	received := make(map[string]bool)
+	for len(received) < len(messages) {
+		select {
+		case event := <-consumer.Events():
+			received[string(event.GetLogMessage().Message)] = true
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expects events to be received from all endpoints: %v", received)
+		}
+	}
+
+	endpoints := consumer.Stats().Endpoints
+	for _, addr := range addrs {
+		if h := endpoints[addr]; !h.Healthy || h.Connects != 1 {
+			t.Fatalf("expects %s to be healthy: %#v", addr, h)
+		}
+	}
+}
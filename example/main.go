@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
@@ -28,6 +29,10 @@ const (
 	// UAATimeout is timeout duration while waiting getting
 	// access token from UAA
 	UAATimeout = 60 * time.Second
+
+	// CloseTimeout is timeout duration while waiting closing
+	// nozzle consumer
+	CloseTimeout = 10 * time.Second
 )
 
 func main() {
@@ -52,6 +57,9 @@ func run(args []string) int {
 		SubscriptionID: SubscriptionID,
 		Insecure:       insecure,
 		Logger:         log.New(os.Stdout, "", log.LstdFlags),
+
+		// Receive only ValueMetric.
+		Filter: nozzle.FilterEventTypes(events.Envelope_ValueMetric),
 	}
 
 	consumer, err := nozzle.NewConsumer(config)
@@ -60,8 +68,13 @@ func run(args []string) int {
 		return 1
 	}
 
-	// Start consumer
-	consumer.Start()
+	// Start consumer. It's stopped when ctx is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := consumer.StartContext(ctx); err != nil {
+		log.Printf("[ERROR] Failed to start nozzle consumer: %s", err)
+		return 1
+	}
 
 	log.Printf("[INFO] Start example producer")
 	doneCh := make(chan struct{})
@@ -69,32 +82,38 @@ func run(args []string) int {
 		defer close(doneCh)
 		for {
 			select {
-			case event := <-consumer.Events():
-				if event.GetEventType() != events.Envelope_ValueMetric {
-					continue
+			case event, ok := <-consumer.Events():
+				if !ok {
+					return
 				}
 				log.Printf("[INFO] ValueMetric: %v", event.GetValueMetric())
-			case <-consumer.Detects():
-				log.Printf("[WARN] Detected SlowConsumerAlert")
+			case err := <-consumer.Detects():
+				if alert, ok := err.(*nozzle.SlowConsumerAlert); ok {
+					log.Printf("[WARN] Detected SlowConsumerAlert (%s) from %s: dropped %d messages",
+						alert.Kind, alert.Origin, alert.Dropped)
+					continue
+				}
+				log.Printf("[WARN] Detected SlowConsumerAlert: %s", err)
 			case err := <-consumer.Errors():
-				log.Printf("[ERROR] Failed to consume nozzle events", err)
+				log.Printf("[ERROR] Failed to consume nozzle events: %s", err)
 				return
 			}
 		}
 	}()
 
 	// Handle signaling
-	signalCh := make(chan os.Signal)
-	signal.Notify(signalCh, os.Interrupt, os.Kill)
-	go func() {
-		<-signalCh
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt)
+	select {
+	case <-signalCh:
 		log.Printf("[INFO] Interrupt Received")
-		close(doneCh)
-	}()
+	case <-doneCh:
+	}
 
-	<-doneCh
 	log.Printf("[INFO] nozzle: close nozzle consumer")
-	if err := consumer.Close(); err != nil {
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), CloseTimeout)
+	defer closeCancel()
+	if err := consumer.CloseContext(closeCtx); err != nil {
 		log.Printf("[ERROR] nozzle: failed to close nozzle consumer: %s", err)
 		return 1
 	}
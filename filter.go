@@ -0,0 +1,423 @@
+package nozzle
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Filter selects envelopes delivered to Consumer (Config.Filter).
+// Filters can be composed by FilterAll, FilterAny and FilterNot.
+//
+// Match is called for every envelope which passes through the consumer.
+// It may be called from different goroutines.
+type Filter interface {
+	// Name is the name of the filter. Envelopes dropped by the filter
+	// are counted by the name in Stats.Filtered.
+	Name() string
+
+	// Match returns true if the envelope should be delivered.
+	Match(*events.Envelope) bool
+}
+
+// FilterV2 is implemented by Filter which can inspect loggregator V2
+// envelope directly. If Filter doesn't implement this, V2 envelope is
+// converted to V1 and it matches if one of the converted envelopes
+// matches.
+type FilterV2 interface {
+	// MatchV2 is same as Match but for V2 envelope.
+	MatchV2(*loggregator_v2.Envelope) bool
+}
+
+// FilterFunc returns the filter which matches envelopes by the function.
+func FilterFunc(name string, f func(*events.Envelope) bool) Filter {
+	return &funcFilter{name: name, f: f}
+}
+
+type funcFilter struct {
+	name string
+	f    func(*events.Envelope) bool
+}
+
+func (f *funcFilter) Name() string {
+	return f.name
+}
+
+func (f *funcFilter) Match(e *events.Envelope) bool {
+	return f.f(e)
+}
+
+// FilterEventTypes returns the filter which matches envelopes of the
+// event types. For V2 envelopes, log matches LogMessage, counter
+// matches CounterEvent, gauge matches ValueMetric or ContainerMetric
+// and timer matches HttpStartStop.
+func FilterEventTypes(types ...events.Envelope_EventType) Filter {
+	return &eventTypeFilter{types: types}
+}
+
+type eventTypeFilter struct {
+	types []events.Envelope_EventType
+}
+
+func (f *eventTypeFilter) Name() string {
+	return "event_type"
+}
+
+func (f *eventTypeFilter) Match(e *events.Envelope) bool {
+	return f.has(e.GetEventType())
+}
+
+func (f *eventTypeFilter) MatchV2(e *loggregator_v2.Envelope) bool {
+	if _, ok := e.GetMessage().(*loggregator_v2.Envelope_Gauge); ok {
+		return f.has(events.Envelope_ValueMetric) || f.has(events.Envelope_ContainerMetric)
+	}
+	return f.has(eventTypeV2(e))
+}
+
+func (f *eventTypeFilter) has(t events.Envelope_EventType) bool {
+	for _, typ := range f.types {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterOrigins returns the filter which matches envelopes from the
+// origins (e.g., "rep"). For V2 envelopes, "origin" tag is used.
+func FilterOrigins(origins ...string) Filter {
+	return &fieldFilter{
+		name:   "origin",
+		values: origins,
+		field:  (*events.Envelope).GetOrigin,
+		tag:    "origin",
+	}
+}
+
+// FilterDeployments returns the filter which matches envelopes from the
+// BOSH deployments. For V2 envelopes, "deployment" tag is used.
+func FilterDeployments(deployments ...string) Filter {
+	return &fieldFilter{
+		name:   "deployment",
+		values: deployments,
+		field:  (*events.Envelope).GetDeployment,
+		tag:    "deployment",
+	}
+}
+
+// FilterJobs returns the filter which matches envelopes from the BOSH
+// jobs (e.g., "diego_cell"). For V2 envelopes, "job" tag is used.
+func FilterJobs(jobs ...string) Filter {
+	return &fieldFilter{
+		name:   "job",
+		values: jobs,
+		field:  (*events.Envelope).GetJob,
+		tag:    "job",
+	}
+}
+
+// FilterAppGUIDs returns the filter which matches envelopes of the
+// applications (LogMessage, ContainerMetric and HttpStartStop). For V2
+// envelopes, source ID is used.
+func FilterAppGUIDs(guids ...string) Filter {
+	return &fieldFilter{
+		name:   "app_guid",
+		values: guids,
+		field:  appGUID,
+		source: true,
+	}
+}
+
+// FilterTag returns the filter which matches envelopes whose tag of the
+// key is one of the values. If no value is given, it matches envelopes
+// which have the tag.
+func FilterTag(key string, values ...string) Filter {
+	return &fieldFilter{
+		name:   "tag:" + key,
+		values: values,
+		field: func(e *events.Envelope) string {
+			return e.GetTags()[key]
+		},
+		tag:     key,
+		present: len(values) == 0,
+	}
+}
+
+// fieldFilter matches envelopes whose field is one of the values.
+type fieldFilter struct {
+	name   string
+	values []string
+	field  func(*events.Envelope) string
+
+	// tag is the key of V2 tag which corresponds to the field. If source
+	// is true, source ID is used instead.
+	tag    string
+	source bool
+
+	// present is true when any non-empty value matches.
+	present bool
+}
+
+func (f *fieldFilter) Name() string {
+	return f.name
+}
+
+func (f *fieldFilter) Match(e *events.Envelope) bool {
+	return f.has(f.field(e))
+}
+
+func (f *fieldFilter) MatchV2(e *loggregator_v2.Envelope) bool {
+	if f.source {
+		return f.has(e.GetSourceId())
+	}
+	return f.has(e.GetTags()[f.tag])
+}
+
+func (f *fieldFilter) has(v string) bool {
+	if f.present {
+		return v != ""
+	}
+
+	for _, value := range f.values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterAll returns the filter which matches envelopes matched by all
+// the filters. When it's used as Config.Filter, dropped envelopes are
+// counted by the name of the first filter which didn't match.
+func FilterAll(filters ...Filter) Filter {
+	return &allFilter{filters: filters}
+}
+
+type allFilter struct {
+	filters []Filter
+}
+
+func (f *allFilter) Name() string {
+	return "all(" + filterNames(f.filters) + ")"
+}
+
+func (f *allFilter) Match(e *events.Envelope) bool {
+	for _, filter := range f.filters {
+		if !filter.Match(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *allFilter) MatchV2(e *loggregator_v2.Envelope) bool {
+	for _, filter := range f.filters {
+		if !matchV2(filter, e) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterAny returns the filter which matches envelopes matched by one
+// of the filters.
+func FilterAny(filters ...Filter) Filter {
+	return &anyFilter{filters: filters}
+}
+
+type anyFilter struct {
+	filters []Filter
+}
+
+func (f *anyFilter) Name() string {
+	return "any(" + filterNames(f.filters) + ")"
+}
+
+func (f *anyFilter) Match(e *events.Envelope) bool {
+	for _, filter := range f.filters {
+		if filter.Match(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *anyFilter) MatchV2(e *loggregator_v2.Envelope) bool {
+	for _, filter := range f.filters {
+		if matchV2(filter, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterNot returns the filter which matches envelopes not matched by
+// the filter.
+func FilterNot(filter Filter) Filter {
+	return &notFilter{filter: filter}
+}
+
+type notFilter struct {
+	filter Filter
+}
+
+func (f *notFilter) Name() string {
+	return "not(" + f.filter.Name() + ")"
+}
+
+func (f *notFilter) Match(e *events.Envelope) bool {
+	return !f.filter.Match(e)
+}
+
+func (f *notFilter) MatchV2(e *loggregator_v2.Envelope) bool {
+	return !matchV2(f.filter, e)
+}
+
+func filterNames(filters []Filter) string {
+	names := make([]string, 0, len(filters))
+	for _, f := range filters {
+		names = append(names, f.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// matchV2 matches V2 envelope by the filter. If the filter doesn't
+// implement FilterV2, the envelope is converted to V1.
+func matchV2(f Filter, e *loggregator_v2.Envelope) bool {
+	if fv2, ok := f.(FilterV2); ok {
+		return fv2.MatchV2(e)
+	}
+
+	for _, v1e := range ToV1(e) {
+		if f.Match(v1e) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectedBy returns the name of the filter which rejected the envelope.
+// It returns an empty string if the envelope matches.
+func rejectedBy(f Filter, e *events.Envelope) string {
+	if all, ok := f.(*allFilter); ok {
+		for _, filter := range all.filters {
+			if name := rejectedBy(filter, e); name != "" {
+				return name
+			}
+		}
+		return ""
+	}
+
+	if !f.Match(e) {
+		return f.Name()
+	}
+	return ""
+}
+
+// rejectedByV2 is same as rejectedBy but for V2 envelope.
+func rejectedByV2(f Filter, e *loggregator_v2.Envelope) string {
+	if all, ok := f.(*allFilter); ok {
+		for _, filter := range all.filters {
+			if name := rejectedByV2(filter, e); name != "" {
+				return name
+			}
+		}
+		return ""
+	}
+
+	if !matchV2(f, e) {
+		return f.Name()
+	}
+	return ""
+}
+
+// appGUID returns the application GUID of the envelope.
+func appGUID(e *events.Envelope) string {
+	switch e.GetEventType() {
+	case events.Envelope_LogMessage:
+		return e.GetLogMessage().GetAppId()
+	case events.Envelope_ContainerMetric:
+		return e.GetContainerMetric().GetApplicationId()
+	case events.Envelope_HttpStartStop:
+		return uuidString(e.GetHttpStartStop().GetApplicationId())
+	default:
+		return ""
+	}
+}
+
+// uuidString formats UUID in the same way as sonde-go.
+func uuidString(u *events.UUID) string {
+	if u == nil {
+		return ""
+	}
+
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], u.GetLow())
+	binary.LittleEndian.PutUint64(b[8:], u.GetHigh())
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// filterEvents drops envelopes which don't match Config.Filter.
+func (c *consumer) filterEvents(eventCh <-chan *events.Envelope) <-chan *events.Envelope {
+	eventCh_ := make(chan *events.Envelope)
+	go func() {
+		defer close(eventCh_)
+		for {
+			select {
+			case event, ok := <-eventCh:
+				if !ok {
+					return
+				}
+
+				if name := rejectedBy(c.filter, event); name != "" {
+					c.stats.addFiltered(name)
+					continue
+				}
+
+				select {
+				case eventCh_ <- event:
+				case <-c.doneCh:
+					return
+				}
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return eventCh_
+}
+
+// filterEventsV2 is same as filterEvents but for V2 envelopes.
+func (c *consumer) filterEventsV2(eventCh <-chan *loggregator_v2.Envelope) <-chan *loggregator_v2.Envelope {
+	eventCh_ := make(chan *loggregator_v2.Envelope)
+	go func() {
+		defer close(eventCh_)
+		for {
+			select {
+			case event, ok := <-eventCh:
+				if !ok {
+					return
+				}
+
+				if name := rejectedByV2(c.filter, event); name != "" {
+					c.stats.addFiltered(name)
+					continue
+				}
+
+				select {
+				case eventCh_ <- event:
+				case <-c.doneCh:
+					return
+				}
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return eventCh_
+}
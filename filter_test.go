@@ -0,0 +1,290 @@
+package nozzle
+
+import (
+	"testing"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestFilter_match(t *testing.T) {
+	logMessage := &events.Envelope{
+		Origin:     proto.String("rep"),
+		EventType:  events.Envelope_LogMessage.Enum(),
+		Deployment: proto.String("cf"),
+		Job:        proto.String("diego_cell"),
+		Tags:       map[string]string{"env": "prod"},
+		LogMessage: &events.LogMessage{
+			AppId: proto.String("app-guid"),
+		},
+	}
+
+	valueMetric := &events.Envelope{
+		Origin:      proto.String("gorouter"),
+		EventType:   events.Envelope_ValueMetric.Enum(),
+		Deployment:  proto.String("cf"),
+		Job:         proto.String("router"),
+		ValueMetric: &events.ValueMetric{},
+	}
+
+	cases := []struct {
+		filter Filter
+		name   string
+		expect []bool // logMessage, valueMetric
+	}{
+		{
+			filter: FilterEventTypes(events.Envelope_LogMessage),
+			name:   "event_type",
+			expect: []bool{true, false},
+		},
+		{
+			filter: FilterOrigins("gorouter", "doppler"),
+			name:   "origin",
+			expect: []bool{false, true},
+		},
+		{
+			filter: FilterDeployments("cf"),
+			name:   "deployment",
+			expect: []bool{true, true},
+		},
+		{
+			filter: FilterJobs("router"),
+			name:   "job",
+			expect: []bool{false, true},
+		},
+		{
+			filter: FilterAppGUIDs("app-guid"),
+			name:   "app_guid",
+			expect: []bool{true, false},
+		},
+		{
+			filter: FilterTag("env", "prod"),
+			name:   "tag:env",
+			expect: []bool{true, false},
+		},
+		{
+			filter: FilterTag("env"),
+			name:   "tag:env",
+			expect: []bool{true, false},
+		},
+		{
+			filter: FilterAll(FilterDeployments("cf"), FilterJobs("router")),
+			name:   "all(deployment,job)",
+			expect: []bool{false, true},
+		},
+		{
+			filter: FilterAny(FilterOrigins("rep"), FilterJobs("router")),
+			name:   "any(origin,job)",
+			expect: []bool{true, true},
+		},
+		{
+			filter: FilterNot(FilterOrigins("rep")),
+			name:   "not(origin)",
+			expect: []bool{false, true},
+		},
+		{
+			filter: FilterFunc("has_log", func(e *events.Envelope) bool {
+				return e.GetLogMessage() != nil
+			}),
+			name:   "has_log",
+			expect: []bool{true, false},
+		},
+	}
+
+	for i, tc := range cases {
+		if got := tc.filter.Name(); got != tc.name {
+			t.Fatalf("#%d expects %q to be eq %q", i, got, tc.name)
+		}
+
+		for j, e := range []*events.Envelope{logMessage, valueMetric} {
+			if got := tc.filter.Match(e); got != tc.expect[j] {
+				t.Fatalf("#%d expects %v to be eq %v for envelope %d", i, got, tc.expect[j], j)
+			}
+		}
+	}
+}
+
+func TestFilter_matchV2(t *testing.T) {
+	log := &loggregator_v2.Envelope{
+		SourceId: "app-guid",
+		Tags: map[string]string{
+			"origin":     "rep",
+			"deployment": "cf",
+		},
+		Message: &loggregator_v2.Envelope_Log{
+			Log: &loggregator_v2.Log{Payload: []byte("hello")},
+		},
+	}
+
+	gauge := &loggregator_v2.Envelope{
+		SourceId: "gorouter",
+		Tags: map[string]string{
+			"origin":     "gorouter",
+			"deployment": "cf",
+		},
+		Message: &loggregator_v2.Envelope_Gauge{
+			Gauge: &loggregator_v2.Gauge{
+				Metrics: map[string]*loggregator_v2.GaugeValue{
+					"latency": {Unit: "ms", Value: 10},
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		filter Filter
+		expect []bool // log, gauge
+	}{
+		{
+			filter: FilterEventTypes(events.Envelope_LogMessage),
+			expect: []bool{true, false},
+		},
+		{
+			filter: FilterEventTypes(events.Envelope_ContainerMetric),
+			expect: []bool{false, true},
+		},
+		{
+			filter: FilterOrigins("gorouter"),
+			expect: []bool{false, true},
+		},
+		{
+			filter: FilterAppGUIDs("app-guid"),
+			expect: []bool{true, false},
+		},
+		{
+			filter: FilterNot(FilterDeployments("cf")),
+			expect: []bool{false, false},
+		},
+		{
+			// Converted to V1.
+			filter: FilterFunc("has_value", func(e *events.Envelope) bool {
+				return e.GetValueMetric() != nil
+			}),
+			expect: []bool{false, true},
+		},
+	}
+
+	for i, tc := range cases {
+		for j, e := range []*loggregator_v2.Envelope{log, gauge} {
+			if got := matchV2(tc.filter, e); got != tc.expect[j] {
+				t.Fatalf("#%d expects %v to be eq %v for envelope %d", i, got, tc.expect[j], j)
+			}
+		}
+	}
+}
+
+func TestFilter_rejectedBy(t *testing.T) {
+	filter := FilterAll(
+		FilterEventTypes(events.Envelope_LogMessage),
+		FilterOrigins("rep"),
+	)
+
+	cases := []struct {
+		envelope *events.Envelope
+		expect   string
+	}{
+		{
+			envelope: &events.Envelope{
+				Origin:    proto.String("rep"),
+				EventType: events.Envelope_LogMessage.Enum(),
+			},
+			expect: "",
+		},
+		{
+			envelope: &events.Envelope{
+				Origin:    proto.String("rep"),
+				EventType: events.Envelope_ValueMetric.Enum(),
+			},
+			expect: "event_type",
+		},
+		{
+			envelope: &events.Envelope{
+				Origin:    proto.String("gorouter"),
+				EventType: events.Envelope_LogMessage.Enum(),
+			},
+			expect: "origin",
+		},
+	}
+
+	for i, tc := range cases {
+		if got := rejectedBy(filter, tc.envelope); got != tc.expect {
+			t.Fatalf("#%d expects %q to be eq %q", i, got, tc.expect)
+		}
+	}
+}
+
+func TestUUIDString(t *testing.T) {
+	u := &events.UUID{
+		Low:  proto.Uint64(0x0706050403020100),
+		High: proto.Uint64(0x0f0e0d0c0b0a0908),
+	}
+
+	expect := "00010203-0405-0607-0809-0a0b0c0d0e0f"
+	if got := uuidString(u); got != expect {
+		t.Fatalf("expects %q to be eq %q", got, expect)
+	}
+}
+
+func TestConsumer_filter(t *testing.T) {
+	rc := &replayRawConsumer{
+		Events: []*events.Envelope{
+			{
+				Origin:    proto.String("fake-origin"),
+				EventType: events.Envelope_LogMessage.Enum(),
+			},
+			{
+				Origin:    proto.String(TR_Origin),
+				EventType: events.Envelope_CounterEvent.Enum(),
+				CounterEvent: &events.CounterEvent{
+					Name:  proto.String(TR_EventName),
+					Delta: proto.Uint64(10),
+					Total: proto.Uint64(10),
+				},
+			},
+		},
+	}
+
+	consumer, err := NewConsumer(&Config{
+		RawConsumer: rc,
+		Filter:      FilterEventTypes(events.Envelope_LogMessage),
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	receivedCh := make(chan []*events.Envelope)
+	go func() {
+		var received []*events.Envelope
+		for event := range consumer.Events() {
+			received = append(received, event)
+		}
+		receivedCh <- received
+	}()
+
+	// Truncation is detected even if the envelope is filtered.
+	err = <-consumer.Detects()
+	if alert, ok := err.(*SlowConsumerAlert); !ok || alert.Kind != AlertTruncated {
+		t.Fatalf("expects %#v to be Truncated alert", err)
+	}
+
+	received := <-receivedCh
+
+	if len(received) != 1 || received[0].GetEventType() != events.Envelope_LogMessage {
+		t.Fatalf("expects %v to have only LogMessage", received)
+	}
+
+	st := consumer.Stats()
+	if st.Received != 2 {
+		t.Fatalf("expects %d to be eq 2", st.Received)
+	}
+
+	if st.Filtered["event_type"] != 1 {
+		t.Fatalf("expects %v to have event_type: 1", st.Filtered)
+	}
+}
@@ -0,0 +1,424 @@
+package nozzle
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	loggregator "code.cloudfoundry.org/go-loggregator"
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	// defaultRetryCount is the number of retries used when
+	// RetryCount is not set.
+	defaultRetryCount = 5
+
+	// maxRetryDelay is the maximum duration to wait before
+	// reconnecting to RLP gateway.
+	maxRetryDelay = 5 * time.Second
+)
+
+// rawRLPGatewayConsumer implements RawConsumer interface. It consumes
+// loggregator V2 envelopes from Reverse Log Proxy (RLP) gateway via
+// HTTP/SSE streaming and converts them to V1 (sonde-go) envelopes.
+//
+// It uses https://github.com/cloudfoundry/go-loggregator.
+type rawRLPGatewayConsumer struct {
+	rlpGatewayAddr string
+	token          string
+	subscriptionID string
+	insecure       bool
+	retryCount     int
+	tokenRefresher TokenSource
+	hooks          *Hooks
+
+	// transport has the TLS config, the proxy and the dialer.
+	transport *http.Transport
+
+	// cancel cancels streaming from RLP gateway.
+	cancel context.CancelFunc
+
+	// doer is used by the current stream.
+	doer *rlpGatewayDoer
+
+	logger *log.Logger
+}
+
+// Consume consumes events from RLP gateway.
+func (c *rawRLPGatewayConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
+	return c.ConsumeContext(context.Background())
+}
+
+// ConsumeContext consumes events from RLP gateway and converts them
+// to V1 envelopes. Streaming is stopped when the given context is done
+// or Close is called.
+func (c *rawRLPGatewayConsumer) ConsumeContext(ctx context.Context) (<-chan *events.Envelope, <-chan error) {
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+
+	v2EventCh, errCh := c.stream(ctx, cancel)
+
+	eventCh := make(chan *events.Envelope)
+	go func() {
+		defer close(eventCh)
+		for v2e := range v2EventCh {
+			for _, v1e := range ToV1(v2e) {
+				select {
+				case eventCh <- v1e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return eventCh, errCh
+}
+
+// ConsumeV2Context consumes V2 envelopes from RLP gateway without
+// conversion. Streaming is stopped when the given context is done
+// or Close is called.
+func (c *rawRLPGatewayConsumer) ConsumeV2Context(ctx context.Context) (<-chan *loggregator_v2.Envelope, <-chan error) {
+	ctx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+
+	return c.stream(ctx, cancel)
+}
+
+// stream starts streaming from RLP gateway. The stream is stopped
+// when ctx is done. cancel is used for stopping the stream when connecting
+// is failed more than retryCount times in a row.
+//
+// RLP gateway client reconnects by itself when stream is disconnected.
+func (c *rawRLPGatewayConsumer) stream(ctx context.Context, cancel context.CancelFunc) (<-chan *loggregator_v2.Envelope, <-chan error) {
+	c.logger.Printf(
+		"[INFO] Start consuming events from RLP gateway (%s) with subscription ID %q",
+		c.rlpGatewayAddr, c.subscriptionID)
+
+	eventCh, errCh := make(chan *loggregator_v2.Envelope), make(chan error)
+
+	retryCount := c.retryCount
+	if retryCount == 0 {
+		retryCount = defaultRetryCount
+	}
+
+	transport := c.transport
+	if transport == nil {
+		transport = &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: c.insecure,
+			},
+		}
+	}
+
+	doer := &rlpGatewayDoer{
+		client: &http.Client{
+			Transport: transport,
+		},
+		addr:           c.rlpGatewayAddr,
+		subscriptionID: c.subscriptionID,
+		ctx:            ctx,
+		cancel:         cancel,
+		token:          c.token,
+		tokenRefresher: c.tokenRefresher,
+		retryCount:     retryCount,
+		hooks:          c.hooks,
+		errCh:          errCh,
+		logger:         c.logger,
+	}
+
+	c.doer = doer
+
+	client := loggregator.NewRLPGatewayClient(
+		c.rlpGatewayAddr,
+		loggregator.WithRLPGatewayClientLogger(c.logger),
+		loggregator.WithRLPGatewayHTTPClient(doer),
+	)
+
+	stream := client.Stream(ctx, &loggregator_v2.EgressBatchRequest{
+		ShardId:   c.subscriptionID,
+		Selectors: allSelectors(),
+	})
+
+	go func() {
+		defer close(eventCh)
+
+		// errCh is closed after the doer never sends
+		// error anymore (RLP gateway client is stopped).
+		defer doer.close()
+
+		for {
+			batch := stream()
+			if batch == nil {
+				// nil is returned only when ctx is done.
+				return
+			}
+
+			for _, e := range batch {
+				select {
+				case eventCh <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return eventCh, errCh
+}
+
+// Close stops streaming from RLP gateway.
+func (c *rawRLPGatewayConsumer) Close() error {
+	c.logger.Printf("[INFO] Stop consuming events from RLP gateway")
+	if c.cancel == nil {
+		return fmt.Errorf("no connection with RLP gateway")
+	}
+
+	c.cancel()
+	c.doer.disconnected(nil)
+	return nil
+}
+
+// validate validates struct has requirement fields or not
+func (c *rawRLPGatewayConsumer) validate() error {
+	if c.rlpGatewayAddr == "" {
+		return fmt.Errorf("RLPGatewayAddr must not be empty")
+	}
+
+	if c.token == "" {
+		return fmt.Errorf("Token must not be empty")
+	}
+
+	if c.subscriptionID == "" {
+		return fmt.Errorf("SubscriptionID must not be empty")
+	}
+
+	return nil
+}
+
+// newRawRLPGatewayConsumer constructs new rawRLPGatewayConsumer.
+func newRawRLPGatewayConsumer(config *Config) (*rawRLPGatewayConsumer, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := config.Hooks
+	c := &rawRLPGatewayConsumer{
+		rlpGatewayAddr: config.RLPGatewayAddr,
+		token:          config.Token,
+		subscriptionID: config.SubscriptionID,
+		insecure:       config.Insecure,
+		transport:      newHTTPTransport(config, tlsConfig),
+		retryCount:     config.RetryCount,
+		tokenRefresher: config.tokenFetcher,
+		hooks:          &hooks,
+		logger:         config.Logger,
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// allSelectors returns selectors to receive all type of
+// envelopes like firehose.
+func allSelectors() []*loggregator_v2.Selector {
+	return []*loggregator_v2.Selector{
+		{Message: &loggregator_v2.Selector_Log{Log: &loggregator_v2.LogSelector{}}},
+		{Message: &loggregator_v2.Selector_Counter{Counter: &loggregator_v2.CounterSelector{}}},
+		{Message: &loggregator_v2.Selector_Gauge{Gauge: &loggregator_v2.GaugeSelector{}}},
+		{Message: &loggregator_v2.Selector_Timer{Timer: &loggregator_v2.TimerSelector{}}},
+		{Message: &loggregator_v2.Selector_Event{Event: &loggregator_v2.EventSelector{}}},
+	}
+}
+
+// rlpGatewayDoer is used by RLP gateway client to send requests.
+// It sets the auth token to the request, refreshes it when the token
+// is expired and reports connection errors.
+type rlpGatewayDoer struct {
+	client *http.Client
+
+	// addr and subscriptionID are used for hooks.
+	addr           string
+	subscriptionID string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	tokenRefresher TokenSource
+	retryCount     int
+	hooks          *Hooks
+
+	// mu protects the following fields.
+	mu       sync.Mutex
+	token    string
+	failures int
+	closed   bool
+
+	disconnectOnce sync.Once
+
+	errCh  chan error
+	logger *log.Logger
+}
+
+// Do sends a request to RLP gateway.
+func (d *rlpGatewayDoer) Do(req *http.Request) (*http.Response, error) {
+	if err := d.wait(); err != nil {
+		return nil, err
+	}
+
+	// The token may be refreshed in background.
+	d.mu.Lock()
+	token := currentToken(d.tokenRefresher, d.token)
+	d.mu.Unlock()
+	req.Header.Set("Authorization", token)
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		d.fail(err)
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		d.mu.Lock()
+		d.failures = 0
+		d.mu.Unlock()
+		d.hooks.onConnect(ConnectEvent{
+			Addr:           d.addr,
+			SubscriptionID: d.subscriptionID,
+			Time:           time.Now(),
+		})
+	case http.StatusUnauthorized:
+		d.fail(fmt.Errorf("unauthorized by RLP gateway (%s)", res.Status))
+		d.refreshToken(token)
+	default:
+		d.fail(fmt.Errorf("unexpected response from RLP gateway (%s)", res.Status))
+	}
+
+	return res, nil
+}
+
+// wait waits before reconnecting. The duration gets longer
+// every time connecting is failed.
+func (d *rlpGatewayDoer) wait() error {
+	d.mu.Lock()
+	failures := d.failures
+	d.mu.Unlock()
+
+	if failures == 0 {
+		return nil
+	}
+
+	delay := time.Duration(failures) * 500 * time.Millisecond
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-d.ctx.Done():
+		return d.ctx.Err()
+	}
+}
+
+// fail reports the error and stops streaming when it fails
+// more than retryCount times in a row.
+func (d *rlpGatewayDoer) fail(err error) {
+	if d.ctx.Err() != nil {
+		// Errors caused by closing are not reported.
+		return
+	}
+
+	d.mu.Lock()
+	d.failures++
+	failures := d.failures
+	d.mu.Unlock()
+
+	d.send(err)
+
+	if failures >= d.retryCount {
+		err := fmt.Errorf("failed to connect to RLP gateway %d times in a row", failures)
+		d.send(err)
+		d.cancel()
+		d.disconnected(err)
+		return
+	}
+
+	d.hooks.onRetry(RetryEvent{
+		Addr:           d.addr,
+		SubscriptionID: d.subscriptionID,
+		Time:           time.Now(),
+		Attempt:        failures,
+		Err:            err,
+	})
+}
+
+// send sends the error to errCh. It gives up sending
+// when streaming is stopped.
+func (d *rlpGatewayDoer) send(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+
+	select {
+	case d.errCh <- err:
+	case <-d.ctx.Done():
+	}
+}
+
+// refreshToken refreshes the token rejected by RLP gateway.
+func (d *rlpGatewayDoer) refreshToken(rejected string) {
+	if d.tokenRefresher == nil {
+		return
+	}
+
+	refresher := &contextTokenRefresher{
+		ctx:     d.ctx,
+		fetcher: d.tokenRefresher,
+		token:   rejected,
+	}
+
+	token, err := refresher.RefreshAuthToken()
+	if err != nil {
+		d.logger.Printf("[ERROR] Failed to refresh token: %s", err)
+		return
+	}
+
+	d.mu.Lock()
+	d.token = token
+	d.mu.Unlock()
+}
+
+// disconnected calls OnDisconnect hook only once (it gives up
+// retrying and then Close is called).
+func (d *rlpGatewayDoer) disconnected(err error) {
+	d.disconnectOnce.Do(func() {
+		d.hooks.onDisconnect(DisconnectEvent{
+			Addr:           d.addr,
+			SubscriptionID: d.subscriptionID,
+			Time:           time.Now(),
+			Err:            err,
+		})
+	})
+}
+
+// close closes errCh.
+func (d *rlpGatewayDoer) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	close(d.errCh)
+}
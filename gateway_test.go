@@ -0,0 +1,234 @@
+package nozzle
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestRawRLPGatewayConsumer_implement(t *testing.T) {
+	var _ RawConsumer = &rawRLPGatewayConsumer{}
+	var _ RawContextConsumer = &rawRLPGatewayConsumer{}
+	var _ RawV2Consumer = &rawRLPGatewayConsumer{}
+}
+
+func TestRawRLPGatewayConsumer_consume(t *testing.T) {
+	t.Parallel()
+
+	// inputCh is used to send message from test RLP gateway server
+	inputCh := make(chan []byte)
+
+	// authToken is valid auth token used for authorizing connection
+	authToken := "bq98Bpiu3bnpaoiuBQ"
+
+	// Setup RLP gateway server
+	ts := NewRLPGatewayServer(t, inputCh, authToken)
+	defer ts.Close()
+
+	consumer := &rawRLPGatewayConsumer{
+		rlpGatewayAddr: ts.URL,
+		token:          authToken,
+		subscriptionID: "test-go-nozzle-A",
+		logger:         log.New(ioutil.Discard, "", log.LstdFlags),
+	}
+	eventCh, _ := consumer.Consume()
+	defer consumer.Close()
+
+	timestamp := time.Now().UnixNano()
+	message := "Hello from fake RLP gateway"
+
+	batch, err := NewEnvelopeBatch(message, timestamp)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Send event to stream
+	inputCh <- batch
+
+	select {
+	case event := <-eventCh:
+		got := string(event.GetLogMessage().Message)
+		if got != message {
+			t.Fatalf("expect %q to be eq %q", got, message)
+		}
+
+		if event.GetOrigin() != "fake-origin-1" {
+			t.Fatalf("expect %q to be eq %q", event.GetOrigin(), "fake-origin-1")
+		}
+
+		if event.GetLogMessage().GetAppId() != "my-app-guid" {
+			t.Fatalf("expect %q to be eq %q", event.GetLogMessage().GetAppId(), "my-app-guid")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
+
+func TestRawRLPGatewayConsumer_consumeV2(t *testing.T) {
+	t.Parallel()
+
+	inputCh := make(chan []byte)
+	authToken := "vaiub9qbvq3BUIbpqa"
+
+	ts := NewRLPGatewayServer(t, inputCh, authToken)
+	defer ts.Close()
+
+	consumer := &rawRLPGatewayConsumer{
+		rlpGatewayAddr: ts.URL,
+		token:          authToken,
+		subscriptionID: "test-go-nozzle-A",
+		logger:         log.New(ioutil.Discard, "", log.LstdFlags),
+	}
+	eventCh, _ := consumer.ConsumeV2Context(context.Background())
+	defer consumer.Close()
+
+	message := "Hello from fake RLP gateway"
+	batch, err := NewEnvelopeBatch(message, time.Now().UnixNano())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	inputCh <- batch
+
+	select {
+	case event := <-eventCh:
+		got := string(event.GetLog().GetPayload())
+		if got != message {
+			t.Fatalf("expect %q to be eq %q", got, message)
+		}
+
+		// Tags are delivered as it is
+		if event.GetTags()["origin"] != "fake-origin-1" {
+			t.Fatalf("expect %q to be eq %q", event.GetTags()["origin"], "fake-origin-1")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
+
+func TestRawRLPGatewayConsumer_refreshToken(t *testing.T) {
+	t.Parallel()
+
+	inputCh := make(chan []byte, 1)
+	authToken := "nvpaiuB8bvIUBp9q"
+
+	ts := NewRLPGatewayServer(t, inputCh, authToken)
+	defer ts.Close()
+
+	consumer := &rawRLPGatewayConsumer{
+		rlpGatewayAddr: ts.URL,
+		token:          "expired-token",
+		subscriptionID: "test-go-nozzle-A",
+		retryCount:     3,
+		tokenRefresher: &testTokenFetcher{
+			Token: authToken,
+		},
+		logger: log.New(ioutil.Discard, "", log.LstdFlags),
+	}
+	eventCh, errCh := consumer.Consume()
+	defer consumer.Close()
+
+	batch, err := NewEnvelopeBatch("Hello", time.Now().UnixNano())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	inputCh <- batch
+
+	// First connection is failed by expired token
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("expect err not to be nil")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	// Reconnect with refreshed token
+	select {
+	case <-eventCh:
+	case err := <-errCh:
+		t.Fatalf("err: %s", err)
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
+
+func TestRawRLPGatewayConsumer_retryCount(t *testing.T) {
+	t.Parallel()
+
+	ts := NewRLPGatewayServer(t, nil, "valid-token")
+	defer ts.Close()
+
+	consumer := &rawRLPGatewayConsumer{
+		rlpGatewayAddr: ts.URL,
+		token:          "invalid-token",
+		subscriptionID: "test-go-nozzle-A",
+		retryCount:     1,
+		logger:         log.New(ioutil.Discard, "", log.LstdFlags),
+	}
+	eventCh, errCh := consumer.Consume()
+
+	errs := 0
+	for range errCh {
+		errs++
+	}
+
+	if errs != 2 {
+		t.Fatalf("expect %d to be eq 2", errs)
+	}
+
+	if _, ok := <-eventCh; ok {
+		t.Fatalf("expect events channel to be closed")
+	}
+}
+
+func TestRawRLPGatewayConsumerClose_no_connection(t *testing.T) {
+	consumer := &rawRLPGatewayConsumer{
+		logger: log.New(ioutil.Discard, "", log.LstdFlags),
+	}
+	if err := consumer.Close(); err == nil {
+		t.Fatalf("expects to be failed")
+	}
+}
+
+func TestRawRLPGatewayConsumer_validate(t *testing.T) {
+	tests := []struct {
+		in      *rawRLPGatewayConsumer
+		success bool
+	}{
+		{
+			in: &rawRLPGatewayConsumer{
+				rlpGatewayAddr: "https://log-stream.cloudfoundry.com",
+				token:          "POrr7uofS1TOqaGCpH0skk=",
+				subscriptionID: "go-nozzle-A",
+			},
+			success: true,
+		},
+
+		{
+			in: &rawRLPGatewayConsumer{
+				rlpGatewayAddr: "https://log-stream.cloudfoundry.com",
+				subscriptionID: "go-nozzle-A",
+			},
+			success: false,
+		},
+
+		{
+			in:      &rawRLPGatewayConsumer{},
+			success: false,
+		},
+	}
+
+	for i, tt := range tests {
+		err := tt.in.validate()
+		if tt.success && err != nil {
+			t.Fatalf("#%d expects '%v' to be nil", i, err)
+		}
+
+		if !tt.success && err == nil {
+			t.Fatalf("#%d expects err not to be nil", i)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package nozzle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultMaxEventAge is the default value of HealthConfig.MaxEventAge.
+	defaultMaxEventAge = 30 * time.Second
+
+	// defaultAlertTimeout is the default value of HealthConfig.AlertTimeout.
+	defaultAlertTimeout = 1 * time.Minute
+)
+
+// HealthConfig is a configuration struct for NewHealthHandler.
+type HealthConfig struct {
+	// MaxEventAge is how long the consumer can be without receiving
+	// envelopes. If no envelope is received within it, the consumer is
+	// not ready. The default value is 30 seconds.
+	MaxEventAge time.Duration
+
+	// AlertTimeout is how long a slow consumer alert is considered
+	// unresolved after it's notified. While it's unresolved, the consumer
+	// is not ready. The default value is 1 minute.
+	AlertTimeout time.Duration
+}
+
+// Health is the health of Consumer. It's written as JSON by the handler
+// constructed by NewHealthHandler.
+type Health struct {
+	// Live is true while goroutines of the consumer are alive
+	// (it's not closed and upstream is not finished).
+	Live bool `json:"live"`
+
+	// Ready is true when the consumer is connected (streaming),
+	// received an envelope within MaxEventAge and has no unresolved
+	// slow consumer alert.
+	Ready bool `json:"ready"`
+
+	// State is the state of the consumer.
+	State string `json:"state"`
+
+	// Reasons describe why the consumer is not live or ready.
+	Reasons []string `json:"reasons,omitempty"`
+
+	// LastReceived is the time when the last envelope is received.
+	LastReceived *time.Time `json:"last_received,omitempty"`
+
+	// LastAlert is the time when the last slow consumer alert is notified.
+	LastAlert *time.Time `json:"last_alert,omitempty"`
+
+	Received   uint64 `json:"received"`
+	Errors     uint64 `json:"errors"`
+	Alerts     uint64 `json:"alerts"`
+	Reconnects uint64 `json:"reconnects"`
+}
+
+// NewHealthHandler returns http.Handler which reports the health of the
+// consumer as JSON (Health). If the request path ends with "/live", the
+// status code is 200 when it's live (otherwise 503). For other paths,
+// the status code is 200 when it's ready (otherwise 503). It can be used
+// for liveness and readiness checks,
+//
+//	http.Handle("/health/", nozzle.NewHealthHandler(consumer, nil))
+//	// GET /health/live  (liveness)
+//	// GET /health/ready (readiness)
+//
+// If config is nil, default values are used.
+func NewHealthHandler(consumer Consumer, config *HealthConfig) http.Handler {
+	h := &healthHandler{
+		consumer:     consumer,
+		maxEventAge:  defaultMaxEventAge,
+		alertTimeout: defaultAlertTimeout,
+		now:          time.Now,
+	}
+
+	if config != nil {
+		if config.MaxEventAge != 0 {
+			h.maxEventAge = config.MaxEventAge
+		}
+
+		if config.AlertTimeout != 0 {
+			h.alertTimeout = config.AlertTimeout
+		}
+	}
+
+	return h
+}
+
+type healthHandler struct {
+	consumer     Consumer
+	maxEventAge  time.Duration
+	alertTimeout time.Duration
+
+	// now is used for getting current time (for testing).
+	now func() time.Time
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	health := h.check()
+
+	ok := health.Ready
+	if strings.HasSuffix(r.URL.Path, "/live") {
+		ok = health.Live
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(health)
+}
+
+// check checks the health of the consumer.
+func (h *healthHandler) check() *Health {
+	state := h.consumer.State()
+	stats := h.consumer.Stats()
+	now := h.now()
+
+	health := &Health{
+		State:      state.String(),
+		Received:   stats.Received,
+		Errors:     stats.Errors,
+		Alerts:     stats.Alerts,
+		Reconnects: stats.Reconnects,
+	}
+
+	if !stats.LastReceived.IsZero() {
+		health.LastReceived = &stats.LastReceived
+	}
+
+	if !stats.LastAlert.IsZero() {
+		health.LastAlert = &stats.LastAlert
+	}
+
+	switch state {
+	case StateDraining, StateClosed:
+		health.Reasons = append(health.Reasons, fmt.Sprintf("consumer is %s", state))
+		return health
+	}
+	health.Live = true
+
+	if state != StateStreaming {
+		health.Reasons = append(health.Reasons, fmt.Sprintf("consumer is not streaming (%s)", state))
+	}
+
+	if stats.LastReceived.IsZero() {
+		health.Reasons = append(health.Reasons, "no envelope is received")
+	} else if age := now.Sub(stats.LastReceived); age > h.maxEventAge {
+		health.Reasons = append(health.Reasons,
+			fmt.Sprintf("no envelope is received for %s (max %s)", age, h.maxEventAge))
+	}
+
+	if !stats.LastAlert.IsZero() && now.Sub(stats.LastAlert) < h.alertTimeout {
+		health.Reasons = append(health.Reasons,
+			fmt.Sprintf("slow consumer alert is notified at %s", stats.LastAlert.Format(time.RFC3339)))
+	}
+
+	health.Ready = len(health.Reasons) == 0
+	return health
+}
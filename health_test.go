@@ -0,0 +1,134 @@
+package nozzle
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stateConsumer is Consumer which returns the given state and stats.
+type stateConsumer struct {
+	Consumer
+	state State
+	stats Stats
+}
+
+func (c *stateConsumer) State() State { return c.state }
+func (c *stateConsumer) Stats() Stats { return c.stats }
+
+func TestHealthHandler(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		state      State
+		stats      Stats
+		path       string
+		statusCode int
+		live       bool
+		ready      bool
+	}{
+		{
+			state:      StateStreaming,
+			stats:      Stats{LastReceived: now.Add(-1 * time.Second)},
+			path:       "/health/ready",
+			statusCode: http.StatusOK,
+			live:       true,
+			ready:      true,
+		},
+
+		// No envelope within MaxEventAge
+		{
+			state:      StateStreaming,
+			stats:      Stats{LastReceived: now.Add(-1 * time.Minute)},
+			path:       "/health/ready",
+			statusCode: http.StatusServiceUnavailable,
+			live:       true,
+			ready:      false,
+		},
+
+		// Still live
+		{
+			state:      StateStreaming,
+			stats:      Stats{LastReceived: now.Add(-1 * time.Minute)},
+			path:       "/health/live",
+			statusCode: http.StatusOK,
+			live:       true,
+			ready:      false,
+		},
+
+		// Unresolved alert
+		{
+			state: StateStreaming,
+			stats: Stats{
+				LastReceived: now.Add(-1 * time.Second),
+				LastAlert:    now.Add(-10 * time.Second),
+			},
+			path:       "/health/ready",
+			statusCode: http.StatusServiceUnavailable,
+			live:       true,
+			ready:      false,
+		},
+
+		// Resolved alert
+		{
+			state: StateStreaming,
+			stats: Stats{
+				LastReceived: now.Add(-1 * time.Second),
+				LastAlert:    now.Add(-10 * time.Minute),
+			},
+			path:       "/health/ready",
+			statusCode: http.StatusOK,
+			live:       true,
+			ready:      true,
+		},
+
+		// Not connected
+		{
+			state:      StateReconnecting,
+			stats:      Stats{LastReceived: now.Add(-1 * time.Second)},
+			path:       "/health/ready",
+			statusCode: http.StatusServiceUnavailable,
+			live:       true,
+			ready:      false,
+		},
+
+		{
+			state:      StateClosed,
+			path:       "/health/live",
+			statusCode: http.StatusServiceUnavailable,
+			live:       false,
+			ready:      false,
+		},
+	}
+
+	for i, tt := range tests {
+		handler := NewHealthHandler(&stateConsumer{state: tt.state, stats: tt.stats}, nil)
+		handler.(*healthHandler).now = func() time.Time { return now }
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+		if w.Code != tt.statusCode {
+			t.Fatalf("#%d expects %d to be eq %d", i, w.Code, tt.statusCode)
+		}
+
+		var health Health
+		if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
+			t.Fatalf("#%d err: %s", i, err)
+		}
+
+		if health.Live != tt.live || health.Ready != tt.ready {
+			t.Fatalf("#%d expects %#v to be live=%v ready=%v", i, health, tt.live, tt.ready)
+		}
+
+		if health.State != tt.state.String() {
+			t.Fatalf("#%d expects %q to be eq %q", i, health.State, tt.state)
+		}
+
+		if !tt.ready && len(health.Reasons) == 0 {
+			t.Fatalf("#%d expects reasons not to be empty", i)
+		}
+	}
+}
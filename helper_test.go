@@ -1,13 +1,20 @@
 package nozzle
 
 import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gogo/protobuf/proto"
+	"github.com/golang/protobuf/jsonpb"
 	"github.com/gorilla/websocket"
 )
 
@@ -58,3 +65,223 @@ func NewEvent(message string, timestamp int64) ([]byte, error) {
 	})
 
 }
+
+// NewRLPGatewayServer is a stand-in of RLP gateway. It streams the
+// envelope batches (JSON) from inputCh as server-sent events.
+func NewRLPGatewayServer(t *testing.T, inputCh <-chan []byte, authToken string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("Authorization")
+		if token != authToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Path != "/v2/read" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			// Should not reach here
+			t.Fatalf("expect ResponseWriter to be http.Flusher")
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for {
+			select {
+			case input, ok := <-inputCh:
+				if !ok {
+					fmt.Fprint(w, "event: closing\ndata: \n\n")
+					flusher.Flush()
+					return
+				}
+				fmt.Fprintf(w, "data: %s\n\n", input)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+}
+
+func NewEnvelopeBatch(message string, timestamp int64) ([]byte, error) {
+	batch := &loggregator_v2.EnvelopeBatch{
+		Batch: []*loggregator_v2.Envelope{
+			{
+				Timestamp: timestamp,
+				SourceId:  "my-app-guid",
+				Tags: map[string]string{
+					"origin": "fake-origin-1",
+				},
+				Message: &loggregator_v2.Envelope_Log{
+					Log: &loggregator_v2.Log{
+						Payload: []byte(message),
+						Type:    loggregator_v2.Log_OUT,
+					},
+				},
+			},
+		},
+	}
+
+	s, err := (&jsonpb.Marshaler{}).MarshalToString(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(s), nil
+}
+
+// NewAppStreamServer is a stand-in of doppler for application streams.
+// It sends one LogMessage of the application to each stream
+// (/apps/:guid/stream) and keeps it open until the client closes it.
+func NewAppStreamServer(t *testing.T, authToken string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != authToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var guid string
+		if _, err := fmt.Sscanf(r.URL.Path, "/apps/%s", &guid); err != nil || !strings.HasSuffix(guid, "/stream") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		guid = strings.TrimSuffix(guid, "/stream")
+
+		upgrader := websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		}
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		b, err := proto.Marshal(&events.Envelope{
+			Origin:    proto.String("fake-origin"),
+			EventType: events.Envelope_LogMessage.Enum(),
+			LogMessage: &events.LogMessage{
+				Message:     []byte("hello"),
+				MessageType: events.LogMessage_OUT.Enum(),
+				AppId:       proto.String(guid),
+				Timestamp:   proto.Int64(time.Now().UnixNano()),
+			},
+		})
+		if err != nil {
+			return
+		}
+
+		if err := ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+			return
+		}
+
+		// Wait until the client closes the connection.
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+// NewTrafficControllerServer is a stand-in of traffic controller for
+// snapshot endpoints (/apps/:guid/recentlogs and containermetrics). It
+// responds the envelopes of the app as multipart/x-protobuf.
+func NewTrafficControllerServer(t *testing.T, authToken string, recentLogs, containerMetrics map[string][]*events.Envelope) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != authToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "You are not authorized")
+			return
+		}
+
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 3 || parts[0] != "apps" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var envelopes map[string][]*events.Envelope
+		switch parts[2] {
+		case "recentlogs":
+			envelopes = recentLogs
+		case "containermetrics":
+			envelopes = containerMetrics
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		appEnvelopes, ok := envelopes[parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "app %s not found", parts[1])
+			return
+		}
+
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/x-protobuf; boundary="+mw.Boundary())
+		for _, e := range appEnvelopes {
+			b, err := proto.Marshal(e)
+			if err != nil {
+				t.Errorf("err: %s", err)
+				return
+			}
+
+			part, err := mw.CreatePart(nil)
+			if err != nil {
+				t.Errorf("err: %s", err)
+				return
+			}
+			part.Write(b)
+		}
+		mw.Close()
+	}))
+}
+
+// NewConnectProxyServer returns HTTP proxy which tunnels connections by
+// CONNECT method. The target hosts are sent to hostCh (if it's not full).
+func NewConnectProxyServer(t *testing.T, hostCh chan<- string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		select {
+		case hostCh <- r.Host:
+		default:
+		}
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			t.Errorf("expects response writer to be hijacker")
+			return
+		}
+
+		conn, _, err := hijacker.Hijack()
+		if err != nil {
+			t.Errorf("err: %s", err)
+			return
+		}
+
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+}
@@ -0,0 +1,193 @@
+package nozzle
+
+import (
+	"time"
+)
+
+// Hooks is a set of callbacks which are called when the state of
+// connection is changed. Callbacks are called synchronously from
+// the goroutine which handles the connection, so they should return
+// immediately. Nil callbacks are ignored.
+type Hooks struct {
+	// OnConnect is called when the connection with doppler (or RLP
+	// gateway) is established. It's called again when it's connected
+	// after retrying.
+	OnConnect func(ConnectEvent)
+
+	// OnDisconnect is called when the connection is closed by Close
+	// or it gives up retrying.
+	OnDisconnect func(DisconnectEvent)
+
+	// OnRetry is called when connecting is failed or the connection is
+	// lost and it's going to retry (up to Config.RetryCount).
+	OnRetry func(RetryEvent)
+
+	// OnTokenRefresh is called when the access token is refreshed
+	// from UAA because it's expired.
+	OnTokenRefresh func(TokenRefreshEvent)
+
+	// OnTokenFetch is called every time the access token is fetched
+	// from UAA, including the initial fetch by NewConsumer and the
+	// fetches for refreshing.
+	OnTokenFetch func(TokenFetchEvent)
+
+	// OnReconnect is called before every reconnect attempt by
+	// supervised mode (Config.Reconnect).
+	OnReconnect func(ReconnectEvent)
+}
+
+// ConnectEvent describes that the connection is established.
+type ConnectEvent struct {
+	// Addr is the address of doppler (or RLP gateway).
+	Addr string
+
+	// SubscriptionID is the subscription ID used for the connection.
+	SubscriptionID string
+
+	// AppGUID is the application GUID of the stream in stream mode
+	// (Config.AppGUIDs).
+	AppGUID string
+
+	// Time is the time when it's connected.
+	Time time.Time
+}
+
+// DisconnectEvent describes that the connection is closed.
+type DisconnectEvent struct {
+	// Addr is the address of doppler (or RLP gateway).
+	Addr string
+
+	// SubscriptionID is the subscription ID used for the connection.
+	SubscriptionID string
+
+	// AppGUID is the application GUID of the stream in stream mode
+	// (Config.AppGUIDs).
+	AppGUID string
+
+	// Time is the time when it's disconnected.
+	Time time.Time
+
+	// Err is the reason of disconnection. It's nil when it's
+	// closed by Close.
+	Err error
+}
+
+// RetryEvent describes that connecting is failed and it's retried.
+type RetryEvent struct {
+	// Addr is the address of doppler (or RLP gateway).
+	Addr string
+
+	// SubscriptionID is the subscription ID used for the connection.
+	SubscriptionID string
+
+	// AppGUID is the application GUID of the stream in stream mode
+	// (Config.AppGUIDs).
+	AppGUID string
+
+	// Time is the time when it's failed.
+	Time time.Time
+
+	// Attempt is the number of failures in a row (starts from 1).
+	Attempt int
+
+	// Err is the error which causes retrying.
+	Err error
+}
+
+// TokenRefreshEvent describes that the access token is refreshed.
+type TokenRefreshEvent struct {
+	// UaaAddr is the address of UAA.
+	UaaAddr string
+
+	// Username is the user whose token is refreshed.
+	Username string
+
+	// Time is the time when it's refreshed.
+	Time time.Time
+
+	// Duration is how long it took to fetch the token from UAA.
+	Duration time.Duration
+
+	// Expiry is when the new token is expired (exp claim of JWT).
+	// It's zero if it's unknown or refreshing is failed.
+	Expiry time.Time
+
+	// Err is the error if refreshing is failed.
+	Err error
+}
+
+// TokenFetchEvent describes that the access token is fetched from UAA.
+type TokenFetchEvent struct {
+	// UaaAddr is the address of UAA.
+	UaaAddr string
+
+	// Username is the user (or UAA client) whose token is fetched.
+	Username string
+
+	// Time is the time when it's fetched.
+	Time time.Time
+
+	// Duration is how long it took to fetch the token from UAA.
+	Duration time.Duration
+
+	// Err is the error if fetching is failed.
+	Err error
+}
+
+// ReconnectEvent describes a reconnect attempt.
+type ReconnectEvent struct {
+	// AppGUID is the application whose stream is restarted in stream
+	// mode (Config.AppGUIDs). It's empty if the whole connection is
+	// re-created.
+	AppGUID string
+
+	// Attempt is the number of attempts since the connection is lost
+	// (starts from 1).
+	Attempt int
+
+	// Delay is how long to wait before this attempt.
+	Delay time.Duration
+
+	// Elapsed is how long it passed since the connection is lost.
+	Elapsed time.Duration
+
+	// Err is the last error occurred in the lost connection (or while
+	// re-creating it). It can be nil.
+	Err error
+}
+
+func (h *Hooks) onConnect(e ConnectEvent) {
+	if h != nil && h.OnConnect != nil {
+		h.OnConnect(e)
+	}
+}
+
+func (h *Hooks) onDisconnect(e DisconnectEvent) {
+	if h != nil && h.OnDisconnect != nil {
+		h.OnDisconnect(e)
+	}
+}
+
+func (h *Hooks) onRetry(e RetryEvent) {
+	if h != nil && h.OnRetry != nil {
+		h.OnRetry(e)
+	}
+}
+
+func (h *Hooks) onTokenRefresh(e TokenRefreshEvent) {
+	if h != nil && h.OnTokenRefresh != nil {
+		h.OnTokenRefresh(e)
+	}
+}
+
+func (h *Hooks) onTokenFetch(e TokenFetchEvent) {
+	if h != nil && h.OnTokenFetch != nil {
+		h.OnTokenFetch(e)
+	}
+}
+
+func (h *Hooks) onReconnect(e ReconnectEvent) {
+	if h != nil && h.OnReconnect != nil {
+		h.OnReconnect(e)
+	}
+}
@@ -0,0 +1,280 @@
+package nozzle
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// MultiConsumer consumes firehoses of multiple CloudFoundry foundations.
+// Each foundation is consumed by its own Consumer (token fetching,
+// reconnecting and slow consumer detection are independent) and their
+// envelopes are merged into the same Events() channel.
+type MultiConsumer interface {
+	// Events returns the read channel for the envelopes of all
+	// foundations. Each envelope is wrapped with its foundation name.
+	// It's closed after the consumers of all foundations are finished.
+	Events() <-chan *FoundationEnvelope
+
+	// Detects returns the read channel that is notified slowConsumerAlerts
+	// of the foundation. It returns nil if the foundation is unknown.
+	Detects(foundation string) <-chan error
+
+	// Errors returns the read channel of errors that occured during
+	// consuming the foundation. It returns nil if the foundation is unknown.
+	Errors(foundation string) <-chan error
+
+	// Start starts consuming all foundations. If any of them is failed
+	// to start, the others are closed and it returns error.
+	Start() error
+
+	// StartContext is same as Start but the lifetime of consuming is tied
+	// to the given context.
+	StartContext(ctx context.Context) error
+
+	// Close stops consuming all foundations. It returns the first error
+	// if closing any of them is failed.
+	Close() error
+
+	// Consumer returns the Consumer of the foundation (e.g., to get its
+	// Stats or State). It returns nil if the foundation is unknown.
+	Consumer(foundation string) Consumer
+
+	// Foundations returns the names of foundations in sorted order.
+	Foundations() []string
+
+	// Stats returns the snapshot of statistics per foundation.
+	Stats() map[string]Stats
+}
+
+// FoundationEnvelope is an envelope with the name of the foundation
+// which it's consumed from.
+type FoundationEnvelope struct {
+	// Foundation is the name of the foundation (the key of the configs
+	// given to NewMultiConsumer).
+	Foundation string
+
+	// Envelope is the V1 envelope. It's nil if Config.EnvelopeV2 is set
+	// for the foundation.
+	Envelope *events.Envelope
+
+	// EnvelopeV2 is the V2 envelope. It's only set if Config.EnvelopeV2
+	// is set for the foundation.
+	EnvelopeV2 *loggregator_v2.Envelope
+}
+
+type multiConsumer struct {
+	foundations []string
+	consumers   map[string]Consumer
+
+	eventCh chan *FoundationEnvelope
+
+	// mu serializes Start and Close.
+	mu      sync.Mutex
+	started bool
+
+	// doneCh is closed by Close to stop forwarding envelopes.
+	doneCh    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewMultiConsumer constructs MultiConsumer from the configs per
+// foundation name. Each config is used for constructing Consumer by
+// NewConsumer (the given configs are copied and not modified).
+func NewMultiConsumer(configs map[string]*Config) (MultiConsumer, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("at least one foundation must be configured")
+	}
+
+	foundations := make([]string, 0, len(configs))
+	for foundation, config := range configs {
+		if foundation == "" {
+			return nil, fmt.Errorf("foundation name must not be empty")
+		}
+
+		if config == nil {
+			return nil, fmt.Errorf("config of foundation %q must not be nil", foundation)
+		}
+		foundations = append(foundations, foundation)
+	}
+	sort.Strings(foundations)
+
+	c := &multiConsumer{
+		foundations: foundations,
+		consumers:   make(map[string]Consumer, len(configs)),
+		doneCh:      make(chan struct{}),
+	}
+
+	for _, foundation := range foundations {
+		// Copy config not to share the token and the logger with
+		// the caller and other foundations. The token cache is also
+		// dropped to fetch the token independently per foundation.
+		config := *configs[foundation]
+		config.tokenFetcher = nil
+		consumer, err := NewConsumer(&config)
+		if err != nil {
+			c.closeConsumers()
+			return nil, fmt.Errorf("failed to construct consumer for foundation %q: %s", foundation, err)
+		}
+		c.consumers[foundation] = consumer
+	}
+
+	return c, nil
+}
+
+// Events returns the read channel for the envelopes of all foundations.
+func (c *multiConsumer) Events() <-chan *FoundationEnvelope {
+	return c.eventCh
+}
+
+// Detects returns the read channel that is notified slowConsumerAlerts
+// of the foundation.
+func (c *multiConsumer) Detects(foundation string) <-chan error {
+	consumer, ok := c.consumers[foundation]
+	if !ok {
+		return nil
+	}
+	return consumer.Detects()
+}
+
+// Errors returns the read channel of errors of the foundation.
+func (c *multiConsumer) Errors(foundation string) <-chan error {
+	consumer, ok := c.consumers[foundation]
+	if !ok {
+		return nil
+	}
+	return consumer.Errors()
+}
+
+// Consumer returns the Consumer of the foundation.
+func (c *multiConsumer) Consumer(foundation string) Consumer {
+	return c.consumers[foundation]
+}
+
+// Foundations returns the names of foundations.
+func (c *multiConsumer) Foundations() []string {
+	foundations := make([]string, len(c.foundations))
+	copy(foundations, c.foundations)
+	return foundations
+}
+
+// Stats returns the snapshot of statistics per foundation.
+func (c *multiConsumer) Stats() map[string]Stats {
+	stats := make(map[string]Stats, len(c.consumers))
+	for foundation, consumer := range c.consumers {
+		stats[foundation] = consumer.Stats()
+	}
+	return stats
+}
+
+func (c *multiConsumer) Start() error {
+	return c.StartContext(context.Background())
+}
+
+// StartContext starts consuming all foundations and merging their
+// envelopes. They are stopped when the given context is done.
+func (c *multiConsumer) StartContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.started {
+		return fmt.Errorf("consumer is already started")
+	}
+	c.started = true
+
+	for _, foundation := range c.foundations {
+		if err := c.consumers[foundation].StartContext(ctx); err != nil {
+			c.closeConsumers()
+			return fmt.Errorf("failed to start consumer for foundation %q: %s", foundation, err)
+		}
+	}
+
+	c.eventCh = make(chan *FoundationEnvelope)
+
+	var wg sync.WaitGroup
+	for _, foundation := range c.foundations {
+		consumer := c.consumers[foundation]
+		wg.Add(2)
+		go c.forward(foundation, consumer.Events(), nil, &wg)
+		go c.forward(foundation, nil, consumer.EventsV2(), &wg)
+	}
+
+	go func() {
+		wg.Wait()
+		close(c.eventCh)
+	}()
+
+	return nil
+}
+
+// forward wraps envelopes from the consumer of the foundation and
+// sends them to eventCh. Either eventCh or eventV2Ch is used (the other
+// one is nil). After Close, remaining envelopes are discarded not to
+// block closing the consumer.
+func (c *multiConsumer) forward(foundation string, eventCh <-chan *events.Envelope, eventV2Ch <-chan *loggregator_v2.Envelope, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if eventCh == nil && eventV2Ch == nil {
+		return
+	}
+
+	for {
+		e := &FoundationEnvelope{Foundation: foundation}
+		var ok bool
+		if eventCh != nil {
+			e.Envelope, ok = <-eventCh
+		} else {
+			e.EnvelopeV2, ok = <-eventV2Ch
+		}
+
+		if !ok {
+			return
+		}
+
+		select {
+		case c.eventCh <- e:
+		case <-c.doneCh:
+		}
+	}
+}
+
+// Close stops consuming all foundations. It's safe to call Close
+// more than once, it returns the result of the first call.
+func (c *multiConsumer) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		close(c.doneCh)
+		c.closeErr = c.closeConsumers()
+	})
+
+	return c.closeErr
+}
+
+// closeConsumers closes the consumers of all foundations and returns
+// the first error.
+func (c *multiConsumer) closeConsumers() error {
+	var firstErr error
+	for _, foundation := range c.foundations {
+		consumer, ok := c.consumers[foundation]
+		if !ok {
+			continue
+		}
+
+		if err := consumer.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to close consumer for foundation %q: %s", foundation, err)
+		}
+	}
+
+	return firstErr
+}
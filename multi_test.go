@@ -0,0 +1,165 @@
+package nozzle
+
+import (
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewMultiConsumer_invalid(t *testing.T) {
+	cases := []struct {
+		configs map[string]*Config
+		errStr  string
+	}{
+		{
+			configs: map[string]*Config{},
+			errStr:  "at least one foundation",
+		},
+		{
+			configs: map[string]*Config{"": {}},
+			errStr:  "foundation name must not be empty",
+		},
+		{
+			configs: map[string]*Config{"east": nil},
+			errStr:  `config of foundation "east" must not be nil`,
+		},
+		{
+			configs: map[string]*Config{
+				"east": {DopplerAddr: "wss://doppler.east.example.com", Token: "token", SubscriptionID: "go-nozzle"},
+				"west": {DopplerAddr: "wss://doppler.west.example.com", Token: "token"},
+			},
+			errStr: `failed to construct consumer for foundation "west"`,
+		},
+	}
+
+	for i, tc := range cases {
+		_, err := NewMultiConsumer(tc.configs)
+		if err == nil || !strings.Contains(err.Error(), tc.errStr) {
+			t.Fatalf("#%d expects %v to contain %q", i, err, tc.errStr)
+		}
+	}
+}
+
+func TestNewMultiConsumer_tokenPerFoundation(t *testing.T) {
+	stale := &countTokenFetcher{ttl: time.Hour}
+	configs := make(map[string]*Config)
+	fetchers := make(map[string]*countTokenFetcher)
+	for _, foundation := range []string{"east", "west"} {
+		fetchers[foundation] = &countTokenFetcher{ttl: time.Hour}
+		configs[foundation] = &Config{
+			DopplerAddr:    "wss://doppler." + foundation + ".example.com",
+			SubscriptionID: "go-nozzle",
+			TokenSource:    fetchers[foundation],
+
+			// The token cache left by another consumer must not be used.
+			tokenFetcher: newTokenCache(stale, 0, defaultLogger),
+		}
+	}
+
+	consumer, err := NewMultiConsumer(configs)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	if n := atomic.LoadInt32(&stale.count); n != 0 {
+		t.Fatalf("expects %d to be eq 0", n)
+	}
+
+	for foundation, fetcher := range fetchers {
+		if n := atomic.LoadInt32(&fetcher.count); n != 1 {
+			t.Fatalf("expects %d to be eq 1 for %s", n, foundation)
+		}
+	}
+}
+
+func TestMultiConsumer(t *testing.T) {
+	t.Parallel()
+
+	authTokens := map[string]string{
+		"east": "n98ubNOIUog9gOPUbvqiur",
+		"west": "bq39hvn7aopq3gvnoa0q9s",
+	}
+
+	configs := make(map[string]*Config)
+	for foundation, authToken := range authTokens {
+		inputCh := make(chan []byte, 1)
+		ts := NewDopplerServer(t, inputCh, authToken)
+		defer ts.Close()
+
+		eventBytes, err := NewEvent("Hello from "+foundation, time.Now().UnixNano())
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		inputCh <- eventBytes
+
+		configs[foundation] = &Config{
+			DopplerAddr:    strings.Replace(ts.URL, "http:", "ws:", 1),
+			Token:          authToken,
+			SubscriptionID: "test-go-nozzle-A",
+		}
+	}
+
+	consumer, err := NewMultiConsumer(configs)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Configs are not modified.
+	if configs["east"].Logger != nil {
+		t.Fatalf("expects config not to be modified")
+	}
+
+	if got, expect := consumer.Foundations(), []string{"east", "west"}; !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expects %v to be eq %v", got, expect)
+	}
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	if consumer.Errors("east") == nil || consumer.Detects("west") == nil {
+		t.Fatalf("expects channels of foundations to be returned")
+	}
+
+	if consumer.Errors("north") != nil || consumer.Consumer("north") != nil {
+		t.Fatalf("expects nil for unknown foundation")
+	}
+
+	received := make(map[string]string)
+	for len(received) < len(authTokens) {
+		select {
+		case e := <-consumer.Events():
+			received[e.Foundation] = string(e.Envelope.GetLogMessage().Message)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expects events to be received from all foundations: %v", received)
+		}
+	}
+
+	for foundation := range authTokens {
+		if got, expect := received[foundation], "Hello from "+foundation; got != expect {
+			t.Fatalf("expects %q to be eq %q", got, expect)
+		}
+	}
+
+	stats := consumer.Stats()
+	if stats["east"].Received != 1 || stats["west"].Received != 1 {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+
+	if err := consumer.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	select {
+	case _, ok := <-consumer.Events():
+		if ok {
+			t.Fatalf("expects no more events")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expects Events() to be closed")
+	}
+}
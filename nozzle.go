@@ -9,16 +9,20 @@
 // To get starts, see Config and Consumer.
 //
 // If you want to change the behavior of default consumer, then implement
-// the interface of it.
+// the interface of it (e.g., RawConsumer) and set it to Config.
 package nozzle
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"time"
 
 	noaaConsumer "github.com/cloudfoundry/noaa/consumer"
+	"github.com/cloudfoundry/sonde-go/events"
 )
 
 // By default, all logs goes to ioutil.Discard.
@@ -32,14 +36,62 @@ type Config struct {
 	// The address should start with 'wss://' (websocket endopint).
 	DopplerAddr string
 
+	// DopplerAddrs is a list of doppler firehose endpoint addresses
+	// (e.g., traffic controllers behind different VIPs). If DopplerAddr
+	// is also set, it's used as the first one. How to use them is
+	// defined by EndpointStrategy. It can't be used with AppGUIDs.
+	DopplerAddrs []string
+
+	// EndpointStrategy defines how to use multiple doppler endpoints
+	// (DopplerAddrs). By default, EndpointFailover is used. The health
+	// of each endpoint is available in Stats.Endpoints.
+	EndpointStrategy EndpointStrategy
+
+	// RLPGatewayAddr is a Reverse Log Proxy (RLP) gateway endpoint address
+	// to connect (e.g., 'https://log-stream.cloudfoundry.net').
+	// If it's not empty, consumer uses loggregator V2 API via RLP gateway
+	// instead of doppler firehose (DopplerAddr is not used). V2 envelopes
+	// are converted to V1 (sonde-go) envelopes. It can't be used with
+	// DopplerAddrs and EndpointStrategy.
+	RLPGatewayAddr string
+
+	// AppGUIDs enables stream mode. In stream mode, consumer opens one
+	// stream (noaa Stream) per application instead of firehose and
+	// delivers their envelopes to the same Events() channel. It doesn't
+	// require doppler.firehose scope (only access to the applications).
+	// Applications can be added and removed by AppStreamer (the
+	// returned Consumer implements it) while consuming. SubscriptionID is not used.
+	//
+	// If the stream of an application gives up reconnecting (RetryCount),
+	// only the application is affected and others keep streaming. With
+	// Reconnect, its stream is restarted with backoff (reported to
+	// OnReconnect with AppGUID). Otherwise (or after
+	// ReconnectMaxElapsedTime), the application is removed and the error
+	// is sent to Errors().
+	AppGUIDs []string
+
+	// EnvelopeV2 enables V2 mode. In V2 mode, envelopes are delivered to
+	// Consumer.EventsV2() as loggregator V2 envelopes and Consumer.Events()
+	// is not used. With RLPGatewayAddr, V2 envelopes are delivered without
+	// conversion (tags, gauge and timer are not lost). Otherwise, firehose
+	// envelopes are converted to V2 envelopes.
+	EnvelopeV2 bool
+
 	// Token is an access token to connect to firehose. It's neccesary
 	// to consume logs from doppler.
 	//
 	// If it's empty, the token is feched from UAA server.
 	// To fetch token from UAA server, UaaAddr and Username/Password
-	// for CF admin need to be set.
+	// for CF admin (or ClientID/ClientSecret) need to be set.
 	Token string
 
+	// TokenSource is used for fetching and refreshing the token instead
+	// of UAA. If it's set, UaaAddr can be empty. If Token is also set,
+	// Token is used first and TokenSource is used for refreshing it.
+	// See NewStaticTokenSource, NewFileTokenSource, NewEnvTokenSource
+	// and NewCachingTokenSource.
+	TokenSource TokenSource
+
 	// SubscriptionID is unique id for a pool of clients of firehose.
 	// For each SubscriptionID, all data will be distributed evenly
 	// among that subscriber's client pool.
@@ -47,7 +99,7 @@ type Config struct {
 
 	// UaaAddr is UAA endpoint address. This is used for fetching access
 	// token if Token is empty. To get token you also need to set
-	// Username/Password for CloudFoundry admin.
+	// Username/Password for CloudFoundry admin or ClientID/ClientSecret.
 	UaaAddr string
 
 	// UaaTimeout is timeout to wait after sending request to uaa server.
@@ -55,20 +107,70 @@ type Config struct {
 	UaaTimeout time.Duration
 
 	// Username is admin username of CloudFoundry. This is used for fetching
-	// access token if Token is empty.
+	// access token if Token is empty. Like uaago, the token is fetched by
+	// client_credentials grant with Username as the client ID (not by
+	// password grant), so it must be the UAA client.
 	Username string
 
 	// Password is admin password of CloudFoundry. This is used for fetching
-	// access token if Token is empty.
+	// access token if Token is empty. It's used as the client secret of
+	// Username.
 	Password string
 
+	// ClientID is the ID of UAA client which has doppler.firehose
+	// authority. If it's set (with ClientSecret), the token is fetched by
+	// client_credentials grant with it. It's same request as
+	// Username/Password and they can not be set both.
+	ClientID string
+
+	// ClientSecret is the secret of the UAA client (ClientID).
+	ClientSecret string
+
+	// TokenRefreshSkew is how long before the token is expired to
+	// refresh it in background while consuming. The expiry is read from
+	// exp claim of the token (JWT). If it's negative, the token is
+	// refreshed only when it's rejected by doppler. The default value
+	// is 1 minute.
+	TokenRefreshSkew time.Duration
+
 	// Insecure is used for skipping verifying insecure connection with doppler
-	// and UAA. Default value is false, not skipping.
+	// and UAA. Default value is false, not skipping. If it's
+	// true, verifying is skipped even if TLSConfig or TLSCAFile is set.
 	//
 	// If it true, by default, connection to doppler & UAA will be insecure.
 	// We strongly recommend not to set true instead of testing purpose.
 	Insecure bool
 
+	// TLSConfig is the base TLS configuration for the connections to
+	// doppler (or RLP gateway) and UAA. It's cloned and not modified.
+	TLSConfig *tls.Config
+
+	// TLSCAFile is the path to the PEM encoded CA bundle to verify
+	// doppler and UAA (e.g., internal CA). It's added to the system
+	// ones.
+	TLSCAFile string
+
+	// TLSCertFile and TLSKeyFile are the paths to the PEM encoded client
+	// certificate and its key for mutual TLS. Both of them must be set.
+	//
+	// TLSCAFile, TLSCertFile and TLSKeyFile are reloaded when they are
+	// changed (checked on every TLS handshake), so certificates can be
+	// rotated without restarting.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Proxy returns the proxy URL for the request to doppler (or RLP
+	// gateway) and UAA. Both HTTP (CONNECT) and SOCKS5 proxies are
+	// supported. If nil (default), the proxy is read from environment
+	// variables (HTTPS_PROXY, HTTP_PROXY and NO_PROXY).
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// Dialer is used for dialing RLP gateway and UAA (e.g., to bind
+	// the local address). noaa (doppler firehose and app streams)
+	// doesn't support custom dialer, so it can only be set with
+	// RLPGatewayAddr (or RawConsumer). Use Proxy for doppler.
+	Dialer Dialer
+
 	// DebugPrinter is noaa.DebugPrinter. It's used for debugging
 	// Noaa. Noaa is a client library to consume metric and log
 	// messages from Doppler.
@@ -86,12 +188,97 @@ type Config struct {
 	// RetryCount defines how many times consumer will retry to connect to doppler
 	RetryCount int
 
-	// tokenFetcher provides function to get a token, and will be used by noaa consumer
-	// to refresh a token when it is expired
-	tokenFetcher tokenFetcher
+	// RawConsumer is used for consuming events instead of the default
+	// one (noaa or RLP gateway client). The events from it pass through
+	// slow consumer detection and are delivered to Consumer channels.
+	//
+	// If it's set, Token and UaaAddr can be empty (then token is not fetched).
+	RawConsumer RawConsumer
+
+	// SlowDetector is used for detecting slow consumer instead of the
+	// default one. To change detection policies (e.g., threshold of
+	// dropped messages or latency), construct it by NewSlowDetector.
+	SlowDetector SlowDetector
+
+	// Filter selects envelopes delivered to Events() (or EventsV2()).
+	// It's applied after SlowDetector, so slow consumer detection still
+	// sees every envelope. Envelopes dropped by it are counted in
+	// Stats.Filtered. Filters can be composed by FilterAll, FilterAny
+	// and FilterNot. If nil (default), all envelopes are delivered.
+	Filter Filter
+
+	// BufferSize is the size of in-process ring buffer between
+	// SlowDetector and Events() (or EventsV2()). It absorbs short
+	// hiccups of downstream not to back up into the connection. If 0
+	// (default), envelopes are passed without buffering.
+	BufferSize int
+
+	// OverflowPolicy defines what to do when the buffer is full. By
+	// default, OverflowBlock is used. Envelopes dropped by other policies
+	// are counted in Stats and reported as AlertLocalDropped alert.
+	OverflowPolicy OverflowPolicy
+
+	// DropOrder is the order of event types to drop with
+	// OverflowDropByPriority (the first one is dropped first).
+	// Event types which are not in it are dropped last. If it's empty,
+	// DefaultDropOrder is used.
+	DropOrder []events.Envelope_EventType
+
+	// SpoolDir enables the disk-backed spool between SlowDetector and
+	// Events() (or EventsV2()). Envelopes are written to segment files in
+	// the directory and read from them when downstream receives them, so
+	// downstream outages don't slow down consuming firehose. Envelopes
+	// which are not delivered yet are replayed after restart. Delivery is
+	// at-least-once (a few envelopes may be delivered again after crash).
+	//
+	// The directory must not be shared by multiple consumers and
+	// EnvelopeV2 must not be changed for the same directory.
+	SpoolDir string
+
+	// SpoolMaxBytes is the maximum total size of segment files. When it's
+	// reached, new envelopes are dropped and counted in Stats as local
+	// drops. The default value is 1 GiB.
+	SpoolMaxBytes int64
+
+	// SpoolSegmentSize is the size to rotate segment files. Segment files
+	// are removed after all envelopes in them are delivered. The default
+	// value is 64 MiB.
+	SpoolSegmentSize int64
 
-	// The following fileds are now only for testing.
-	rawConsumer rawConsumer
+	// SpoolSync defines when segment files are synced to disk.
+	// By default, SpoolSyncNone is used.
+	SpoolSync SpoolSyncPolicy
+
+	// Reconnect enables supervised mode. In supervised mode, consumer
+	// re-creates the connection when it's lost (e.g., noaa gave up after
+	// RetryCount). It waits before reconnecting with exponential backoff
+	// plus jitter. Events() and other channels stay the same across
+	// reconnects. If RawConsumer is set, the same RawConsumer is consumed
+	// again after Close, so it must support it.
+	Reconnect bool
+
+	// ReconnectInterval is the initial interval to wait before reconnecting.
+	// It's doubled for every attempt. The default value is 1 second.
+	ReconnectInterval time.Duration
+
+	// ReconnectMaxInterval is the maximum interval to wait before
+	// reconnecting. The default value is 1 minute.
+	ReconnectMaxInterval time.Duration
+
+	// ReconnectMaxElapsedTime is how long to keep trying to reconnect
+	// after the connection is lost. After that, consumer gives up and
+	// sends error to Errors(). If 0 (default), it never gives up.
+	ReconnectMaxElapsedTime time.Duration
+
+	// Hooks are called when the state of connection is changed (connected,
+	// disconnected, retrying, reconnecting) or the token is refreshed.
+	// They can be used for exporting metrics or audit logs.
+	Hooks Hooks
+
+	// tokenFetcher provides function to get a token, and will be used by noaa consumer
+	// to refresh a token when it is expired. It's TokenSource (or the
+	// default one for UAA) wrapped by tokenCache.
+	tokenFetcher TokenSource
 }
 
 // NewConsumer constructs a new consumer client for nozzle.
@@ -104,53 +291,231 @@ type Config struct {
 // It returns error if the token is empty or can not fetch token from UAA
 // If token is not empty or successfully getting from UAA, then it returns nozzle.Consumer.
 // (In initial version, it starts consuming here but now Start() should be called).
+//
+// The given config is copied and not modified, so it can be reused for
+// other consumers (the token is fetched for each of them).
 func NewConsumer(config *Config) (Consumer, error) {
+	// Work on the copy not to set Logger and Token to the caller's config.
+	ownConfig := *config
+	config = &ownConfig
+
 	if config.Logger == nil {
 		config.Logger = defaultLogger
 	}
 
+	c := &consumer{
+		slowDetector: config.SlowDetector,
+		logger:       config.Logger,
+		v2:           config.EnvelopeV2,
+		stats:        &stats{},
+
+		filter:         config.Filter,
+		bufferSize:     config.BufferSize,
+		overflowPolicy: config.OverflowPolicy,
+		dropOrder:      config.DropOrder,
+	}
+
+	// hooks track the state and stats of consumer.
+	hooks := c.observeHooks(config.Hooks)
+
 	// If Token is not provided, fetch it by tokenFetcher.
+	// Custom RawConsumer may not need token.
+	if config.Token != "" || config.RawConsumer == nil || config.UaaAddr != "" || config.TokenSource != nil {
+		if err := setupToken(config, hooks); err != nil {
+			return nil, err
+		}
+	}
+
+	if cache, ok := config.tokenFetcher.(*tokenCache); ok {
+		c.tokenCache = cache
+	}
+
+	if expiry, ok := tokenExpiry(config.Token); ok {
+		c.stats.setTokenExpiry(expiry)
+	}
+
+	// Copy config to track the state of consumer by hooks. The copy
+	// is also used for reconnecting.
+	rawConfig := *config
+	rawConfig.Hooks = hooks
+
+	// Create new RawConsumer
+	rc, err := newRawConsumer(&rawConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	newRC := func() (RawConsumer, error) {
+		return newRawConsumer(&rawConfig)
+	}
+
+	// Stream consumer is reused because applications can be added and
+	// removed at runtime.
+	streamer, ok := rc.(*rawStreamConsumer)
+	if ok {
+		newRC = func() (RawConsumer, error) {
+			return streamer, nil
+		}
+	}
+
+	// Multi endpoint consumer is reused to keep the selected endpoint
+	// across reconnects. With EndpointAll, each endpoint is supervised
+	// instead not to stop the others while one is reconnecting.
+	endpointer, ok := rc.(*rawEndpointConsumer)
+	if ok {
+		newRC = func() (RawConsumer, error) {
+			return endpointer, nil
+		}
+	}
+
+	if config.Reconnect {
+		if endpointer != nil && endpointer.selector.strategy == EndpointAll {
+			endpointer.supervise(&rawConfig)
+		} else {
+			rc = newSupervisedRawConsumer(&rawConfig, rc, newRC)
+		}
+	}
+
+	c.rawConsumer = rc
+
+	// Open spool at last not to leave it opened on errors.
+	if config.SpoolDir != "" {
+		sp, err := openSpool(config, c.stats, config.Logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open spool: %s", err)
+		}
+		c.spool = sp
+	}
+
+	if streamer != nil {
+		return &streamConsumer{consumer: c, streamer: streamer}, nil
+	}
+
+	return c, nil
+}
+
+// setupToken sets Config.Token. If it's empty, the token is fetched by
+// Config.TokenSource (by default, from UAA). The source is also used
+// to refresh the token later. It's wrapped by tokenCache to share the
+// token and refresh it before it's expired.
+func setupToken(config *Config, hooks Hooks) error {
+	if config.tokenFetcher == nil && config.TokenSource != nil {
+		config.tokenFetcher = config.TokenSource
+	}
+
 	if config.Token != "" {
 		config.Logger.Printf("[DEBUG] Using auth token (%s)",
 			maskString(config.Token))
-	} else {
+		if config.tokenFetcher != nil {
+			cache := wrapTokenCache(config)
+			cache.set(config.Token)
+		}
+		return nil
+	}
+
+	if config.tokenFetcher == nil {
 		if config.UaaAddr == "" {
-			return nil, fmt.Errorf("both Token and UaaAddr can not be empty")
+			return fmt.Errorf("both Token and UaaAddr can not be empty")
 		}
 
-	    if config.tokenFetcher == nil {
-		    fetcher, err := newDefaultTokenFetcher(config)
-		    if err != nil {
-			    return nil, fmt.Errorf("failed to construct default token fetcher: %s", err)
-		    }
-		    config.tokenFetcher = fetcher
-	    }
+		fetcherConfig := *config
+		fetcherConfig.Hooks = hooks
+		fetcher, err := newTokenFetcher(&fetcherConfig)
+		if err != nil {
+			return fmt.Errorf("failed to construct default token fetcher: %s", err)
+		}
+		config.tokenFetcher = fetcher
+	}
 
-		// Execute tokenFetcher and get token
-		token, err := config.tokenFetcher.Fetch()
+	// Execute tokenFetcher and get token
+	token, err := wrapTokenCache(config).Fetch()
+	if err != nil {
+		return fmt.Errorf("failed to fetch token: %s", err)
+	}
+
+	config.Logger.Printf("[DEBUG] Setting auth token (%s)",
+		maskString(token))
+	config.Token = token
+	return nil
+}
+
+// wrapTokenCache wraps Config.tokenFetcher by tokenCache (if it's not
+// wrapped yet) and returns it.
+func wrapTokenCache(config *Config) *tokenCache {
+	if cache, ok := config.tokenFetcher.(*tokenCache); ok {
+		return cache
+	}
+
+	cache := newTokenCache(config.tokenFetcher, config.TokenRefreshSkew, config.Logger)
+	config.tokenFetcher = cache
+	return cache
+}
+
+// newRawConsumer returns RawConsumer for the config. If Config.RawConsumer
+// is set, it's returned as it is.
+func newRawConsumer(config *Config) (RawConsumer, error) {
+	if config.RawConsumer != nil {
+		return config.RawConsumer, nil
+	}
+
+	// Single endpoint in DopplerAddrs is same as DopplerAddr.
+	addrs := dopplerAddrs(config)
+	if len(addrs) == 1 && config.DopplerAddr == "" {
+		endpointConfig := *config
+		endpointConfig.DopplerAddr = addrs[0]
+		config = &endpointConfig
+	}
+
+	// noaa can't use the dialer, so it must not be ignored silently.
+	if config.RLPGatewayAddr == "" && config.Dialer != nil {
+		return nil, fmt.Errorf("Dialer can not be used with doppler (use Proxy instead)")
+	}
+
+	if len(config.AppGUIDs) > 0 {
+		if config.RLPGatewayAddr != "" {
+			return nil, fmt.Errorf("AppGUIDs can not be used with RLPGatewayAddr")
+		}
+
+		if len(addrs) > 1 {
+			return nil, fmt.Errorf("AppGUIDs can not be used with multiple doppler endpoints")
+		}
+
+		rc, err := newRawStreamConsumer(config)
 		if err != nil {
-			return nil, fmt.Errorf("failed to fetch token: %s", err)
+			return nil, fmt.Errorf("failed to construct stream consumer: %s", err)
+		}
+		return rc, nil
+	}
+
+	if config.RLPGatewayAddr != "" {
+		if len(config.DopplerAddrs) > 0 {
+			return nil, fmt.Errorf("DopplerAddrs can not be used with RLPGatewayAddr")
 		}
 
-		config.Logger.Printf("[DEBUG] Setting auth token (%s)",
-			maskString(token))
-		config.Token = token
+		if config.EndpointStrategy != EndpointFailover {
+			return nil, fmt.Errorf("EndpointStrategy can not be used with RLPGatewayAddr")
+		}
+
+		rc, err := newRawRLPGatewayConsumer(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct RLP gateway consumer: %s", err)
+		}
+		return rc, nil
 	}
 
-	// Create new RawConsumer
-	rc := config.rawConsumer
-	if rc == nil {
-		var err error
-		rc, err = newRawDefaultConsumer(config)
+	if len(addrs) > 1 {
+		rc, err := newRawEndpointConsumer(config, addrs)
 		if err != nil {
-			return nil, fmt.Errorf("failed to construct default consumer: %s", err)
+			return nil, fmt.Errorf("failed to construct multi endpoint consumer: %s", err)
 		}
+		return rc, nil
 	}
 
-	return &consumer{
-		rawConsumer: rc,
-		logger:      config.Logger,
-	}, nil
+	rc, err := newRawDefaultConsumer(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct default consumer: %s", err)
+	}
+	return rc, nil
 }
 
 // Deprecated: NewDefaultConsumer is deprecated, use NewConsumer instead
@@ -1,9 +1,13 @@
 package nozzle
 
 import (
+	"context"
+	"net"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
 )
 
 func TestDefaultConsumer(t *testing.T) {
@@ -64,6 +68,103 @@ func TestDefaultConsumer(t *testing.T) {
 	}
 }
 
+func TestDefaultConsumer_envelopeV2(t *testing.T) {
+	t.Parallel()
+
+	// inputCh is used to send message from test web socket server
+	inputCh := make(chan []byte, 1)
+
+	// authToken is valid auth token used for authorizing web socket connection
+	authToken := "pqnv8ubq3pOUBpaivu"
+
+	// Setup web socket server
+	ds := NewDopplerServer(t, inputCh, authToken)
+	defer ds.Close()
+
+	config := &Config{
+		DopplerAddr:    strings.Replace(ds.URL, "http:", "ws:", 1),
+		Insecure:       true,
+		Token:          authToken,
+		SubscriptionID: "A",
+		EnvelopeV2:     true,
+	}
+
+	consumer, err := NewConsumer(config)
+	if err != nil {
+		t.Fatalf("Expect not to err: %s", err)
+	}
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	message := "Hello from fake loggregator"
+	eventBytes, err := NewEvent(message, time.Now().UnixNano())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Send message from doppler.
+	inputCh <- eventBytes
+
+	select {
+	case event := <-consumer.EventsV2():
+		got := string(event.GetLog().GetPayload())
+		if got != message {
+			t.Fatalf("expect %q to be eq %q", got, message)
+		}
+	case err := <-consumer.Errors():
+		t.Fatalf("err :%s", err)
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
+
+func TestConsumer_customRawConsumer(t *testing.T) {
+	t.Parallel()
+
+	// Replay events including truncation message
+	rc := &replayRawConsumer{
+		Events: []*events.Envelope{
+			{
+				Origin:    &TR_Origin,
+				EventType: &TR_EventType,
+				CounterEvent: &events.CounterEvent{
+					Name: &TR_EventName,
+				},
+			},
+		},
+	}
+
+	consumer, err := NewConsumer(&Config{
+		RawConsumer: rc,
+	})
+	if err != nil {
+		t.Fatalf("Expect not to err: %s", err)
+	}
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	select {
+	case <-consumer.Detects():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect to be detected")
+	}
+
+	select {
+	case event := <-consumer.Events():
+		if event.GetOrigin() != TR_Origin {
+			t.Fatalf("expect %q to be eq %q", event.GetOrigin(), TR_Origin)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+}
+
 func TestDefaultConsumer_withoutStart(t *testing.T) {
 
 	// inputCh is used to send message from test web socket server
@@ -140,7 +241,53 @@ func TestNewDefaultConsumer(t *testing.T) {
 		{
 			in: &Config{
 				Token:       "xyz",
-				rawConsumer: &testRawConsumer{},
+				RawConsumer: &testRawConsumer{},
+			},
+			success: true,
+		},
+
+		{
+			in: &Config{
+				RawConsumer: &testRawConsumer{},
+			},
+			success: true,
+		},
+
+		{
+			in: &Config{
+				Token:          "xyz",
+				RLPGatewayAddr: "https://log-stream.cloudfoundry.net",
+			},
+			success: false,
+			errStr:  "SubscriptionID must not be empty",
+		},
+
+		{
+			in: &Config{
+				Token:          "xyz",
+				RLPGatewayAddr: "https://log-stream.cloudfoundry.net",
+				SubscriptionID: "A",
+			},
+			success: true,
+		},
+
+		{
+			in: &Config{
+				Token:          "xyz",
+				DopplerAddr:    "wss://doppler.cloudfoundry.net",
+				SubscriptionID: "A",
+				Dialer:         &net.Dialer{},
+			},
+			success: false,
+			errStr:  "Dialer can not be used with doppler",
+		},
+
+		{
+			in: &Config{
+				Token:          "xyz",
+				RLPGatewayAddr: "https://log-stream.cloudfoundry.net",
+				SubscriptionID: "A",
+				Dialer:         &net.Dialer{},
 			},
 			success: true,
 		},
@@ -155,8 +302,8 @@ func TestNewDefaultConsumer(t *testing.T) {
 
 		{
 			in: &Config{
-				UaaAddr:      "https://uaa.cloudfoundry.net",
-				tokenFetcher: &testTokenFetcher{},
+				UaaAddr:     "https://uaa.cloudfoundry.net",
+				TokenSource: &testTokenFetcher{},
 			},
 			success: false,
 			errStr:  "no token found",
@@ -165,7 +312,7 @@ func TestNewDefaultConsumer(t *testing.T) {
 		{
 			in: &Config{
 				UaaAddr: "https://uaa.cloudfoundry.net",
-				tokenFetcher: &testTokenFetcher{
+				TokenSource: &testTokenFetcher{
 					Token: "abc",
 				},
 			},
@@ -176,10 +323,10 @@ func TestNewDefaultConsumer(t *testing.T) {
 		{
 			in: &Config{
 				UaaAddr: "https://uaa.cloudfoundry.net",
-				tokenFetcher: &testTokenFetcher{
+				TokenSource: &testTokenFetcher{
 					Token: "abc",
 				},
-				rawConsumer: &testRawConsumer{},
+				RawConsumer: &testRawConsumer{},
 			},
 			success: true,
 		},
@@ -228,3 +375,87 @@ func TestMaskString(t *testing.T) {
 		}
 	}
 }
+
+func TestDefaultConsumer_startContext(t *testing.T) {
+	t.Parallel()
+
+	// inputCh is used to send message from test web socket server
+	inputCh := make(chan []byte, 1)
+
+	// authToken is valid auth token used for authorizing web socket connection
+	authToken := "bu9Pbvo8aBIUbq3ubvaU"
+
+	// Setup web socket server
+	ds := NewDopplerServer(t, inputCh, authToken)
+	defer ds.Close()
+
+	config := &Config{
+		DopplerAddr:    strings.Replace(ds.URL, "http:", "ws:", 1),
+		Insecure:       true,
+		Token:          authToken,
+		SubscriptionID: "A",
+	}
+
+	consumer, err := NewConsumer(config)
+	if err != nil {
+		t.Fatalf("Expect not to err: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := consumer.StartContext(ctx); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Cancel context, then consumer should be closed.
+	cancel()
+
+	select {
+	case _, ok := <-consumer.Events():
+		if ok {
+			t.Fatalf("expect events channel to be closed")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expect not timeout")
+	}
+
+	// Close after context is done should not fail.
+	if err := consumer.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestConsumer_startContext_done(t *testing.T) {
+	consumer := &consumer{
+		rawConsumer: &testRawConsumer{},
+		logger:      defaultLogger,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := consumer.StartContext(ctx); err != context.Canceled {
+		t.Fatalf("expect %v to be eq %v", err, context.Canceled)
+	}
+}
+
+func TestConsumer_closeContext_deadline(t *testing.T) {
+	t.Parallel()
+
+	consumer := &consumer{
+		rawConsumer: &testRawConsumer{
+			CloseWait: 1 * time.Second,
+		},
+		logger: defaultLogger,
+	}
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := consumer.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect %v to be eq %v", err, context.DeadlineExceeded)
+	}
+}
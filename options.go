@@ -0,0 +1,391 @@
+package nozzle
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Option configures the consumer constructed by New.
+type Option func(*options)
+
+// options is the state of Options. Errors of invalid arguments are
+// collected and reported by New with other problems.
+type options struct {
+	config Config
+	errs   []error
+}
+
+func (o *options) errorf(format string, args ...interface{}) {
+	o.errs = append(o.errs, fmt.Errorf(format, args...))
+}
+
+// ValidationError is returned by New when the options are invalid.
+// It has all problems found, not only the first one.
+type ValidationError struct {
+	Errors []error
+}
+
+// Error returns the description of all problems.
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("invalid config (%d errors): %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// New constructs a new consumer client for nozzle by options. Unlike
+// NewConsumer, all options are validated before constructing and it
+// returns *ValidationError which has every problem found. Given values
+// (including Config of WithConfig) are never modified.
+//
+// For example,
+//
+//	consumer, err := nozzle.New(
+//		nozzle.WithDoppler("wss://doppler.cf.example.com:443"),
+//		nozzle.WithSubscriptionID("go-nozzle"),
+//		nozzle.WithUAA("https://uaa.cf.example.com", "admin", "passw0rd"),
+//		nozzle.WithLogger(logger),
+//	)
+func New(opts ...Option) (Consumer, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	errs := append(o.errs, validateConfig(&o.config)...)
+	if len(errs) > 0 {
+		return nil, &ValidationError{Errors: errs}
+	}
+
+	return NewConsumer(&o.config)
+}
+
+// WithConfig uses the copy of the config as the base (slices and
+// TLSConfig are also copied). It replaces the values set by the former
+// options, so give it first.
+func WithConfig(config *Config) Option {
+	return func(o *options) {
+		if config == nil {
+			o.errorf("WithConfig: config must not be nil")
+			return
+		}
+		o.config = *config
+		o.config.tokenFetcher = nil
+		o.config.DopplerAddrs = copyStrings(config.DopplerAddrs)
+		o.config.AppGUIDs = copyStrings(config.AppGUIDs)
+		if config.DropOrder != nil {
+			o.config.DropOrder = append([]events.Envelope_EventType(nil), config.DropOrder...)
+		}
+
+		if config.TLSConfig != nil {
+			o.config.TLSConfig = config.TLSConfig.Clone()
+		}
+	}
+}
+
+// WithDoppler sets doppler firehose endpoint addresses. If more than
+// one address is given, they are used by Config.EndpointStrategy.
+func WithDoppler(addrs ...string) Option {
+	return func(o *options) {
+		if len(addrs) == 0 {
+			o.errorf("WithDoppler: at least one address must be given")
+			return
+		}
+
+		for _, addr := range addrs {
+			if addr == "" {
+				o.errorf("WithDoppler: address must not be empty")
+				return
+			}
+		}
+
+		o.config.DopplerAddr = ""
+		o.config.DopplerAddrs = copyStrings(addrs)
+	}
+}
+
+// WithSubscriptionID sets the subscription ID of firehose.
+func WithSubscriptionID(subscriptionID string) Option {
+	return func(o *options) {
+		o.config.SubscriptionID = subscriptionID
+	}
+}
+
+// WithUAA sets UAA endpoint address and CF admin username and password
+// to fetch the token.
+func WithUAA(addr, username, password string) Option {
+	return func(o *options) {
+		o.config.UaaAddr = addr
+		o.config.Username = username
+		o.config.Password = password
+	}
+}
+
+// WithClientCredentials sets UAA endpoint address and UAA client to
+// fetch the token by client_credentials grant.
+func WithClientCredentials(addr, clientID, clientSecret string) Option {
+	return func(o *options) {
+		o.config.UaaAddr = addr
+		o.config.ClientID = clientID
+		o.config.ClientSecret = clientSecret
+	}
+}
+
+// WithToken sets the access token.
+func WithToken(token string) Option {
+	return func(o *options) {
+		if token == "" {
+			o.errorf("WithToken: token must not be empty")
+			return
+		}
+		o.config.Token = token
+	}
+}
+
+// WithTokenSource sets TokenSource to fetch and refresh the token.
+func WithTokenSource(source TokenSource) Option {
+	return func(o *options) {
+		if source == nil {
+			o.errorf("WithTokenSource: source must not be nil")
+			return
+		}
+		o.config.TokenSource = source
+	}
+}
+
+// WithLogger sets the logger of go-nozzle.
+func WithLogger(logger *log.Logger) Option {
+	return func(o *options) {
+		if logger == nil {
+			o.errorf("WithLogger: logger must not be nil")
+			return
+		}
+		o.config.Logger = logger
+	}
+}
+
+// WithRetry sets how many times noaa retries to connect to doppler.
+func WithRetry(count int) Option {
+	return func(o *options) {
+		if count < 0 {
+			o.errorf("WithRetry: count must not be negative (%d)", count)
+			return
+		}
+		o.config.RetryCount = count
+	}
+}
+
+// WithIdleTimeout sets how much time to wait for a message to arrive.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		if timeout < 0 {
+			o.errorf("WithIdleTimeout: timeout must not be negative (%s)", timeout)
+			return
+		}
+		o.config.IdleTimeout = timeout
+	}
+}
+
+// validateConfig returns all problems of the config which are found
+// before connecting (validate of each consumer and token fetcher only
+// returns the first one).
+func validateConfig(config *Config) []error {
+	var errs []error
+	errorf := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	addrs := dopplerAddrs(config)
+
+	if config.RawConsumer == nil {
+		switch {
+		case len(config.AppGUIDs) > 0:
+			if config.RLPGatewayAddr != "" {
+				errorf("AppGUIDs can not be used with RLPGatewayAddr")
+			}
+
+			if len(addrs) > 1 {
+				errorf("AppGUIDs can not be used with multiple doppler endpoints")
+			}
+
+			if len(addrs) == 0 {
+				errorf("DopplerAddr must not be empty")
+			}
+		case config.RLPGatewayAddr == "" && len(addrs) == 0:
+			errorf("DopplerAddr (or RLPGatewayAddr) must not be empty")
+		}
+
+		if len(config.AppGUIDs) == 0 && config.SubscriptionID == "" {
+			errorf("SubscriptionID must not be empty")
+		}
+
+		if config.RLPGatewayAddr != "" && len(config.DopplerAddrs) > 0 {
+			errorf("DopplerAddrs can not be used with RLPGatewayAddr")
+		}
+
+		if config.RLPGatewayAddr != "" && config.EndpointStrategy != EndpointFailover {
+			errorf("EndpointStrategy can not be used with RLPGatewayAddr")
+		}
+
+		if config.RLPGatewayAddr == "" && config.Dialer != nil {
+			errorf("Dialer can not be used with doppler (use Proxy instead)")
+		}
+	}
+
+	switch config.EndpointStrategy {
+	case EndpointFailover, EndpointRoundRobin, EndpointAll:
+	default:
+		errorf("unknown EndpointStrategy: %s", config.EndpointStrategy)
+	}
+
+	// The token is fetched from UAA if it's not given.
+	if config.Token == "" && config.TokenSource == nil && (config.RawConsumer == nil || config.UaaAddr != "") {
+		errs = append(errs, validateUAAConfig(config)...)
+	}
+
+	if (config.ClientID != "" || config.ClientSecret != "") && (config.Username != "" || config.Password != "") {
+		errorf("both ClientID/ClientSecret and Username/Password can not be set")
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		errorf("both TLSCertFile and TLSKeyFile must be set")
+	} else if config.TLSCAFile != "" || config.TLSCertFile != "" {
+		// Load the files in the same way as connecting to check
+		// they are readable.
+		if _, err := newTLSConfig(config); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if config.RetryCount < 0 {
+		errorf("RetryCount must not be negative")
+	}
+
+	if config.IdleTimeout < 0 {
+		errorf("IdleTimeout must not be negative")
+	}
+
+	if config.BufferSize < 0 {
+		errorf("BufferSize must not be negative")
+	}
+
+	switch config.OverflowPolicy {
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowDropByPriority:
+	default:
+		errorf("unknown OverflowPolicy: %s", config.OverflowPolicy)
+	}
+
+	if len(config.DropOrder) > 0 && config.OverflowPolicy != OverflowDropByPriority {
+		errorf("DropOrder can only be used with OverflowDropByPriority")
+	}
+
+	for _, eventType := range config.DropOrder {
+		if _, ok := events.Envelope_EventType_name[int32(eventType)]; !ok {
+			errorf("unknown event type in DropOrder: %d", eventType)
+		}
+	}
+
+	errs = append(errs, validateSpoolConfig(config)...)
+
+	if config.ReconnectInterval < 0 {
+		errorf("ReconnectInterval must not be negative")
+	}
+
+	if config.ReconnectMaxInterval < 0 {
+		errorf("ReconnectMaxInterval must not be negative")
+	}
+
+	if config.ReconnectMaxElapsedTime < 0 {
+		errorf("ReconnectMaxElapsedTime must not be negative")
+	}
+
+	if config.ReconnectInterval > 0 && config.ReconnectMaxInterval > 0 && config.ReconnectMaxInterval < config.ReconnectInterval {
+		errorf("ReconnectMaxInterval (%s) must not be less than ReconnectInterval (%s)",
+			config.ReconnectMaxInterval, config.ReconnectInterval)
+	}
+
+	return errs
+}
+
+// validateSpoolConfig returns the problems of the spool settings. The
+// directory is not created here.
+func validateSpoolConfig(config *Config) []error {
+	var errs []error
+	if config.SpoolMaxBytes < 0 {
+		errs = append(errs, fmt.Errorf("SpoolMaxBytes must not be negative"))
+	}
+
+	if config.SpoolSegmentSize < 0 {
+		errs = append(errs, fmt.Errorf("SpoolSegmentSize must not be negative"))
+	}
+
+	switch config.SpoolSync {
+	case SpoolSyncNone, SpoolSyncSegment, SpoolSyncAlways:
+	default:
+		errs = append(errs, fmt.Errorf("unknown SpoolSync: %s", config.SpoolSync))
+	}
+
+	if config.SpoolDir == "" {
+		return errs
+	}
+
+	// If it doesn't exist yet, it's created with its parents by opening
+	// the spool, so the nearest existing one must be a directory.
+	path := config.SpoolDir
+	fi, err := os.Stat(path)
+	for err != nil && filepath.Dir(path) != path {
+		path = filepath.Dir(path)
+		fi, err = os.Stat(path)
+	}
+
+	if err == nil && !fi.IsDir() {
+		errs = append(errs, fmt.Errorf("SpoolDir can not be created: %s is not a directory", path))
+	}
+
+	return errs
+}
+
+// validateUAAConfig returns the problems of the config for fetching
+// the token from UAA.
+func validateUAAConfig(config *Config) []error {
+	if config.UaaAddr == "" {
+		return []error{fmt.Errorf("Token, TokenSource or UaaAddr must be set")}
+	}
+
+	var errs []error
+	if config.ClientID != "" || config.ClientSecret != "" {
+		if config.ClientID == "" {
+			errs = append(errs, fmt.Errorf("ClientID must not be empty"))
+		}
+
+		if config.ClientSecret == "" {
+			errs = append(errs, fmt.Errorf("ClientSecret must not be empty"))
+		}
+		return errs
+	}
+
+	if config.Username == "" {
+		errs = append(errs, fmt.Errorf("Username must not be empty"))
+	}
+
+	if config.Password == "" {
+		errs = append(errs, fmt.Errorf("Password must not be empty"))
+	}
+	return errs
+}
+
+// copyStrings returns the copy of the slice not to share it with
+// the caller.
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string(nil), s...)
+}
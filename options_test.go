@@ -0,0 +1,219 @@
+package nozzle
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+func TestNew(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+
+	c, err := New(
+		WithDoppler("wss://doppler.example.com"),
+		WithSubscriptionID("go-nozzle"),
+		WithToken("n98ubNOIUog9gOPUbvqiur"),
+		WithLogger(logger),
+		WithRetry(3),
+		WithIdleTimeout(10*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rc, ok := c.(*consumer).rawConsumer.(*rawDefaultConsumer)
+	if !ok {
+		t.Fatalf("expects rawDefaultConsumer to be used")
+	}
+
+	if rc.dopplerAddr != "wss://doppler.example.com" || rc.retryCount != 3 || rc.idleTimeout != 10*time.Second || rc.logger != logger {
+		t.Fatalf("unexpected consumer: %#v", rc)
+	}
+}
+
+func TestNew_notModified(t *testing.T) {
+	fetcher := &countTokenFetcher{ttl: time.Hour}
+	addrs := []string{"wss://doppler-a.example.com", "wss://doppler-b.example.com"}
+	dropOrder := []events.Envelope_EventType{events.Envelope_LogMessage}
+	tlsConfig := &tls.Config{ServerName: "doppler.example.com"}
+	config := &Config{
+		DopplerAddrs:   addrs,
+		SubscriptionID: "go-nozzle",
+		TokenSource:    fetcher,
+		TLSConfig:      tlsConfig,
+		OverflowPolicy: OverflowDropByPriority,
+		DropOrder:      dropOrder,
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := New(WithConfig(config), WithRetry(1)); err != nil {
+			t.Fatalf("#%d err: %s", i, err)
+		}
+	}
+
+	if config.Token != "" || config.Logger != nil || config.RetryCount != 0 || config.tokenFetcher != nil {
+		t.Fatalf("expects config not to be modified: %#v", config)
+	}
+
+	if _, err := New(WithConfig(config), WithDoppler("wss://doppler-c.example.com")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if addrs[0] != "wss://doppler-a.example.com" || len(config.DopplerAddrs) != 2 {
+		t.Fatalf("expects addresses not to be modified: %v", config.DopplerAddrs)
+	}
+
+	// The config is owned by the options after WithConfig.
+	o := &options{}
+	WithConfig(config)(o)
+	o.config.TLSConfig.ServerName = "modified"
+	o.config.DropOrder[0] = events.Envelope_ValueMetric
+
+	if tlsConfig.ServerName != "doppler.example.com" || dropOrder[0] != events.Envelope_LogMessage {
+		t.Fatalf("expects TLSConfig and DropOrder not to be shared: %#v", config)
+	}
+
+	// The token cache of another consumer must not be shared.
+	config.tokenFetcher = newTokenCache(fetcher, 0, nil)
+	o = &options{}
+	WithConfig(config)(o)
+	if o.config.tokenFetcher != nil {
+		t.Fatalf("expects tokenFetcher not to be copied: %#v", o.config.tokenFetcher)
+	}
+}
+
+func TestNew_validate(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cases := []struct {
+		opts   []Option
+		expect []string
+	}{
+		{
+			opts: nil,
+			expect: []string{
+				"DopplerAddr (or RLPGatewayAddr) must not be empty",
+				"SubscriptionID must not be empty",
+				"Token, TokenSource or UaaAddr must be set",
+			},
+		},
+		{
+			opts: []Option{
+				WithDoppler("wss://doppler.example.com"),
+				WithSubscriptionID("go-nozzle"),
+				WithUAA("https://uaa.example.com", "admin", ""),
+				WithRetry(-1),
+				WithIdleTimeout(-1 * time.Second),
+				WithLogger(nil),
+			},
+			expect: []string{
+				"WithRetry: count must not be negative (-1)",
+				"WithIdleTimeout: timeout must not be negative (-1s)",
+				"WithLogger: logger must not be nil",
+				"Password must not be empty",
+			},
+		},
+		{
+			opts: []Option{
+				WithConfig(&Config{
+					AppGUIDs:         []string{"app-1"},
+					RLPGatewayAddr:   "https://log-stream.example.com",
+					EndpointStrategy: EndpointStrategy(10),
+					TLSCertFile:      "cert.pem",
+				}),
+				WithDoppler("wss://doppler-a.example.com", "wss://doppler-b.example.com"),
+				WithClientCredentials("https://uaa.example.com", "nozzle-client", ""),
+			},
+			expect: []string{
+				"AppGUIDs can not be used with RLPGatewayAddr",
+				"AppGUIDs can not be used with multiple doppler endpoints",
+				"DopplerAddrs can not be used with RLPGatewayAddr",
+				"EndpointStrategy can not be used with RLPGatewayAddr",
+				"unknown EndpointStrategy: EndpointStrategy(10)",
+				"ClientSecret must not be empty",
+				"both TLSCertFile and TLSKeyFile must be set",
+			},
+		},
+		{
+			opts: []Option{
+				WithConfig(&Config{Dialer: &net.Dialer{}}),
+				WithDoppler("wss://doppler.example.com"),
+				WithSubscriptionID("go-nozzle"),
+				WithToken("n98ubNOIUog9gOPUbvqiur"),
+			},
+			expect: []string{
+				"Dialer can not be used with doppler (use Proxy instead)",
+			},
+		},
+		{
+			opts: []Option{
+				WithConfig(&Config{
+					TLSCAFile:               caFile,
+					BufferSize:              10,
+					OverflowPolicy:          OverflowPolicy(10),
+					DropOrder:               []events.Envelope_EventType{events.Envelope_LogMessage, 100},
+					SpoolDir:                filepath.Join(file, "spool"),
+					SpoolMaxBytes:           -1,
+					SpoolSegmentSize:        -1,
+					SpoolSync:               SpoolSyncPolicy(10),
+					Reconnect:               true,
+					ReconnectInterval:       10 * time.Second,
+					ReconnectMaxInterval:    time.Second,
+					ReconnectMaxElapsedTime: -1,
+				}),
+				WithDoppler("wss://doppler.example.com"),
+				WithSubscriptionID("go-nozzle"),
+				WithToken("n98ubNOIUog9gOPUbvqiur"),
+			},
+			expect: []string{
+				"failed to stat " + caFile + ": stat " + caFile + ": no such file or directory",
+				"unknown OverflowPolicy: OverflowPolicy(10)",
+				"DropOrder can only be used with OverflowDropByPriority",
+				"unknown event type in DropOrder: 100",
+				"SpoolMaxBytes must not be negative",
+				"SpoolSegmentSize must not be negative",
+				"unknown SpoolSync: SpoolSyncPolicy(10)",
+				"SpoolDir can not be created: " + file + " is not a directory",
+				"ReconnectMaxElapsedTime must not be negative",
+				"ReconnectMaxInterval (1s) must not be less than ReconnectInterval (10s)",
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		_, err := New(tc.opts...)
+		verr, ok := err.(*ValidationError)
+		if !ok {
+			t.Fatalf("#%d expects %v to be *ValidationError", i, err)
+		}
+
+		if len(verr.Errors) != len(tc.expect) {
+			t.Fatalf("#%d expects %d errors: %s", i, len(tc.expect), verr)
+		}
+
+		for j, expect := range tc.expect {
+			if got := verr.Errors[j].Error(); got != expect {
+				t.Fatalf("#%d-%d expects %q to be eq %q", i, j, got, expect)
+			}
+		}
+
+		if !strings.HasPrefix(verr.Error(), "invalid config") {
+			t.Fatalf("#%d unexpected message: %s", i, verr)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package nozzle
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gorilla/websocket"
+)
+
+// DetectPolicy defines the policy to detect `slowConsumerAlert`.
+// It's used by SlowDetector constructed by NewSlowDetector.
+//
+// Methods are called for every envelope and error which pass through
+// the detector. They may be called from different goroutines.
+type DetectPolicy interface {
+	// CheckEnvelope inspects the envelope from upstream. It returns
+	// non-nil error when the nozzle is considered slow. The error
+	// is notified as `slowConsumerAlert`.
+	CheckEnvelope(*events.Envelope) error
+
+	// CheckError inspects the error from upstream. It returns
+	// non-nil error when the nozzle is considered slow.
+	CheckError(error) error
+}
+
+// DetectPolicyV2 is implemented by DetectPolicy which can inspect
+// loggregator V2 envelope directly. If DetectPolicy doesn't implement
+// this, V2 envelope is converted to V1 before passing it.
+type DetectPolicyV2 interface {
+	// CheckEnvelopeV2 is same as CheckEnvelope but for V2 envelope.
+	CheckEnvelopeV2(*loggregator_v2.Envelope) error
+}
+
+// DefaultDetectPolicies returns the policies used by default.
+// These are same as the detection logic of
+// https://github.com/cloudfoundry-incubator/datadog-firehose-nozzle.
+func DefaultDetectPolicies() []DetectPolicy {
+	return []DetectPolicy{
+		DetectTruncated(),
+		DetectPolicyViolation(),
+	}
+}
+
+// DetectTruncated returns the policy which detects the message from
+// doppler that it dropped messages from its queue (truncating buffer)
+// because the nozzle could not consume messages as quickly as
+// the firehose was sending them.
+func DetectTruncated() DetectPolicy {
+	return &truncatedPolicy{}
+}
+
+type truncatedPolicy struct{}
+
+func (p *truncatedPolicy) CheckEnvelope(e *events.Envelope) error {
+	if !isTruncated(e) {
+		return nil
+	}
+
+	alert := newEnvelopeAlert(AlertTruncated, e,
+		"doppler dropped messages from its queue because nozzle is slow")
+	alert.Dropped = e.GetCounterEvent().GetDelta()
+	return alert
+}
+
+func (p *truncatedPolicy) CheckEnvelopeV2(e *loggregator_v2.Envelope) error {
+	if v1e := truncatedV1(e); v1e != nil {
+		return p.CheckEnvelope(v1e)
+	}
+	return nil
+}
+
+func (p *truncatedPolicy) CheckError(error) error {
+	return nil
+}
+
+// DetectPolicyViolation returns the policy which detects websocket
+// close error with ClosePolicyViolation (1008).
+func DetectPolicyViolation() DetectPolicy {
+	return &policyViolationPolicy{}
+}
+
+type policyViolationPolicy struct{}
+
+func (p *policyViolationPolicy) CheckEnvelope(*events.Envelope) error {
+	return nil
+}
+
+func (p *policyViolationPolicy) CheckEnvelopeV2(*loggregator_v2.Envelope) error {
+	return nil
+}
+
+func (p *policyViolationPolicy) CheckError(err error) error {
+	switch t := err.(type) {
+	case *websocket.CloseError:
+		if t.Code == websocket.ClosePolicyViolation {
+			// ClosePolicyViolation (1008)
+			// indicates that an endpoint is terminating the connection
+			// because it has received a message that violates its policy.
+			//
+			// This is a generic status code that can be returned when there is no
+			// other more suitable status code (e.g., 1003 or 1009) or if there
+			// is a need to hide specific details about the policy.
+			//
+			// http://tools.ietf.org/html/rfc6455#section-11.7
+			return &SlowConsumerAlert{
+				Kind:    AlertPolicyViolation,
+				Time:    time.Now(),
+				Message: "websocket terminates the connection because connection is too slow (ClosePolicyViolation)",
+				Err:     err,
+			}
+		}
+	}
+	return nil
+}
+
+// DetectDroppedRate returns the policy which detects when doppler
+// dropped more than threshold messages in the sliding window.
+// The number of dropped messages is counted by the delta of
+// `TruncatingBuffer.DroppedMessages` counter.
+//
+// Unlike DetectTruncated, it ignores occasional small drops.
+func DetectDroppedRate(threshold uint64, window time.Duration) DetectPolicy {
+	return &droppedRatePolicy{
+		threshold: threshold,
+		window:    window,
+		now:       time.Now,
+	}
+}
+
+type droppedRatePolicy struct {
+	threshold uint64
+	window    time.Duration
+
+	// now is used for getting current time (for testing).
+	now func() time.Time
+
+	mu      sync.Mutex
+	samples []droppedSample
+}
+
+// droppedSample is the number of dropped messages at the time.
+type droppedSample struct {
+	time  time.Time
+	delta uint64
+}
+
+func (p *droppedRatePolicy) CheckEnvelope(e *events.Envelope) error {
+	if !isTruncated(e) {
+		return nil
+	}
+
+	sum, ok := p.add(e.GetCounterEvent().GetDelta())
+	if !ok {
+		return nil
+	}
+
+	alert := newEnvelopeAlert(AlertDroppedRate, e,
+		fmt.Sprintf("doppler dropped %d messages in %s because nozzle is slow", sum, p.window))
+	alert.Dropped = sum
+	return alert
+}
+
+func (p *droppedRatePolicy) CheckEnvelopeV2(e *loggregator_v2.Envelope) error {
+	if v1e := truncatedV1(e); v1e != nil {
+		return p.CheckEnvelope(v1e)
+	}
+	return nil
+}
+
+func (p *droppedRatePolicy) CheckError(error) error {
+	return nil
+}
+
+// add adds the sample and checks the sum of dropped messages
+// in the window exceeds threshold or not. It returns the sum
+// and true if it exceeds.
+func (p *droppedRatePolicy) add(delta uint64) (uint64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	p.samples = append(p.samples, droppedSample{time: now, delta: delta})
+
+	// Remove samples which are out of the window.
+	i := 0
+	for ; i < len(p.samples); i++ {
+		if now.Sub(p.samples[i].time) < p.window {
+			break
+		}
+	}
+	p.samples = p.samples[i:]
+
+	var sum uint64
+	for _, s := range p.samples {
+		sum += s.delta
+	}
+
+	if sum < p.threshold {
+		return 0, false
+	}
+
+	// Reset samples not to notify same drops again.
+	p.samples = nil
+	return sum, true
+}
+
+// DetectLatency returns the policy which detects when the nozzle lags
+// behind more than threshold. Lag is measured from the timestamp of
+// envelope to the time when the detector receives it.
+//
+// Since it's checked for every envelope, it's recommended to use it
+// with MinAlertInterval.
+func DetectLatency(threshold time.Duration) DetectPolicy {
+	return &latencyPolicy{
+		threshold: threshold,
+		now:       time.Now,
+	}
+}
+
+type latencyPolicy struct {
+	threshold time.Duration
+
+	// now is used for getting current time (for testing).
+	now func() time.Time
+}
+
+func (p *latencyPolicy) CheckEnvelope(e *events.Envelope) error {
+	latency, ok := p.check(e.GetTimestamp())
+	if !ok {
+		return nil
+	}
+
+	alert := newEnvelopeAlert(AlertLatency, e, p.message(latency))
+	alert.Latency = latency
+	return alert
+}
+
+func (p *latencyPolicy) CheckEnvelopeV2(e *loggregator_v2.Envelope) error {
+	latency, ok := p.check(e.GetTimestamp())
+	if !ok {
+		return nil
+	}
+
+	alert := newEnvelopeV2Alert(AlertLatency, e, p.message(latency))
+	alert.Latency = latency
+	return alert
+}
+
+func (p *latencyPolicy) CheckError(error) error {
+	return nil
+}
+
+// check returns the latency and true if it exceeds threshold.
+func (p *latencyPolicy) check(timestamp int64) (time.Duration, bool) {
+	// Envelope without timestamp can not be checked.
+	if timestamp == 0 {
+		return 0, false
+	}
+
+	latency := p.now().Sub(time.Unix(0, timestamp))
+	return latency, latency > p.threshold
+}
+
+func (p *latencyPolicy) message(latency time.Duration) string {
+	return fmt.Sprintf("nozzle lags behind firehose by %s (threshold %s)", latency, p.threshold)
+}
+
+// MinAlertInterval returns the policy which wraps the given policy and
+// suppresses alerts until interval passes since the last alert.
+// It's used for reducing alert noise.
+func MinAlertInterval(interval time.Duration, policy DetectPolicy) DetectPolicy {
+	return &minIntervalPolicy{
+		interval: interval,
+		policy:   policy,
+		now:      time.Now,
+	}
+}
+
+type minIntervalPolicy struct {
+	interval time.Duration
+	policy   DetectPolicy
+
+	// now is used for getting current time (for testing).
+	now func() time.Time
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (p *minIntervalPolicy) CheckEnvelope(e *events.Envelope) error {
+	return p.throttle(p.policy.CheckEnvelope(e))
+}
+
+func (p *minIntervalPolicy) CheckEnvelopeV2(e *loggregator_v2.Envelope) error {
+	if pv2, ok := p.policy.(DetectPolicyV2); ok {
+		return p.throttle(pv2.CheckEnvelopeV2(e))
+	}
+
+	for _, v1e := range ToV1(e) {
+		if err := p.throttle(p.policy.CheckEnvelope(v1e)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *minIntervalPolicy) CheckError(err error) error {
+	return p.throttle(p.policy.CheckError(err))
+}
+
+// throttle returns nil if the last alert was notified in interval.
+func (p *minIntervalPolicy) throttle(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if !p.last.IsZero() && now.Sub(p.last) < p.interval {
+		return nil
+	}
+
+	p.last = now
+	return err
+}
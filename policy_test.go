@@ -0,0 +1,220 @@
+package nozzle
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+)
+
+// fakeClock is used for controlling current time in policies.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTruncatedEvent(delta uint64) *events.Envelope {
+	return &events.Envelope{
+		Origin:    &TR_Origin,
+		EventType: &TR_EventType,
+		CounterEvent: &events.CounterEvent{
+			Name:  &TR_EventName,
+			Delta: proto.Uint64(delta),
+		},
+	}
+}
+
+func TestDetectPolicy_implement(t *testing.T) {
+	var _ DetectPolicyV2 = &truncatedPolicy{}
+	var _ DetectPolicyV2 = &policyViolationPolicy{}
+	var _ DetectPolicyV2 = &droppedRatePolicy{}
+	var _ DetectPolicyV2 = &latencyPolicy{}
+	var _ DetectPolicyV2 = &minIntervalPolicy{}
+}
+
+func TestDetectTruncated_v2(t *testing.T) {
+	cases := []struct {
+		Input  *loggregator_v2.Envelope
+		Expect bool
+	}{
+		{
+			Input: &loggregator_v2.Envelope{
+				Tags: map[string]string{
+					"origin": TR_Origin,
+				},
+				Message: &loggregator_v2.Envelope_Counter{
+					Counter: &loggregator_v2.Counter{
+						Name:  TR_EventName,
+						Delta: 10,
+					},
+				},
+			},
+			Expect: true,
+		},
+
+		{
+			Input: &loggregator_v2.Envelope{
+				Tags: map[string]string{
+					"origin": "metron",
+				},
+				Message: &loggregator_v2.Envelope_Counter{
+					Counter: &loggregator_v2.Counter{
+						Name: TR_EventName,
+					},
+				},
+			},
+			Expect: false,
+		},
+
+		{
+			Input:  &loggregator_v2.Envelope{},
+			Expect: false,
+		},
+	}
+
+	policy := DetectTruncated().(DetectPolicyV2)
+	for i, tc := range cases {
+		err := policy.CheckEnvelopeV2(tc.Input)
+		if (err != nil) != tc.Expect {
+			t.Fatalf("#%d expects %v to be eq %v", i, err != nil, tc.Expect)
+		}
+	}
+}
+
+func TestDetectPolicyViolation(t *testing.T) {
+	cases := []struct {
+		Input  error
+		Expect bool
+	}{
+		{
+			Input: &websocket.CloseError{
+				Code: websocket.ClosePolicyViolation,
+			},
+			Expect: true,
+		},
+
+		{
+			Input: &websocket.CloseError{
+				Code: websocket.CloseNormalClosure,
+			},
+			Expect: false,
+		},
+
+		{
+			Input:  errors.New(""),
+			Expect: false,
+		},
+	}
+
+	policy := DetectPolicyViolation()
+	for i, tc := range cases {
+		err := policy.CheckError(tc.Input)
+		if (err != nil) != tc.Expect {
+			t.Fatalf("#%d expects %v to be eq %v", i, err != nil, tc.Expect)
+		}
+	}
+}
+
+func TestDetectDroppedRate(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	policy := DetectDroppedRate(100, 1*time.Minute).(*droppedRatePolicy)
+	policy.now = clock.Now
+
+	cases := []struct {
+		After  time.Duration
+		Input  *events.Envelope
+		Expect bool
+	}{
+		// Non truncation message is ignored
+		{Input: &events.Envelope{}, Expect: false},
+
+		// 60 messages in window
+		{Input: newTruncatedEvent(60), Expect: false},
+
+		// 60 messages are out of window, 50 messages in window
+		{After: 2 * time.Minute, Input: newTruncatedEvent(50), Expect: false},
+
+		// 110 messages in window
+		{After: 10 * time.Second, Input: newTruncatedEvent(60), Expect: true},
+
+		// Samples are reset after notified
+		{After: 10 * time.Second, Input: newTruncatedEvent(10), Expect: false},
+	}
+
+	for i, tc := range cases {
+		clock.Add(tc.After)
+		err := policy.CheckEnvelope(tc.Input)
+		if (err != nil) != tc.Expect {
+			t.Fatalf("#%d expects %v to be eq %v", i, err != nil, tc.Expect)
+		}
+	}
+}
+
+func TestDetectLatency(t *testing.T) {
+	now := time.Now()
+	policy := DetectLatency(10 * time.Second).(*latencyPolicy)
+	policy.now = func() time.Time { return now }
+
+	cases := []struct {
+		Timestamp int64
+		Expect    bool
+	}{
+		{Timestamp: now.Add(-1 * time.Second).UnixNano(), Expect: false},
+		{Timestamp: now.Add(-1 * time.Minute).UnixNano(), Expect: true},
+
+		// No timestamp
+		{Timestamp: 0, Expect: false},
+	}
+
+	for i, tc := range cases {
+		err := policy.CheckEnvelope(&events.Envelope{
+			Timestamp: proto.Int64(tc.Timestamp),
+		})
+		if (err != nil) != tc.Expect {
+			t.Fatalf("#%d expects %v to be eq %v", i, err != nil, tc.Expect)
+		}
+
+		err = policy.CheckEnvelopeV2(ToV2(&events.Envelope{
+			Timestamp: proto.Int64(tc.Timestamp),
+		}))
+		if (err != nil) != tc.Expect {
+			t.Fatalf("#%d expects %v to be eq %v (V2)", i, err != nil, tc.Expect)
+		}
+	}
+}
+
+func TestMinAlertInterval(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	policy := MinAlertInterval(1*time.Minute, DetectTruncated()).(*minIntervalPolicy)
+	policy.now = clock.Now
+
+	cases := []struct {
+		After  time.Duration
+		Input  *events.Envelope
+		Expect bool
+	}{
+		{Input: newTruncatedEvent(1), Expect: true},
+		{After: 10 * time.Second, Input: newTruncatedEvent(1), Expect: false},
+		{After: 10 * time.Second, Input: &events.Envelope{}, Expect: false},
+		{After: 1 * time.Minute, Input: newTruncatedEvent(1), Expect: true},
+	}
+
+	for i, tc := range cases {
+		clock.Add(tc.After)
+		err := policy.CheckEnvelope(tc.Input)
+		if (err != nil) != tc.Expect {
+			t.Fatalf("#%d expects %v to be eq %v", i, err != nil, tc.Expect)
+		}
+	}
+}
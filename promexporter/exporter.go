@@ -0,0 +1,260 @@
+// Package promexporter exports the metrics of go-nozzle consumer
+// in Prometheus format.
+//
+// Exporter collects the statistics of Consumer (Consumer.Stats) and
+// the events from Hooks (e.g., token fetch latency). To use it, set
+// Hooks before constructing Consumer and watch it after that,
+//
+//	exporter := promexporter.New(&promexporter.Config{})
+//	config.Hooks = exporter.Hooks(config.Hooks)
+//
+//	consumer, err := nozzle.NewConsumer(config)
+//	...
+//	exporter.Watch(consumer)
+//
+//	// Metrics are served on /metrics
+//	go http.ListenAndServe(":9090", exporter)
+package promexporter
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rakutentech/go-nozzle"
+)
+
+const (
+	// DefaultNamespace is the default prefix of metric names.
+	DefaultNamespace = "nozzle"
+
+	// DefaultPath is the default path to serve metrics.
+	DefaultPath = "/metrics"
+)
+
+// Config is a configuration struct for Exporter.
+type Config struct {
+	// Namespace is the prefix of metric names.
+	// The default value is DefaultNamespace ("nozzle").
+	Namespace string
+
+	// Path is the path to serve metrics by ServeHTTP.
+	// The default value is DefaultPath ("/metrics").
+	Path string
+
+	// Registry is used for registering Exporter. If it's nil, new
+	// registry is created. Use it to serve metrics with your own ones.
+	Registry *prometheus.Registry
+
+	// TokenFetchBuckets is the buckets of token fetch latency histogram
+	// in seconds. The default value is prometheus.DefBuckets.
+	TokenFetchBuckets []float64
+}
+
+// Exporter implements prometheus.Collector and http.Handler.
+type Exporter struct {
+	path     string
+	registry *prometheus.Registry
+	handler  http.Handler
+
+	envelopes      *prometheus.Desc
+	bytes          *prometheus.Desc
+	errors         *prometheus.Desc
+	alerts         *prometheus.Desc
+	retries        *prometheus.Desc
+	reconnects     *prometheus.Desc
+	lag            *prometheus.Desc
+	lastTimestamp  *prometheus.Desc
+	tokenFetch     prometheus.Histogram
+	tokenFailures  prometheus.Counter
+	tokenRefreshes prometheus.Counter
+
+	// mu protects consumer.
+	mu       sync.Mutex
+	consumer nozzle.Consumer
+}
+
+// New constructs Exporter and registers it to the registry.
+func New(config *Config) *Exporter {
+	namespace := config.Namespace
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	path := config.Path
+	if path == "" {
+		path = DefaultPath
+	}
+
+	registry := config.Registry
+	if registry == nil {
+		registry = prometheus.NewRegistry()
+	}
+
+	buckets := config.TokenFetchBuckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+
+	e := &Exporter{
+		path:     path,
+		registry: registry,
+		handler:  promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+
+		envelopes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "envelopes_total"),
+			"Number of envelopes received from firehose.",
+			[]string{"type", "origin"}, nil),
+		bytes: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "envelope_bytes_total"),
+			"Total size of envelopes received from firehose.",
+			nil, nil),
+		errors: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "errors_total"),
+			"Number of errors occurred while consuming.",
+			nil, nil),
+		alerts: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "slow_consumer_alerts_total"),
+			"Number of slow consumer alerts.",
+			[]string{"kind"}, nil),
+		retries: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "retries_total"),
+			"Number of retries by noaa or RLP gateway client.",
+			nil, nil),
+		reconnects: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "reconnects_total"),
+			"Number of reconnect attempts by supervised mode.",
+			nil, nil),
+		lag: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "lag_seconds"),
+			"How much the consumer lags behind the timestamp of the last envelope.",
+			nil, nil),
+		lastTimestamp: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "last_envelope_timestamp_seconds"),
+			"Timestamp of the last envelope.",
+			nil, nil),
+
+		tokenFetch: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "token_fetch_duration_seconds",
+			Help:      "Latency of fetching token from UAA.",
+			Buckets:   buckets,
+		}),
+		tokenFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "token_fetch_failures_total",
+			Help:      "Number of failures of fetching token from UAA.",
+		}),
+		tokenRefreshes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "token_refreshes_total",
+			Help:      "Number of token refreshes.",
+		}),
+	}
+
+	registry.MustRegister(e)
+	return e
+}
+
+// Hooks returns hooks which observe token fetching and then call
+// the given hooks. Set them to nozzle.Config.Hooks.
+func (e *Exporter) Hooks(hooks nozzle.Hooks) nozzle.Hooks {
+	onTokenFetch, onTokenRefresh := hooks.OnTokenFetch, hooks.OnTokenRefresh
+
+	// OnTokenFetch also covers the initial fetch.
+	hooks.OnTokenFetch = func(ev nozzle.TokenFetchEvent) {
+		e.tokenFetch.Observe(ev.Duration.Seconds())
+		if ev.Err != nil {
+			e.tokenFailures.Inc()
+		}
+
+		if onTokenFetch != nil {
+			onTokenFetch(ev)
+		}
+	}
+
+	hooks.OnTokenRefresh = func(ev nozzle.TokenRefreshEvent) {
+		e.tokenRefreshes.Inc()
+		if onTokenRefresh != nil {
+			onTokenRefresh(ev)
+		}
+	}
+
+	return hooks
+}
+
+// Watch sets the consumer whose statistics are exported.
+func (e *Exporter) Watch(consumer nozzle.Consumer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.consumer = consumer
+}
+
+// Describe implements prometheus.Collector.
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.envelopes
+	ch <- e.bytes
+	ch <- e.errors
+	ch <- e.alerts
+	ch <- e.retries
+	ch <- e.reconnects
+	ch <- e.lag
+	ch <- e.lastTimestamp
+	e.tokenFetch.Describe(ch)
+	e.tokenFailures.Describe(ch)
+	e.tokenRefreshes.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.tokenFetch.Collect(ch)
+	e.tokenFailures.Collect(ch)
+	e.tokenRefreshes.Collect(ch)
+
+	e.mu.Lock()
+	consumer := e.consumer
+	e.mu.Unlock()
+
+	if consumer == nil {
+		return
+	}
+
+	stats := consumer.Stats()
+	for origin, byType := range stats.ReceivedByOrigin {
+		for typ, n := range byType {
+			ch <- prometheus.MustNewConstMetric(e.envelopes, prometheus.CounterValue, float64(n), typ, origin)
+		}
+	}
+
+	for kind, n := range stats.AlertsByKind {
+		ch <- prometheus.MustNewConstMetric(e.alerts, prometheus.CounterValue, float64(n), kind.String())
+	}
+
+	ch <- prometheus.MustNewConstMetric(e.bytes, prometheus.CounterValue, float64(stats.Bytes))
+	ch <- prometheus.MustNewConstMetric(e.errors, prometheus.CounterValue, float64(stats.Errors))
+	ch <- prometheus.MustNewConstMetric(e.retries, prometheus.CounterValue, float64(stats.Retries))
+	ch <- prometheus.MustNewConstMetric(e.reconnects, prometheus.CounterValue, float64(stats.Reconnects))
+
+	if !stats.LastEventTimestamp.IsZero() {
+		ch <- prometheus.MustNewConstMetric(e.lag, prometheus.GaugeValue, stats.Lag.Seconds())
+		ch <- prometheus.MustNewConstMetric(e.lastTimestamp, prometheus.GaugeValue,
+			float64(stats.LastEventTimestamp.UnixNano())/1e9)
+	}
+}
+
+// Handler returns http.Handler which serves metrics in the registry
+// (on any path).
+func (e *Exporter) Handler() http.Handler {
+	return e.handler
+}
+
+// ServeHTTP serves metrics on Config.Path.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != e.path {
+		http.NotFound(w, r)
+		return
+	}
+
+	e.handler.ServeHTTP(w, r)
+}
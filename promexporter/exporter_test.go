@@ -0,0 +1,269 @@
+package promexporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/rakutentech/go-nozzle"
+)
+
+type replayRawConsumer struct {
+	Events []*events.Envelope
+}
+
+func (c *replayRawConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
+	eventCh, errCh := make(chan *events.Envelope), make(chan error)
+	go func() {
+		defer close(eventCh)
+		defer close(errCh)
+		for _, event := range c.Events {
+			eventCh <- event
+		}
+	}()
+	return eventCh, errCh
+}
+
+func (c *replayRawConsumer) Close() error {
+	return nil
+}
+
+func scrape(t *testing.T, handler http.Handler, path string) (int, string) {
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return res.StatusCode, string(body)
+}
+
+func TestExporter(t *testing.T) {
+	exporter := New(&Config{})
+
+	config := &nozzle.Config{
+		RawConsumer: &replayRawConsumer{
+			Events: []*events.Envelope{
+				{
+					Origin:    proto.String("fake-origin"),
+					EventType: events.Envelope_LogMessage.Enum(),
+					Timestamp: proto.Int64(time.Now().UnixNano()),
+				},
+				{
+					Origin:    proto.String("doppler"),
+					EventType: events.Envelope_CounterEvent.Enum(),
+					Timestamp: proto.Int64(time.Now().UnixNano()),
+					CounterEvent: &events.CounterEvent{
+						Name:  proto.String("TruncatingBuffer.DroppedMessages"),
+						Delta: proto.Uint64(10),
+						Total: proto.Uint64(10),
+					},
+				},
+			},
+		},
+	}
+	config.Hooks = exporter.Hooks(config.Hooks)
+
+	consumer, err := nozzle.NewConsumer(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	exporter.Watch(consumer)
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	go func() {
+		for range consumer.Detects() {
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		<-consumer.Events()
+	}
+
+	// Alert is counted after it's received.
+	for i := 0; consumer.Stats().Alerts == 0; i++ {
+		if i > 100 {
+			t.Fatalf("expects alert to be counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Token fetch and refresh are observed by hooks.
+	config.Hooks.OnTokenFetch(nozzle.TokenFetchEvent{
+		Duration: 100 * time.Millisecond,
+		Err:      fmt.Errorf("failed"),
+	})
+	config.Hooks.OnTokenRefresh(nozzle.TokenRefreshEvent{
+		Duration: 100 * time.Millisecond,
+		Err:      fmt.Errorf("failed"),
+	})
+
+	status, body := scrape(t, exporter, "/metrics")
+	if status != http.StatusOK {
+		t.Fatalf("expects %d to be eq %d", status, http.StatusOK)
+	}
+
+	expects := []string{
+		`nozzle_envelopes_total{origin="fake-origin",type="LogMessage"} 1`,
+		`nozzle_envelopes_total{origin="doppler",type="CounterEvent"} 1`,
+		`nozzle_slow_consumer_alerts_total{kind="Truncated"} 1`,
+		`nozzle_retries_total 0`,
+		`nozzle_reconnects_total 0`,
+		`nozzle_token_fetch_duration_seconds_count 1`,
+		`nozzle_token_fetch_failures_total 1`,
+		`nozzle_token_refreshes_total 1`,
+		`nozzle_lag_seconds`,
+	}
+
+	for _, expect := range expects {
+		if !strings.Contains(body, expect) {
+			t.Fatalf("expects %q to contain %q", body, expect)
+		}
+	}
+}
+
+func TestExporter_initialTokenFetch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	exporter := New(&Config{})
+
+	config := &nozzle.Config{
+		DopplerAddr:    "wss://doppler.example.com",
+		SubscriptionID: "go-nozzle",
+		UaaAddr:        ts.URL,
+		ClientID:       "nozzle-client",
+		ClientSecret:   "s3cret",
+	}
+	config.Hooks = exporter.Hooks(config.Hooks)
+
+	// The first fetch is failed, so the token is never refreshed.
+	if _, err := nozzle.NewConsumer(config); err == nil {
+		t.Fatalf("expects error to be occurred")
+	}
+
+	_, body := scrape(t, exporter, "/metrics")
+
+	expects := []string{
+		`nozzle_token_fetch_duration_seconds_count 1`,
+		`nozzle_token_fetch_failures_total 1`,
+		`nozzle_token_refreshes_total 0`,
+	}
+
+	for _, expect := range expects {
+		if !strings.Contains(body, expect) {
+			t.Fatalf("expects %q to contain %q", body, expect)
+		}
+	}
+}
+
+// customKindPolicy alerts every envelope. The envelope from "custom"
+// origin is alerted by the kind which is not defined by nozzle.
+type customKindPolicy struct{}
+
+func (customKindPolicy) CheckEnvelope(e *events.Envelope) error {
+	if e.GetOrigin() == "custom" {
+		return &nozzle.SlowConsumerAlert{Kind: nozzle.AlertKind(6), Message: "custom"}
+	}
+	return fmt.Errorf("other")
+}
+
+func (customKindPolicy) CheckError(err error) error {
+	return nil
+}
+
+func TestExporter_customAlertKind(t *testing.T) {
+	exporter := New(&Config{})
+
+	consumer, err := nozzle.NewConsumer(&nozzle.Config{
+		RawConsumer: &replayRawConsumer{
+			Events: []*events.Envelope{
+				{Origin: proto.String("fake-origin"), EventType: events.Envelope_LogMessage.Enum()},
+				{Origin: proto.String("custom"), EventType: events.Envelope_LogMessage.Enum()},
+			},
+		},
+		SlowDetector: nozzle.NewSlowDetector(nil, customKindPolicy{}),
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	exporter.Watch(consumer)
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	go func() {
+		for range consumer.Detects() {
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		<-consumer.Events()
+	}
+
+	for i := 0; consumer.Stats().Alerts < 2; i++ {
+		if i > 100 {
+			t.Fatalf("expects alerts to be counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Unknown kind is counted as Other, not as another sample with
+	// the same label.
+	status, body := scrape(t, exporter, "/metrics")
+	if status != http.StatusOK {
+		t.Fatalf("expects %d to be eq %d: %s", status, http.StatusOK, body)
+	}
+
+	expect := `nozzle_slow_consumer_alerts_total{kind="Other"} 2`
+	if !strings.Contains(body, expect) {
+		t.Fatalf("expects %q to contain %q", body, expect)
+	}
+}
+
+func TestExporter_path(t *testing.T) {
+	exporter := New(&Config{
+		Namespace: "my_nozzle",
+		Path:      "/custom",
+	})
+
+	if status, _ := scrape(t, exporter, "/metrics"); status != http.StatusNotFound {
+		t.Fatalf("expects %d to be eq %d", status, http.StatusNotFound)
+	}
+
+	status, body := scrape(t, exporter, "/custom")
+	if status != http.StatusOK {
+		t.Fatalf("expects %d to be eq %d", status, http.StatusOK)
+	}
+
+	// Consumer is not watched yet.
+	if strings.Contains(body, "my_nozzle_envelopes_total") {
+		t.Fatalf("expects %q not to contain envelopes", body)
+	}
+
+	if !strings.Contains(body, "my_nozzle_token_refreshes_total 0") {
+		t.Fatalf("expects %q to contain token refreshes", body)
+	}
+}
@@ -0,0 +1,39 @@
+package nozzle
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Dialer dials the network connection. *net.Dialer and SOCKS5 dialer
+// of golang.org/x/net/proxy implement it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// proxyFunc returns Config.Proxy. If it's nil, the proxy is read from
+// environment variables (HTTPS_PROXY, HTTP_PROXY and NO_PROXY).
+func proxyFunc(config *Config) func(*http.Request) (*url.URL, error) {
+	if config.Proxy != nil {
+		return config.Proxy
+	}
+	return http.ProxyFromEnvironment
+}
+
+// newHTTPTransport returns http.Transport with the TLS config, the proxy
+// and the dialer of the config.
+func newHTTPTransport(config *Config, tlsConfig *tls.Config) *http.Transport {
+	transport := &http.Transport{
+		Proxy:           proxyFunc(config),
+		TLSClientConfig: tlsConfig,
+	}
+
+	if config.Dialer != nil {
+		transport.DialContext = config.Dialer.DialContext
+	}
+
+	return transport
+}
@@ -0,0 +1,213 @@
+package nozzle
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countDialer counts dialed connections.
+type countDialer struct {
+	count int32
+}
+
+func (d *countDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	atomic.AddInt32(&d.count, 1)
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func TestRawConsumer_proxy(t *testing.T) {
+	t.Parallel()
+
+	inputCh := make(chan []byte)
+	authToken := "n98ubNOIUog9gOPUbvqiur"
+
+	ts := NewDopplerServer(t, inputCh, authToken)
+	defer ts.Close()
+
+	hostCh := make(chan string, 1)
+	proxy := NewConnectProxyServer(t, hostCh)
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	consumer, err := newRawDefaultConsumer(&Config{
+		DopplerAddr:    strings.Replace(ts.URL, "http:", "ws:", 1),
+		Token:          authToken,
+		SubscriptionID: "test-go-nozzle-A",
+		Proxy:          http.ProxyURL(proxyURL),
+		Logger:         defaultLogger,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	eventCh, _ := consumer.Consume()
+	defer consumer.Close()
+
+	eventBytes, err := NewEvent("Hello via proxy", time.Now().UnixNano())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	inputCh <- eventBytes
+
+	select {
+	case event := <-eventCh:
+		if got := string(event.GetLogMessage().Message); got != "Hello via proxy" {
+			t.Fatalf("expects %q to be eq %q", got, "Hello via proxy")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expects event to be received")
+	}
+
+	select {
+	case host := <-hostCh:
+		if expect := strings.TrimPrefix(ts.URL, "http://"); host != expect {
+			t.Fatalf("expects %q to be eq %q", host, expect)
+		}
+	default:
+		t.Fatalf("expects connection to be tunneled by proxy")
+	}
+}
+
+func TestTokenFetcher_proxy(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"np9q34bcanBIUI98b9q3vnaoirv","token_type":"bearer"}`))
+	}))
+	defer ts.Close()
+
+	hostCh := make(chan string, 1)
+	proxy := NewConnectProxyServer(t, hostCh)
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cases := []*Config{
+		{
+			UaaAddr:      ts.URL,
+			ClientID:     "nozzle-client",
+			ClientSecret: "s3cret",
+		},
+		{
+			UaaAddr:  ts.URL,
+			Username: "admin",
+			Password: "passw0rd",
+		},
+	}
+
+	for i, config := range cases {
+		dialer := &countDialer{}
+		config.Proxy = http.ProxyURL(proxyURL)
+		config.Dialer = dialer
+		config.Insecure = true
+		config.Logger = defaultLogger
+
+		fetcher, err := newTokenFetcher(config)
+		if err != nil {
+			t.Fatalf("#%d err: %s", i, err)
+		}
+
+		token, err := fetcher.Fetch()
+		if err != nil {
+			t.Fatalf("#%d err: %s", i, err)
+		}
+
+		if token != "bearer np9q34bcanBIUI98b9q3vnaoirv" {
+			t.Fatalf("#%d unexpected token: %q", i, token)
+		}
+
+		select {
+		case host := <-hostCh:
+			if expect := strings.TrimPrefix(ts.URL, "https://"); host != expect {
+				t.Fatalf("#%d expects %q to be eq %q", i, host, expect)
+			}
+		default:
+			t.Fatalf("#%d expects connection to be tunneled by proxy", i)
+		}
+
+		// The dialer dials the proxy.
+		if n := atomic.LoadInt32(&dialer.count); n == 0 {
+			t.Fatalf("#%d expects dialer to be used", i)
+		}
+	}
+}
+
+func TestTokenFetcher_proxyFromEnvironment(t *testing.T) {
+	// The proxy of environment variables is cached by net/http in the
+	// process, so the token is fetched in the child process.
+	if os.Getenv("GO_NOZZLE_TEST_PROXY_CHILD") != "" {
+		fetcher, err := newTokenFetcher(&Config{
+			UaaAddr:    "https://uaa.nozzle.test",
+			Username:   "admin",
+			Password:   "passw0rd",
+			UaaTimeout: 3 * time.Second,
+			Logger:     defaultLogger,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		// It fails because the proxy can't connect to the host.
+		fetcher.Fetch()
+		return
+	}
+
+	hostCh := make(chan string, 1)
+	proxy := NewConnectProxyServer(t, hostCh)
+	defer proxy.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestTokenFetcher_proxyFromEnvironment$")
+	cmd.Env = append(os.Environ(),
+		"GO_NOZZLE_TEST_PROXY_CHILD=1",
+		"HTTPS_PROXY="+proxy.URL,
+		"https_proxy="+proxy.URL,
+		"NO_PROXY=",
+		"no_proxy=",
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("err: %s\n%s", err, out)
+	}
+
+	select {
+	case host := <-hostCh:
+		if host != "uaa.nozzle.test:443" {
+			t.Fatalf("expects %q to be eq %q", host, "uaa.nozzle.test:443")
+		}
+	default:
+		t.Fatalf("expects UAA request to be tunneled by proxy of HTTPS_PROXY")
+	}
+}
+
+func TestProxyFunc(t *testing.T) {
+	if proxyFunc(&Config{}) == nil {
+		t.Fatalf("expects proxy from environment to be used")
+	}
+
+	proxyURL, _ := url.Parse("http://proxy.example.com:8080")
+	config := &Config{Proxy: http.ProxyURL(proxyURL)}
+
+	req, _ := http.NewRequest("GET", "https://doppler.example.com", nil)
+	got, err := proxyFunc(config)(req)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if got.String() != proxyURL.String() {
+		t.Fatalf("expects %q to be eq %q", got, proxyURL)
+	}
+}
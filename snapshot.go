@@ -0,0 +1,264 @@
+package nozzle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// UnauthorizedError is returned by SnapshotClient when traffic controller
+// rejects the token (401) even after refreshing it.
+type UnauthorizedError struct {
+	AppGUID string
+
+	// Message is the response body from traffic controller.
+	Message string
+}
+
+// Error returns the description of the error.
+func (e *UnauthorizedError) Error() string {
+	return fmt.Sprintf("unauthorized to access app %s: %s", e.AppGUID, e.Message)
+}
+
+// NotFoundError is returned by SnapshotClient when the application
+// is not found (404).
+type NotFoundError struct {
+	AppGUID string
+
+	// Message is the response body from traffic controller.
+	Message string
+}
+
+// Error returns the description of the error.
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("app %s is not found: %s", e.AppGUID, e.Message)
+}
+
+// SnapshotClient gets one-shot snapshots of an application (recent logs
+// and container metrics) from traffic controller. It uses the same
+// Config as Consumer (DopplerAddr, Token or UAA, and TLS) and
+// refreshes the token when it's expired.
+//
+// It's safe to use it from multiple goroutines.
+type SnapshotClient struct {
+	addr         string
+	client       *http.Client
+	tokenFetcher TokenSource
+	logger       *log.Logger
+
+	// mu protects token which is updated when it's refreshed.
+	mu    sync.Mutex
+	token string
+}
+
+// NewSnapshotClient constructs SnapshotClient. Like NewConsumer, it
+// fetches the token from UAA if Config.Token is empty.
+func NewSnapshotClient(config *Config) (*SnapshotClient, error) {
+	// Copy not to modify the caller's config.
+	cfg := *config
+	if cfg.Logger == nil {
+		cfg.Logger = defaultLogger
+	}
+
+	if cfg.DopplerAddr == "" {
+		return nil, fmt.Errorf("DopplerAddr must not be empty")
+	}
+
+	tlsConfig, err := newTLSConfig(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setupToken(&cfg, cfg.Hooks); err != nil {
+		return nil, err
+	}
+
+	// Traffic controller serves snapshots on the same address over HTTP.
+	addr := strings.TrimRight(cfg.DopplerAddr, "/")
+	addr = strings.Replace(addr, "wss://", "https://", 1)
+	addr = strings.Replace(addr, "ws://", "http://", 1)
+
+	return &SnapshotClient{
+		addr: addr,
+		client: &http.Client{
+			Transport: newHTTPTransport(&cfg, tlsConfig),
+		},
+		tokenFetcher: cfg.tokenFetcher,
+		logger:       cfg.Logger,
+		token:        cfg.Token,
+	}, nil
+}
+
+// RecentLogs returns recent logs of the application sorted by timestamp.
+func (c *SnapshotClient) RecentLogs(appGUID string) ([]*events.LogMessage, error) {
+	return c.RecentLogsContext(context.Background(), appGUID)
+}
+
+// RecentLogsContext is same as RecentLogs but it's canceled when the
+// given context is done.
+func (c *SnapshotClient) RecentLogsContext(ctx context.Context, appGUID string) ([]*events.LogMessage, error) {
+	envelopes, err := c.get(ctx, appGUID, "recentlogs")
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*events.LogMessage, 0, len(envelopes))
+	for _, e := range envelopes {
+		if m := e.GetLogMessage(); m != nil {
+			messages = append(messages, m)
+		}
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].GetTimestamp() < messages[j].GetTimestamp()
+	})
+
+	return messages, nil
+}
+
+// ContainerEnvelopes returns the latest container metrics envelopes of
+// the application (one per instance) sorted by timestamp.
+func (c *SnapshotClient) ContainerEnvelopes(appGUID string) ([]*events.Envelope, error) {
+	return c.ContainerEnvelopesContext(context.Background(), appGUID)
+}
+
+// ContainerEnvelopesContext is same as ContainerEnvelopes but it's
+// canceled when the given context is done.
+func (c *SnapshotClient) ContainerEnvelopesContext(ctx context.Context, appGUID string) ([]*events.Envelope, error) {
+	envelopes, err := c.get(ctx, appGUID, "containermetrics")
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(envelopes, func(i, j int) bool {
+		return envelopes[i].GetTimestamp() < envelopes[j].GetTimestamp()
+	})
+
+	return envelopes, nil
+}
+
+func (c *SnapshotClient) currentToken() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return currentToken(c.tokenFetcher, c.token)
+}
+
+// get requests the endpoint of the application and returns envelopes
+// in the response. If the token is rejected, it's refreshed and
+// requested again.
+func (c *SnapshotClient) get(ctx context.Context, appGUID, endpoint string) ([]*events.Envelope, error) {
+	if appGUID == "" {
+		return nil, fmt.Errorf("app GUID must not be empty")
+	}
+
+	url := fmt.Sprintf("%s/apps/%s/%s", c.addr, appGUID, endpoint)
+	c.logger.Printf("[DEBUG] Getting %s of app %s", endpoint, appGUID)
+
+	token := c.currentToken()
+	res, err := c.do(ctx, url, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized && c.tokenFetcher != nil {
+		res.Body.Close()
+
+		refresher := &contextTokenRefresher{ctx: ctx, fetcher: c.tokenFetcher, token: token}
+		token, err := refresher.RefreshAuthToken()
+		if err != nil {
+			return nil, fmt.Errorf("failed to refresh token: %s", err)
+		}
+
+		c.mu.Lock()
+		c.token = token
+		c.mu.Unlock()
+
+		if res, err = c.do(ctx, url, token); err != nil {
+			return nil, err
+		}
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, &UnauthorizedError{AppGUID: appGUID, Message: readMessage(res.Body)}
+	case http.StatusNotFound:
+		return nil, &NotFoundError{AppGUID: appGUID, Message: readMessage(res.Body)}
+	default:
+		return nil, fmt.Errorf("unexpected response from traffic controller (%d): %s",
+			res.StatusCode, readMessage(res.Body))
+	}
+
+	return readMultipartEnvelopes(res)
+}
+
+func (c *SnapshotClient) do(ctx context.Context, url, token string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", token)
+
+	return c.client.Do(req.WithContext(ctx))
+}
+
+// readMultipartEnvelopes reads envelopes from multipart/x-protobuf
+// response. Each part is a protobuf encoded envelope.
+func readMultipartEnvelopes(res *http.Response) ([]*events.Envelope, error) {
+	_, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid content type: %s", err)
+	}
+
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, fmt.Errorf("invalid content type: no boundary")
+	}
+
+	var envelopes []*events.Envelope
+	reader := multipart.NewReader(res.Body, boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(b) == 0 {
+			continue
+		}
+
+		var e events.Envelope
+		if err := proto.Unmarshal(b, &e); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal envelope: %s", err)
+		}
+		envelopes = append(envelopes, &e)
+	}
+
+	return envelopes, nil
+}
+
+// readMessage reads the response body for error messages.
+func readMessage(r io.Reader) string {
+	b, _ := ioutil.ReadAll(io.LimitReader(r, 1024))
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,166 @@
+package nozzle
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func testLogEnvelope(appGUID, message string, timestamp int64) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String("fake-origin"),
+		EventType: events.Envelope_LogMessage.Enum(),
+		Timestamp: proto.Int64(timestamp),
+		LogMessage: &events.LogMessage{
+			Message:     []byte(message),
+			MessageType: events.LogMessage_OUT.Enum(),
+			AppId:       proto.String(appGUID),
+			Timestamp:   proto.Int64(timestamp),
+		},
+	}
+}
+
+func testContainerEnvelope(appGUID string, index int32, timestamp int64) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String("rep"),
+		EventType: events.Envelope_ContainerMetric.Enum(),
+		Timestamp: proto.Int64(timestamp),
+		ContainerMetric: &events.ContainerMetric{
+			ApplicationId: proto.String(appGUID),
+			InstanceIndex: proto.Int32(index),
+			CpuPercentage: proto.Float64(1.5),
+			MemoryBytes:   proto.Uint64(1024),
+			DiskBytes:     proto.Uint64(2048),
+		},
+	}
+}
+
+func TestSnapshotClient(t *testing.T) {
+	t.Parallel()
+
+	authToken := "n98ubNOIUog9gOPUbvqiur"
+	ts := NewTrafficControllerServer(t, authToken,
+		map[string][]*events.Envelope{
+			"app-1": {
+				testLogEnvelope("app-1", "second", 2),
+				testLogEnvelope("app-1", "first", 1),
+				testLogEnvelope("app-1", "third", 3),
+			},
+		},
+		map[string][]*events.Envelope{
+			"app-1": {
+				testContainerEnvelope("app-1", 1, 20),
+				testContainerEnvelope("app-1", 0, 10),
+			},
+		},
+	)
+	defer ts.Close()
+
+	// Token is expired and refreshed by TokenSource.
+	client, err := NewSnapshotClient(&Config{
+		DopplerAddr: strings.Replace(ts.URL, "http:", "ws:", 1),
+		Token:       "expired-token",
+		TokenSource: &testTokenFetcher{Token: authToken},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	logs, err := client.RecentLogs("app-1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var messages []string
+	for _, l := range logs {
+		messages = append(messages, string(l.GetMessage()))
+	}
+
+	if got := strings.Join(messages, ","); got != "first,second,third" {
+		t.Fatalf("expects %q to be eq %q", got, "first,second,third")
+	}
+
+	envelopes, err := client.ContainerEnvelopes("app-1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(envelopes) != 2 {
+		t.Fatalf("expects %d to be eq 2", len(envelopes))
+	}
+
+	for i, e := range envelopes {
+		if got := e.GetContainerMetric().GetInstanceIndex(); got != int32(i) {
+			t.Fatalf("#%d expects %d to be eq %d", i, got, i)
+		}
+	}
+}
+
+func TestSnapshotClient_errors(t *testing.T) {
+	t.Parallel()
+
+	authToken := "n98ubNOIUog9gOPUbvqiur"
+	ts := NewTrafficControllerServer(t, authToken, nil, nil)
+	defer ts.Close()
+
+	cases := []struct {
+		token   string
+		fetcher TokenSource
+		check   func(error) bool
+	}{
+		{
+			token: "invalid-token",
+			check: func(err error) bool {
+				_, ok := err.(*UnauthorizedError)
+				return ok
+			},
+		},
+		{
+			// Refreshed token is also rejected.
+			token:   "invalid-token",
+			fetcher: &testTokenFetcher{Token: "invalid-token-2"},
+			check: func(err error) bool {
+				_, ok := err.(*UnauthorizedError)
+				return ok
+			},
+		},
+		{
+			token: authToken,
+			check: func(err error) bool {
+				e, ok := err.(*NotFoundError)
+				return ok && e.AppGUID == "unknown-app"
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		client, err := NewSnapshotClient(&Config{
+			DopplerAddr: strings.Replace(ts.URL, "http:", "ws:", 1),
+			Token:       tc.token,
+			TokenSource: tc.fetcher,
+		})
+		if err != nil {
+			t.Fatalf("#%d err: %s", i, err)
+		}
+
+		_, err = client.RecentLogs("unknown-app")
+		if !tc.check(err) {
+			t.Fatalf("#%d unexpected error: %#v", i, err)
+		}
+	}
+}
+
+func TestNewSnapshotClient_validate(t *testing.T) {
+	cases := []*Config{
+		{Token: "token"},
+		{DopplerAddr: "wss://doppler.example.com"},
+	}
+
+	for i, config := range cases {
+		if _, err := NewSnapshotClient(config); err == nil {
+			t.Fatalf("#%d expects error to be occurred", i)
+		}
+	}
+}
@@ -0,0 +1,687 @@
+package nozzle
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	golangProto "github.com/golang/protobuf/proto"
+)
+
+// SpoolSyncPolicy defines when spool segment files are synced (fsync)
+// to disk (Config.SpoolSync).
+type SpoolSyncPolicy int
+
+const (
+	// SpoolSyncNone leaves syncing to OS. Spooled envelopes survive
+	// a process crash but may be lost on OS crash.
+	SpoolSyncNone SpoolSyncPolicy = iota
+
+	// SpoolSyncSegment syncs a segment file when it's rotated and
+	// when consumer is closed.
+	SpoolSyncSegment
+
+	// SpoolSyncAlways syncs after every envelope is written. It's the
+	// safest but the slowest.
+	SpoolSyncAlways
+)
+
+// String returns the name of the policy.
+func (p SpoolSyncPolicy) String() string {
+	switch p {
+	case SpoolSyncNone:
+		return "None"
+	case SpoolSyncSegment:
+		return "Segment"
+	case SpoolSyncAlways:
+		return "Always"
+	default:
+		return fmt.Sprintf("SpoolSyncPolicy(%d)", int(p))
+	}
+}
+
+const (
+	// defaultSpoolMaxBytes is the default value of Config.SpoolMaxBytes.
+	defaultSpoolMaxBytes = 1 << 30
+
+	// defaultSpoolSegmentSize is the default value of Config.SpoolSegmentSize.
+	defaultSpoolSegmentSize = 64 << 20
+
+	// spoolCursorInterval is the interval to save the read position.
+	// Envelopes delivered in the interval may be delivered again after
+	// the process crashes.
+	spoolCursorInterval = 1 * time.Second
+
+	spoolSegmentExt  = ".seg"
+	spoolCursorFile  = "cursor"
+	spoolSegmentPerm = 0600
+)
+
+var (
+	// errSpoolFull is returned when the total size of segments
+	// reaches Config.SpoolMaxBytes.
+	errSpoolFull = errors.New("spool is full")
+
+	// errSpoolClosed is returned when the spool is closed.
+	errSpoolClosed = errors.New("spool is closed")
+)
+
+// spoolSegment is a segment file of spool. Its name is the hex of seq.
+type spoolSegment struct {
+	seq  uint64
+	size int64
+}
+
+// spool is a write-ahead log of envelopes. Envelopes are written to
+// segment files as length-prefixed (uvarint) protobuf and read in the
+// order. Segment files which are read are removed and the read position
+// is saved to cursor file, so unread envelopes are replayed after restart.
+//
+// It's safe to write and read from different goroutines.
+type spool struct {
+	dir         string
+	maxBytes    int64
+	segmentSize int64
+	syncPolicy  SpoolSyncPolicy
+	stats       *stats
+	logger      *log.Logger
+
+	mu sync.Mutex
+
+	// segments are ordered by seq. The first one is read and
+	// the last one is written.
+	segments []*spoolSegment
+	size     int64
+
+	w *os.File
+	r *os.File
+
+	// roff is the read position in the first segment and pending is
+	// the size of the record returned by next and not committed yet.
+	roff    int64
+	pending int64
+
+	lastCursor time.Time
+	finished   bool
+	closed     bool
+
+	// notifyCh is notified when a record is written or writing
+	// is finished.
+	notifyCh chan struct{}
+}
+
+// openSpool opens the spool in Config.SpoolDir. Segments left by the
+// previous process are read first. New envelopes are always written to
+// a new segment not to append after a broken record.
+func openSpool(config *Config, stats *stats, logger *log.Logger) (*spool, error) {
+	s := &spool{
+		dir:         config.SpoolDir,
+		maxBytes:    config.SpoolMaxBytes,
+		segmentSize: config.SpoolSegmentSize,
+		syncPolicy:  config.SpoolSync,
+		stats:       stats,
+		logger:      logger,
+		notifyCh:    make(chan struct{}, 1),
+	}
+
+	if s.maxBytes <= 0 {
+		s.maxBytes = defaultSpoolMaxBytes
+	}
+
+	if s.segmentSize <= 0 {
+		s.segmentSize = defaultSpoolSegmentSize
+	}
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	segments, err := readSpoolSegments(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cursorSeq, cursorOff, err := readSpoolCursor(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove segments which were read but not removed.
+	for len(segments) > 0 && segments[0].seq < cursorSeq {
+		if err := os.Remove(s.segmentPath(segments[0].seq)); err != nil {
+			return nil, err
+		}
+		segments = segments[1:]
+	}
+
+	if len(segments) > 0 && segments[0].seq == cursorSeq && cursorOff <= segments[0].size {
+		s.roff = cursorOff
+	}
+
+	seq := cursorSeq + 1
+	for _, seg := range segments {
+		s.size += seg.size
+		seq = seg.seq + 1
+	}
+
+	if n := s.size - s.roff; n > 0 {
+		logger.Printf("[INFO] Replaying %d bytes in %d segments from spool %s",
+			n, len(segments), s.dir)
+	}
+
+	s.segments = segments
+	if err := s.createSegmentLocked(seq); err != nil {
+		return nil, err
+	}
+
+	r, err := os.Open(s.segmentPath(s.segments[0].seq))
+	if err != nil {
+		s.w.Close()
+		return nil, err
+	}
+	s.r = r
+
+	s.stats.setSpoolBytes(s.size - s.roff)
+	return s, nil
+}
+
+// readSpoolSegments returns segments in the directory ordered by seq.
+func readSpoolSegments(dir string) ([]*spoolSegment, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []*spoolSegment
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, &spoolSegment{seq: seq, size: info.Size()})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].seq < segments[j].seq
+	})
+
+	return segments, nil
+}
+
+// readSpoolCursor returns the saved read position. It returns zero
+// if it's not saved yet.
+func readSpoolCursor(dir string) (uint64, int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, spoolCursorFile))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var seq uint64
+	var off int64
+	if _, err := fmt.Sscanf(string(b), "%d %d", &seq, &off); err != nil {
+		return 0, 0, fmt.Errorf("invalid spool cursor: %s", err)
+	}
+
+	return seq, off, nil
+}
+
+func (s *spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016x%s", seq, spoolSegmentExt))
+}
+
+func (s *spool) createSegmentLocked(seq uint64) error {
+	w, err := os.OpenFile(s.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, spoolSegmentPerm)
+	if err != nil {
+		return err
+	}
+
+	s.w = w
+	s.segments = append(s.segments, &spoolSegment{seq: seq})
+	return nil
+}
+
+// rotateLocked closes the current segment and creates the next one.
+func (s *spool) rotateLocked() error {
+	if s.syncPolicy != SpoolSyncNone {
+		if err := s.w.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.w.Close(); err != nil {
+		return err
+	}
+
+	return s.createSegmentLocked(s.segments[len(s.segments)-1].seq + 1)
+}
+
+// write appends the record. It returns errSpoolFull if the spool
+// reaches the size limit.
+func (s *spool) write(b []byte) error {
+	rec := make([]byte, binary.MaxVarintLen64+len(b))
+	n := binary.PutUvarint(rec, uint64(len(b)))
+	n += copy(rec[n:], b)
+	rec = rec[:n]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.finished {
+		return errSpoolClosed
+	}
+
+	if s.size+int64(len(rec)) > s.maxBytes {
+		return errSpoolFull
+	}
+
+	seg := s.segments[len(s.segments)-1]
+	if seg.size > 0 && seg.size+int64(len(rec)) > s.segmentSize {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+		seg = s.segments[len(s.segments)-1]
+	}
+
+	if _, err := s.w.Write(rec); err != nil {
+		// Remove the partial record not to break the segment.
+		s.w.Truncate(seg.size)
+		return err
+	}
+
+	if s.syncPolicy == SpoolSyncAlways {
+		if err := s.w.Sync(); err != nil {
+			return err
+		}
+	}
+
+	seg.size += int64(len(rec))
+	s.size += int64(len(rec))
+	s.stats.setSpoolBytes(s.size - s.roff)
+
+	select {
+	case s.notifyCh <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// finish tells that no more records are written. After that, next
+// returns io.EOF when all records are read.
+func (s *spool) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.finished = true
+	select {
+	case s.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next record. It blocks until a record is written.
+// The record is returned again until commit is called.
+func (s *spool) next(doneCh <-chan struct{}) ([]byte, error) {
+	for {
+		s.mu.Lock()
+		b, err := s.readLocked()
+		finished := s.finished
+		s.mu.Unlock()
+
+		if err != nil || b != nil {
+			return b, err
+		}
+
+		if finished {
+			return nil, io.EOF
+		}
+
+		select {
+		case <-s.notifyCh:
+		case <-doneCh:
+			return nil, errSpoolClosed
+		}
+	}
+}
+
+// readLocked returns the record at the read position. It returns nil if
+// no record is written yet. Segments which are read are removed.
+func (s *spool) readLocked() ([]byte, error) {
+	for {
+		if s.closed {
+			return nil, errSpoolClosed
+		}
+
+		seg := s.segments[0]
+		if s.roff < seg.size {
+			b, n, err := s.readRecordLocked(seg)
+			if err == nil {
+				s.pending = n
+				return b, nil
+			}
+
+			// The record may be broken when the process crashed while
+			// writing it. Skip the rest of the segment.
+			s.logger.Printf("[ERROR] Skipping broken spool segment %s: %s",
+				s.segmentPath(seg.seq), err)
+			s.roff = seg.size
+			continue
+		}
+
+		// The last segment is being written.
+		if len(s.segments) == 1 {
+			return nil, nil
+		}
+
+		if err := s.removeSegmentLocked(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readRecordLocked reads the record at the read position and returns
+// it with its size including the length prefix.
+func (s *spool) readRecordLocked(seg *spoolSegment) ([]byte, int64, error) {
+	rest := seg.size - s.roff
+
+	prefix := make([]byte, binary.MaxVarintLen64)
+	if rest < int64(len(prefix)) {
+		prefix = prefix[:rest]
+	}
+
+	if _, err := s.r.ReadAt(prefix, s.roff); err != nil {
+		return nil, 0, err
+	}
+
+	l, n := binary.Uvarint(prefix)
+	if n <= 0 {
+		return nil, 0, fmt.Errorf("invalid length prefix at %d", s.roff)
+	}
+
+	// Compare in unsigned space not to overflow by the corrupted prefix.
+	if l > uint64(rest-int64(n)) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	b := make([]byte, l)
+	if _, err := s.r.ReadAt(b, s.roff+int64(n)); err != nil {
+		return nil, 0, err
+	}
+
+	return b, int64(n) + int64(l), nil
+}
+
+// removeSegmentLocked removes the first segment which is read and
+// starts reading the next one.
+func (s *spool) removeSegmentLocked() error {
+	seg := s.segments[0]
+
+	s.r.Close()
+	if err := os.Remove(s.segmentPath(seg.seq)); err != nil {
+		return err
+	}
+
+	s.segments = s.segments[1:]
+	s.size -= seg.size
+	s.roff = 0
+	s.stats.setSpoolBytes(s.size - s.roff)
+
+	r, err := os.Open(s.segmentPath(s.segments[0].seq))
+	if err != nil {
+		return err
+	}
+	s.r = r
+
+	return s.saveCursorLocked()
+}
+
+// commit advances the read position after the record returned by
+// next is delivered.
+func (s *spool) commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.roff += s.pending
+	s.pending = 0
+	s.stats.setSpoolBytes(s.size - s.roff)
+
+	if time.Since(s.lastCursor) < spoolCursorInterval {
+		return
+	}
+
+	if err := s.saveCursorLocked(); err != nil {
+		s.logger.Printf("[ERROR] Failed to save spool cursor: %s", err)
+	}
+}
+
+// saveCursorLocked saves the read position to the cursor file.
+func (s *spool) saveCursorLocked() error {
+	s.lastCursor = time.Now()
+
+	path := filepath.Join(s.dir, spoolCursorFile)
+	cursor := fmt.Sprintf("%d %d\n", s.segments[0].seq, s.roff)
+	if err := ioutil.WriteFile(path+".tmp", []byte(cursor), spoolSegmentPerm); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// close saves the read position and closes segment files.
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	select {
+	case s.notifyCh <- struct{}{}:
+	default:
+	}
+
+	var errs []string
+	if err := s.saveCursorLocked(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if s.syncPolicy != SpoolSyncNone {
+		if err := s.w.Sync(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if err := s.w.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if err := s.r.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close spool: %s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// writeSpool writes the marshaled envelope to the spool. Envelopes which
+// can not be written are dropped and counted as local drops.
+func (c *consumer) writeSpool(b []byte, full *bool) {
+	err := c.spool.write(b)
+	if err == nil {
+		*full = false
+		return
+	}
+
+	c.stats.addLocalDropped(1)
+	if err != errSpoolFull {
+		c.logger.Printf("[ERROR] Failed to write envelope to spool: %s", err)
+		return
+	}
+
+	// Log only when it becomes full not to flood.
+	if !*full {
+		c.logger.Printf("[ERROR] Spool is full (%d bytes), dropping envelopes", c.spool.maxBytes)
+	}
+	*full = true
+}
+
+// finishSpool closes the spool after the writer goroutine is finished.
+func (c *consumer) finishSpool(writeDoneCh <-chan struct{}) {
+	<-writeDoneCh
+	if err := c.spool.close(); err != nil {
+		c.logger.Printf("[ERROR] %s", err)
+	}
+	close(c.spoolDoneCh)
+}
+
+// spoolEvents passes events from upstream to downstream through the spool.
+// Upstream is not blocked by downstream (as long as the spool has space).
+func (c *consumer) spoolEvents(eventCh <-chan *events.Envelope) <-chan *events.Envelope {
+	eventCh_ := make(chan *events.Envelope)
+	writeDoneCh := make(chan struct{})
+	c.spoolDoneCh = make(chan struct{})
+
+	go func() {
+		defer close(writeDoneCh)
+		defer c.spool.finish()
+
+		var full bool
+		for {
+			select {
+			case event, ok := <-eventCh:
+				if !ok {
+					return
+				}
+
+				b, err := proto.Marshal(event)
+				if err != nil {
+					c.logger.Printf("[ERROR] Failed to marshal envelope: %s", err)
+					continue
+				}
+				c.writeSpool(b, &full)
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(eventCh_)
+		defer c.finishSpool(writeDoneCh)
+
+		for {
+			b, err := c.spool.next(c.doneCh)
+			if err != nil {
+				if err != io.EOF && err != errSpoolClosed {
+					c.logger.Printf("[ERROR] Failed to read envelope from spool: %s", err)
+				}
+				return
+			}
+
+			var event events.Envelope
+			if err := proto.Unmarshal(b, &event); err != nil {
+				c.logger.Printf("[ERROR] Failed to unmarshal envelope from spool: %s", err)
+				c.spool.commit()
+				continue
+			}
+
+			select {
+			case eventCh_ <- &event:
+				c.spool.commit()
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return eventCh_
+}
+
+// spoolEventsV2 is same as spoolEvents but for V2 envelopes.
+func (c *consumer) spoolEventsV2(eventCh <-chan *loggregator_v2.Envelope) <-chan *loggregator_v2.Envelope {
+	eventCh_ := make(chan *loggregator_v2.Envelope)
+	writeDoneCh := make(chan struct{})
+	c.spoolDoneCh = make(chan struct{})
+
+	go func() {
+		defer close(writeDoneCh)
+		defer c.spool.finish()
+
+		var full bool
+		for {
+			select {
+			case event, ok := <-eventCh:
+				if !ok {
+					return
+				}
+
+				b, err := golangProto.Marshal(event)
+				if err != nil {
+					c.logger.Printf("[ERROR] Failed to marshal envelope: %s", err)
+					continue
+				}
+				c.writeSpool(b, &full)
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(eventCh_)
+		defer c.finishSpool(writeDoneCh)
+
+		for {
+			b, err := c.spool.next(c.doneCh)
+			if err != nil {
+				if err != io.EOF && err != errSpoolClosed {
+					c.logger.Printf("[ERROR] Failed to read envelope from spool: %s", err)
+				}
+				return
+			}
+
+			event := &loggregator_v2.Envelope{}
+			if err := golangProto.Unmarshal(b, event); err != nil {
+				c.logger.Printf("[ERROR] Failed to unmarshal envelope from spool: %s", err)
+				c.spool.commit()
+				continue
+			}
+
+			select {
+			case eventCh_ <- event:
+				c.spool.commit()
+			case <-c.doneCh:
+				return
+			}
+		}
+	}()
+
+	return eventCh_
+}
@@ -0,0 +1,273 @@
+package nozzle
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func testSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "nozzle-spool")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return dir
+}
+
+func testOpenSpool(t *testing.T, config *Config) *spool {
+	s, err := openSpool(config, &stats{}, log.New(ioutil.Discard, "", log.LstdFlags))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return s
+}
+
+func TestSpool_replay(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	// Each record is 8 bytes (1 byte prefix), so segments are rotated
+	// every 2 records.
+	config := &Config{
+		SpoolDir:         dir,
+		SpoolSegmentSize: 16,
+		SpoolSync:        SpoolSyncSegment,
+	}
+
+	s := testOpenSpool(t, config)
+	for i := 0; i < 5; i++ {
+		if err := s.write([]byte(fmt.Sprintf("record%d", i))); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Read 3 records and commit them.
+	for i := 0; i < 3; i++ {
+		b, err := s.next(nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if expect := fmt.Sprintf("record%d", i); string(b) != expect {
+			t.Fatalf("expects %q to be eq %q", b, expect)
+		}
+		s.commit()
+	}
+
+	// Read but not commit.
+	if _, err := s.next(nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := s.close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The first segment is removed after it's read.
+	segments, err := readSpoolSegments(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("expects %d to be eq 2", len(segments))
+	}
+
+	// Reopen and replay records which are not committed.
+	s = testOpenSpool(t, config)
+	defer s.close()
+
+	if err := s.write([]byte("record5")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	s.finish()
+
+	for i := 3; i < 6; i++ {
+		b, err := s.next(nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if expect := fmt.Sprintf("record%d", i); string(b) != expect {
+			t.Fatalf("expects %q to be eq %q", b, expect)
+		}
+		s.commit()
+	}
+
+	if _, err := s.next(nil); err != io.EOF {
+		t.Fatalf("expects %v to be eq %v", err, io.EOF)
+	}
+}
+
+func TestSpool_full(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s := testOpenSpool(t, &Config{
+		SpoolDir:      dir,
+		SpoolMaxBytes: 16,
+	})
+	defer s.close()
+
+	for i := 0; i < 2; i++ {
+		if err := s.write([]byte("record0")); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	if err := s.write([]byte("record2")); err != errSpoolFull {
+		t.Fatalf("expects %v to be eq %v", err, errSpoolFull)
+	}
+
+	if got := s.stats.snapshot().SpoolBytes; got != 16 {
+		t.Fatalf("expects %d to be eq 16", got)
+	}
+}
+
+func TestSpool_brokenSegment(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	config := &Config{SpoolDir: dir}
+	s := testOpenSpool(t, config)
+	if err := s.write([]byte("record0")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	seq := s.segments[0].seq
+	s.close()
+
+	// Append the partial record as if the process crashed while writing.
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%016x.seg", seq)), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	f.Write([]byte{7, 'r', 'e'})
+	f.Close()
+
+	s = testOpenSpool(t, config)
+	defer s.close()
+
+	if err := s.write([]byte("record1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		b, err := s.next(nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if expect := fmt.Sprintf("record%d", i); string(b) != expect {
+			t.Fatalf("expects %q to be eq %q", b, expect)
+		}
+		s.commit()
+	}
+}
+
+func TestSpool_oversizedPrefix(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	config := &Config{SpoolDir: dir}
+	s := testOpenSpool(t, config)
+	if err := s.write([]byte("record0")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	seq := s.segments[0].seq
+	s.close()
+
+	// Append the corrupted length prefix which is negative as int64.
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%016x.seg", seq)), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	prefix := make([]byte, binary.MaxVarintLen64)
+	f.Write(prefix[:binary.PutUvarint(prefix, 1<<63+5)])
+	f.Write([]byte("broken"))
+	f.Close()
+
+	s = testOpenSpool(t, config)
+	defer s.close()
+
+	if err := s.write([]byte("record1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		b, err := s.next(nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if expect := fmt.Sprintf("record%d", i); string(b) != expect {
+			t.Fatalf("expects %q to be eq %q", b, expect)
+		}
+		s.commit()
+	}
+}
+
+func TestConsumer_spool(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	// Envelopes left by the previous process.
+	s := testOpenSpool(t, &Config{SpoolDir: dir})
+	for i := int64(0); i < 2; i++ {
+		b, err := proto.Marshal(&events.Envelope{
+			Origin:    proto.String("fake-origin"),
+			EventType: events.Envelope_LogMessage.Enum(),
+			Timestamp: proto.Int64(i),
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if err := s.write(b); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	s.close()
+
+	rc := &replayRawConsumer{
+		Events: []*events.Envelope{
+			{
+				Origin:    proto.String("fake-origin"),
+				EventType: events.Envelope_LogMessage.Enum(),
+				Timestamp: proto.Int64(2),
+			},
+		},
+	}
+
+	consumer, err := NewConsumer(&Config{
+		RawConsumer: rc,
+		SpoolDir:    dir,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	var timestamps []int64
+	for event := range consumer.Events() {
+		timestamps = append(timestamps, event.GetTimestamp())
+	}
+
+	if fmt.Sprint(timestamps) != "[0 1 2]" {
+		t.Fatalf("expects %v to be eq [0 1 2]", timestamps)
+	}
+
+	if got := consumer.Stats().SpoolBytes; got != 0 {
+		t.Fatalf("expects %d to be eq 0", got)
+	}
+}
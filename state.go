@@ -0,0 +1,196 @@
+package nozzle
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// State is the state of Consumer.
+//
+//	New -> Connecting -> Streaming <-> Reconnecting
+//	                         |              |
+//	                         +-> Draining <-+
+//	                                |
+//	                              Closed
+//
+// Close can be called in any state except Closed (then it's moved to
+// Draining and Closed). Close before Start moves New to Closed directly.
+type State int
+
+const (
+	// StateNew is the state before Start is called.
+	StateNew State = iota
+
+	// StateConnecting is the state while connecting to firehose
+	// after Start is called.
+	StateConnecting
+
+	// StateStreaming is the state while receiving events.
+	StateStreaming
+
+	// StateReconnecting is the state while retrying or reconnecting
+	// after the connection is lost.
+	StateReconnecting
+
+	// StateDraining is the state while closing or after the upstream
+	// is finished (e.g., it gave up reconnecting). Remaining events
+	// can be still received.
+	StateDraining
+
+	// StateClosed is the state after Close is finished.
+	StateClosed
+)
+
+// String returns the name of the state.
+func (s State) String() string {
+	switch s {
+	case StateNew:
+		return "New"
+	case StateConnecting:
+		return "Connecting"
+	case StateStreaming:
+		return "Streaming"
+	case StateReconnecting:
+		return "Reconnecting"
+	case StateDraining:
+		return "Draining"
+	case StateClosed:
+		return "Closed"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// StateChange is notified via Consumer.StateChanges() when the state
+// of Consumer is changed.
+type StateChange struct {
+	From State
+	To   State
+	Time time.Time
+}
+
+// StateError is returned when the operation is not allowed in the
+// current state (e.g., Start is called twice).
+type StateError struct {
+	// Op is the operation (e.g., "Start").
+	Op string
+
+	// From is the current state and To is the state which the
+	// operation tried to move to.
+	From State
+	To   State
+}
+
+// Error returns the description of the error.
+func (e *StateError) Error() string {
+	return fmt.Sprintf("%s is not allowed in %s state (transition to %s)", e.Op, e.From, e.To)
+}
+
+// stateChangeBufferSize is the buffer size of StateChanges channel.
+const stateChangeBufferSize = 32
+
+// transitions defines the states which can be moved to from the state.
+var transitions = map[State][]State{
+	StateNew:          {StateConnecting, StateClosed},
+	StateConnecting:   {StateStreaming, StateReconnecting, StateDraining},
+	StateStreaming:    {StateReconnecting, StateDraining},
+	StateReconnecting: {StateStreaming, StateDraining},
+	StateDraining:     {StateClosed},
+	StateClosed:       {},
+}
+
+// canTransition returns true if it can be moved from the state to the state.
+func canTransition(from, to State) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// stateMachine holds the state of consumer. The zero value is
+// ready to use and its state is StateNew.
+type stateMachine struct {
+	mu       sync.Mutex
+	state    State
+	changeCh chan StateChange
+}
+
+// current returns the current state.
+func (m *stateMachine) current() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// changes returns the channel which is notified state changes.
+// It's closed after moving to StateClosed.
+func (m *stateMachine) changes() <-chan StateChange {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.changeChLocked()
+}
+
+func (m *stateMachine) changeChLocked() chan StateChange {
+	if m.changeCh == nil {
+		m.changeCh = make(chan StateChange, stateChangeBufferSize)
+		if m.state == StateClosed {
+			close(m.changeCh)
+		}
+	}
+	return m.changeCh
+}
+
+// transition moves the state to the given state. It returns
+// *StateError if it's not allowed.
+func (m *stateMachine) transition(op string, to State) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !canTransition(m.state, to) {
+		return &StateError{Op: op, From: m.state, To: to}
+	}
+
+	m.setLocked(to)
+	return nil
+}
+
+// transitionIf moves the state to the given state only when the current
+// state is one of from. It returns true if it's moved. It's used for
+// transitions caused by connection (not by user operation).
+func (m *stateMachine) transitionIf(to State, from ...State) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range from {
+		if m.state == s && canTransition(s, to) {
+			m.setLocked(to)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *stateMachine) setLocked(to State) {
+	change := StateChange{
+		From: m.state,
+		To:   to,
+		Time: time.Now(),
+	}
+	changeCh := m.changeChLocked()
+	m.state = to
+
+	// Changes are dropped when nobody receives them not to block
+	// consuming events.
+	select {
+	case changeCh <- change:
+	default:
+	}
+
+	if to == StateClosed {
+		close(changeCh)
+	}
+}
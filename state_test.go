@@ -0,0 +1,149 @@
+package nozzle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestState_String(t *testing.T) {
+	tests := []struct {
+		in     State
+		expect string
+	}{
+		{StateNew, "New"},
+		{StateConnecting, "Connecting"},
+		{StateStreaming, "Streaming"},
+		{StateReconnecting, "Reconnecting"},
+		{StateDraining, "Draining"},
+		{StateClosed, "Closed"},
+		{State(100), "State(100)"},
+	}
+
+	for i, tt := range tests {
+		if got := tt.in.String(); got != tt.expect {
+			t.Fatalf("#%d expects %q to be eq %q", i, got, tt.expect)
+		}
+	}
+}
+
+func TestStateMachine_transition(t *testing.T) {
+	var m stateMachine
+	if got := m.current(); got != StateNew {
+		t.Fatalf("expects %s to be eq %s", got, StateNew)
+	}
+
+	if err := m.transition("Start", StateConnecting); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err := m.transition("Start", StateConnecting)
+	stateErr, ok := err.(*StateError)
+	if !ok {
+		t.Fatalf("expects %#v to be *StateError", err)
+	}
+
+	if stateErr.From != StateConnecting || stateErr.To != StateConnecting {
+		t.Fatalf("expects %#v to be from Connecting to Connecting", stateErr)
+	}
+
+	if m.transitionIf(StateStreaming, StateReconnecting) {
+		t.Fatalf("expects not to move from %s", m.current())
+	}
+
+	if !m.transitionIf(StateStreaming, StateConnecting, StateReconnecting) {
+		t.Fatalf("expects to move from %s", m.current())
+	}
+
+	if err := m.transition("Close", StateClosed); err == nil {
+		t.Fatalf("expects Streaming not to move to Closed directly")
+	}
+}
+
+func TestConsumer_closeBeforeStart(t *testing.T) {
+	consumer := &consumer{
+		rawConsumer: &testRawConsumer{},
+		logger:      defaultLogger,
+	}
+
+	if err := consumer.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if got := consumer.State(); got != StateClosed {
+		t.Fatalf("expects %s to be eq %s", got, StateClosed)
+	}
+
+	err := consumer.Start()
+	if _, ok := err.(*StateError); !ok {
+		t.Fatalf("expects %#v to be *StateError", err)
+	}
+}
+
+func TestConsumer_startTwice(t *testing.T) {
+	consumer := &consumer{
+		rawConsumer: &testRawConsumer{},
+		logger:      defaultLogger,
+	}
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	err := consumer.Start()
+	if _, ok := err.(*StateError); !ok {
+		t.Fatalf("expects %#v to be *StateError", err)
+	}
+}
+
+func TestConsumer_stateChanges(t *testing.T) {
+	consumer := &consumer{
+		rawConsumer: &replayRawConsumer{
+			Events: []*events.Envelope{
+				{
+					Origin:    proto.String("fake-origin"),
+					EventType: events.Envelope_LogMessage.Enum(),
+				},
+			},
+		},
+		logger: defaultLogger,
+	}
+
+	changes := consumer.StateChanges()
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	<-consumer.Events()
+
+	// Wait until upstream is finished.
+	for i := 0; consumer.State() != StateDraining; i++ {
+		if i > 100 {
+			t.Fatalf("expects %s to be eq %s", consumer.State(), StateDraining)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := consumer.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var got []State
+	for change := range changes {
+		got = append(got, change.To)
+	}
+
+	expect := []State{StateConnecting, StateStreaming, StateDraining, StateClosed}
+	if len(got) != len(expect) {
+		t.Fatalf("expects %v to be eq %v", got, expect)
+	}
+
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Fatalf("expects %v to be eq %v", got, expect)
+		}
+	}
+}
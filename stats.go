@@ -0,0 +1,469 @@
+package nozzle
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	golangProto "github.com/golang/protobuf/proto"
+)
+
+// Stats is a snapshot of the statistics of Consumer.
+//
+// Envelopes, bytes, errors and alerts are counted by the default
+// SlowDetector (including one constructed by NewSlowDetector). If you
+// use your own SlowDetector, they are not counted.
+type Stats struct {
+	// Received is the number of envelopes received from upstream.
+	Received uint64
+
+	// ReceivedByOrigin is the number of envelopes per origin and
+	// event type (origin -> event type -> count). The key of event
+	// type is same as ReceivedByType.
+	ReceivedByOrigin map[string]map[string]uint64
+
+	// ReceivedByType is the number of envelopes per event type. The key
+	// is the name of events.Envelope_EventType (e.g., "LogMessage") for V1
+	// envelopes and "Log", "Counter", "Gauge", "Timer" or "Event" for
+	// V2 envelopes (Config.EnvelopeV2).
+	ReceivedByType map[string]uint64
+
+	// Filtered is the number of envelopes dropped by Config.Filter
+	// per filter name (see FilterAll). Dropped envelopes are still
+	// counted in Received.
+	Filtered map[string]uint64
+
+	// Bytes is the total size of received envelopes (protobuf encoded).
+	Bytes uint64
+
+	// Errors is the number of errors from upstream.
+	Errors uint64
+
+	// LocalDropped is the number of envelopes dropped by nozzle itself
+	// because its buffer is full (Config.BufferSize).
+	LocalDropped uint64
+
+	// SpoolBytes is the size of envelopes in the spool which are not
+	// delivered yet (Config.SpoolDir).
+	SpoolBytes uint64
+
+	// Alerts is the number of notified slow consumer alerts.
+	Alerts uint64
+
+	// AlertsByKind is the number of notified slow consumer alerts
+	// per kind. Kinds which are not defined by this package are
+	// counted as AlertOther.
+	AlertsByKind map[AlertKind]uint64
+
+	// LastAlert is the time when the last slow consumer alert is notified.
+	LastAlert time.Time
+
+	// Retries is the number of retries by noaa or RLP gateway client
+	// within one connection.
+	Retries uint64
+
+	// Reconnects is the number of reconnect attempts by supervised mode
+	// (Config.Reconnect).
+	Reconnects uint64
+
+	// TokenRefreshes is the number of token refreshes (including failures).
+	TokenRefreshes uint64
+
+	// TokenExpiry is when the current token is expired (exp claim of
+	// JWT). The token is refreshed in background before it (see
+	// Config.TokenRefreshSkew). It's zero if it's unknown.
+	TokenExpiry time.Time
+
+	// Endpoints is the health of each endpoint (doppler or RLP gateway)
+	// by its address. It's useful with multiple doppler endpoints
+	// (Config.DopplerAddrs).
+	Endpoints map[string]EndpointHealth
+
+	// LastEventTimestamp is the timestamp of the last received envelope.
+	LastEventTimestamp time.Time
+
+	// LastReceived is the time when the last envelope is received.
+	LastReceived time.Time
+
+	// Lag is how much the consumer lags behind the envelope timestamp.
+	// It's the difference between LastReceived and LastEventTimestamp.
+	Lag time.Duration
+}
+
+// EndpointHealth is the health of an endpoint. It's tracked by
+// connect, retry and disconnect events (see Hooks).
+type EndpointHealth struct {
+	// Healthy is true if the endpoint is connected and it's not
+	// failed after that.
+	Healthy bool
+
+	// Connects is the number of established connections.
+	Connects uint64
+
+	// Failures is the number of failures (failed to connect, lost
+	// connection or gave up retrying).
+	Failures uint64
+
+	// LastConnected is the time when it's connected last.
+	LastConnected time.Time
+
+	// LastFailure is the time when it's failed last.
+	LastFailure time.Time
+
+	// LastError is the error of the last failure.
+	LastError error
+}
+
+// v2EventTypes is the names of V2 envelope types. They are counted
+// after V1 event types in stats.byType.
+var v2EventTypes = []string{"Log", "Counter", "Gauge", "Timer", "Event"}
+
+// numV1EventTypes is the number of slots for V1 event types
+// (events.Envelope_EventType is 1 to 9).
+const numV1EventTypes = 10
+
+// numAlertKinds is the number of slots for AlertKind. Unknown kinds
+// (e.g., by custom DetectPolicy) are counted as AlertOther.
+const numAlertKinds = int(AlertLocalDropped) + 1
+
+// originKey is the key of the counter per origin and event type.
+type originKey struct {
+	origin string
+	typ    int
+}
+
+// stats holds counters updated by atomic operations. Methods
+// can be called with nil receiver (then nothing is counted).
+type stats struct {
+	// 64-bit fields must be first for atomic operations on 32-bit platforms.
+	received       uint64
+	bytes          uint64
+	errors         uint64
+	localDropped   uint64
+	spoolBytes     uint64
+	alerts         uint64
+	retries        uint64
+	reconnects     uint64
+	tokenRefreshes uint64
+
+	// lastEventTimestamp, lastReceived, lastAlert and tokenExpiry are
+	// unix time in nanoseconds.
+	lastEventTimestamp int64
+	lastReceived       int64
+	lastAlert          int64
+	tokenExpiry        int64
+
+	byType [numV1EventTypes + 5]uint64
+	byKind [numAlertKinds]uint64
+
+	// mu protects byOrigin, filtered and endpoints maps. Counters in
+	// byOrigin and filtered are updated by atomic operations.
+	mu        sync.RWMutex
+	byOrigin  map[originKey]*uint64
+	filtered  map[string]*uint64
+	endpoints map[string]*EndpointHealth
+}
+
+// addEnvelope counts V1 envelope.
+func (s *stats) addEnvelope(e *events.Envelope) {
+	if s == nil {
+		return
+	}
+
+	i := int(e.GetEventType())
+	if i < 0 || i >= numV1EventTypes {
+		i = 0
+	}
+
+	s.add(i, e.GetOrigin(), proto.Size(e), e.GetTimestamp())
+}
+
+// addEnvelopeV2 counts V2 envelope.
+func (s *stats) addEnvelopeV2(e *loggregator_v2.Envelope) {
+	if s == nil {
+		return
+	}
+
+	var i int
+	switch e.GetMessage().(type) {
+	case *loggregator_v2.Envelope_Log:
+		i = numV1EventTypes
+	case *loggregator_v2.Envelope_Counter:
+		i = numV1EventTypes + 1
+	case *loggregator_v2.Envelope_Gauge:
+		i = numV1EventTypes + 2
+	case *loggregator_v2.Envelope_Timer:
+		i = numV1EventTypes + 3
+	case *loggregator_v2.Envelope_Event:
+		i = numV1EventTypes + 4
+	}
+
+	s.add(i, e.GetTags()["origin"], golangProto.Size(e), e.GetTimestamp())
+}
+
+func (s *stats) add(i int, origin string, size int, timestamp int64) {
+	atomic.AddUint64(&s.received, 1)
+	atomic.AddUint64(&s.byType[i], 1)
+	atomic.AddUint64(s.originCounter(originKey{origin: origin, typ: i}), 1)
+	atomic.AddUint64(&s.bytes, uint64(size))
+	atomic.StoreInt64(&s.lastEventTimestamp, timestamp)
+	atomic.StoreInt64(&s.lastReceived, time.Now().UnixNano())
+}
+
+// originCounter returns the counter for the key. It's created
+// if it doesn't exist.
+func (s *stats) originCounter(key originKey) *uint64 {
+	s.mu.RLock()
+	counter, ok := s.byOrigin[key]
+	s.mu.RUnlock()
+	if ok {
+		return counter
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if counter, ok := s.byOrigin[key]; ok {
+		return counter
+	}
+
+	if s.byOrigin == nil {
+		s.byOrigin = make(map[originKey]*uint64)
+	}
+	counter = new(uint64)
+	s.byOrigin[key] = counter
+	return counter
+}
+
+// addFiltered counts the envelope dropped by the filter.
+func (s *stats) addFiltered(name string) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(s.filterCounter(name), 1)
+}
+
+// filterCounter returns the counter for the filter. It's created
+// if it doesn't exist.
+func (s *stats) filterCounter(name string) *uint64 {
+	s.mu.RLock()
+	counter, ok := s.filtered[name]
+	s.mu.RUnlock()
+	if ok {
+		return counter
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if counter, ok := s.filtered[name]; ok {
+		return counter
+	}
+
+	if s.filtered == nil {
+		s.filtered = make(map[string]*uint64)
+	}
+	counter = new(uint64)
+	s.filtered[name] = counter
+	return counter
+}
+
+func (s *stats) addError() {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.errors, 1)
+}
+
+func (s *stats) addLocalDropped(n uint64) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.localDropped, n)
+}
+
+func (s *stats) setSpoolBytes(n int64) {
+	if s == nil {
+		return
+	}
+	atomic.StoreUint64(&s.spoolBytes, uint64(n))
+}
+
+func (s *stats) addAlert(kind AlertKind) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.alerts, 1)
+	atomic.StoreInt64(&s.lastAlert, time.Now().UnixNano())
+
+	if kind < 0 || int(kind) >= numAlertKinds {
+		kind = AlertOther
+	}
+	atomic.AddUint64(&s.byKind[kind], 1)
+}
+
+func (s *stats) addRetry() {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.retries, 1)
+}
+
+func (s *stats) addReconnect() {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.reconnects, 1)
+}
+
+func (s *stats) addTokenRefresh() {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.tokenRefreshes, 1)
+}
+
+func (s *stats) setTokenExpiry(t time.Time) {
+	if s == nil || t.IsZero() {
+		return
+	}
+	atomic.StoreInt64(&s.tokenExpiry, t.UnixNano())
+}
+
+// endpointConnected records that the endpoint is connected.
+func (s *stats) endpointConnected(addr string, t time.Time) {
+	s.updateEndpoint(addr, func(h *EndpointHealth) {
+		h.Healthy = true
+		h.Connects++
+		h.LastConnected = t
+	})
+}
+
+// endpointFailed records that the endpoint is failed.
+func (s *stats) endpointFailed(addr string, t time.Time, err error) {
+	s.updateEndpoint(addr, func(h *EndpointHealth) {
+		h.Healthy = false
+		h.Failures++
+		h.LastFailure = t
+		h.LastError = err
+	})
+}
+
+// endpointClosed records that the connection to the endpoint is closed
+// by Close.
+func (s *stats) endpointClosed(addr string) {
+	s.updateEndpoint(addr, func(h *EndpointHealth) {
+		h.Healthy = false
+	})
+}
+
+func (s *stats) updateEndpoint(addr string, fn func(*EndpointHealth)) {
+	if s == nil || addr == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.endpoints == nil {
+		s.endpoints = make(map[string]*EndpointHealth)
+	}
+
+	h, ok := s.endpoints[addr]
+	if !ok {
+		h = &EndpointHealth{}
+		s.endpoints[addr] = h
+	}
+	fn(h)
+}
+
+// snapshot returns the current values as Stats.
+func (s *stats) snapshot() Stats {
+	st := Stats{
+		ReceivedByOrigin: make(map[string]map[string]uint64),
+		ReceivedByType:   make(map[string]uint64),
+		Filtered:         make(map[string]uint64),
+		AlertsByKind:     make(map[AlertKind]uint64),
+		Endpoints:        make(map[string]EndpointHealth),
+	}
+
+	if s == nil {
+		return st
+	}
+
+	st.Received = atomic.LoadUint64(&s.received)
+	st.Bytes = atomic.LoadUint64(&s.bytes)
+	st.Errors = atomic.LoadUint64(&s.errors)
+	st.LocalDropped = atomic.LoadUint64(&s.localDropped)
+	st.SpoolBytes = atomic.LoadUint64(&s.spoolBytes)
+	st.Alerts = atomic.LoadUint64(&s.alerts)
+	st.Retries = atomic.LoadUint64(&s.retries)
+	st.Reconnects = atomic.LoadUint64(&s.reconnects)
+	st.TokenRefreshes = atomic.LoadUint64(&s.tokenRefreshes)
+
+	if ts := atomic.LoadInt64(&s.lastEventTimestamp); ts != 0 {
+		st.LastEventTimestamp = time.Unix(0, ts)
+	}
+
+	if ts := atomic.LoadInt64(&s.lastReceived); ts != 0 {
+		st.LastReceived = time.Unix(0, ts)
+	}
+
+	if ts := atomic.LoadInt64(&s.lastAlert); ts != 0 {
+		st.LastAlert = time.Unix(0, ts)
+	}
+
+	if ts := atomic.LoadInt64(&s.tokenExpiry); ts != 0 {
+		st.TokenExpiry = time.Unix(0, ts)
+	}
+
+	if !st.LastEventTimestamp.IsZero() && !st.LastReceived.IsZero() {
+		st.Lag = st.LastReceived.Sub(st.LastEventTimestamp)
+	}
+
+	for i := range s.byType {
+		if n := atomic.LoadUint64(&s.byType[i]); n != 0 {
+			st.ReceivedByType[eventTypeName(i)] = n
+		}
+	}
+
+	for i := range s.byKind {
+		if n := atomic.LoadUint64(&s.byKind[i]); n != 0 {
+			st.AlertsByKind[AlertKind(i)] = n
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, counter := range s.byOrigin {
+		byType, ok := st.ReceivedByOrigin[key.origin]
+		if !ok {
+			byType = make(map[string]uint64)
+			st.ReceivedByOrigin[key.origin] = byType
+		}
+		byType[eventTypeName(key.typ)] = atomic.LoadUint64(counter)
+	}
+
+	for name, counter := range s.filtered {
+		st.Filtered[name] = atomic.LoadUint64(counter)
+	}
+
+	for addr, h := range s.endpoints {
+		st.Endpoints[addr] = *h
+	}
+
+	return st
+}
+
+// eventTypeName returns the name of event type of the slot.
+func eventTypeName(i int) string {
+	switch {
+	case i == 0:
+		return "Unknown"
+	case i < numV1EventTypes:
+		return events.Envelope_EventType(i).String()
+	default:
+		return v2EventTypes[i-numV1EventTypes]
+	}
+}
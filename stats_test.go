@@ -0,0 +1,200 @@
+package nozzle
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestStats_nil(t *testing.T) {
+	var s *stats
+	s.addEnvelope(&events.Envelope{})
+	s.addError()
+
+	st := s.snapshot()
+	if st.Received != 0 || st.ReceivedByType == nil {
+		t.Fatalf("expects %#v to be empty", st)
+	}
+}
+
+func TestStats_snapshot(t *testing.T) {
+	s := &stats{}
+
+	timestamp := time.Now().UnixNano()
+	s.addEnvelope(&events.Envelope{
+		Origin:    proto.String("fake-origin"),
+		EventType: events.Envelope_LogMessage.Enum(),
+		Timestamp: proto.Int64(timestamp),
+	})
+	s.addEnvelope(&events.Envelope{
+		Origin:    proto.String("fake-origin"),
+		EventType: events.Envelope_CounterEvent.Enum(),
+	})
+	s.addEnvelopeV2(&loggregator_v2.Envelope{
+		Timestamp: timestamp,
+		Message: &loggregator_v2.Envelope_Gauge{
+			Gauge: &loggregator_v2.Gauge{},
+		},
+	})
+	s.addError()
+	s.addAlert(AlertTruncated)
+	s.addRetry()
+	s.addReconnect()
+	s.addTokenRefresh()
+
+	st := s.snapshot()
+	if st.Received != 3 {
+		t.Fatalf("expects %d to be eq 3", st.Received)
+	}
+
+	expect := map[string]uint64{
+		"LogMessage":   1,
+		"CounterEvent": 1,
+		"Gauge":        1,
+	}
+	if len(st.ReceivedByType) != len(expect) {
+		t.Fatalf("expects %v to be eq %v", st.ReceivedByType, expect)
+	}
+	for k, v := range expect {
+		if st.ReceivedByType[k] != v {
+			t.Fatalf("expects %v to be eq %v", st.ReceivedByType, expect)
+		}
+	}
+
+	if st.Bytes == 0 {
+		t.Fatalf("expects bytes to be counted")
+	}
+
+	if st.Errors != 1 || st.Alerts != 1 || st.Retries != 1 || st.Reconnects != 1 || st.TokenRefreshes != 1 {
+		t.Fatalf("expects %#v to be counted once", st)
+	}
+
+	if st.AlertsByKind[AlertTruncated] != 1 {
+		t.Fatalf("expects %v to have 1 Truncated alert", st.AlertsByKind)
+	}
+
+	if got := st.ReceivedByOrigin["fake-origin"]["LogMessage"]; got != 1 {
+		t.Fatalf("expects %d to be eq 1", got)
+	}
+
+	if got := st.ReceivedByOrigin[""]["Gauge"]; got != 1 {
+		t.Fatalf("expects %d to be eq 1", got)
+	}
+
+	if st.LastEventTimestamp.UnixNano() != timestamp {
+		t.Fatalf("expects %s to be eq %s", st.LastEventTimestamp, time.Unix(0, timestamp))
+	}
+
+	if st.LastReceived.IsZero() {
+		t.Fatalf("expects LastReceived to be set")
+	}
+}
+
+func TestConsumer_stats(t *testing.T) {
+	rc := &replayRawConsumer{
+		Events: []*events.Envelope{
+			{
+				Origin:    proto.String("fake-origin"),
+				EventType: events.Envelope_LogMessage.Enum(),
+			},
+			{
+				Origin:    proto.String(TR_Origin),
+				EventType: events.Envelope_CounterEvent.Enum(),
+				CounterEvent: &events.CounterEvent{
+					Name:  proto.String(TR_EventName),
+					Delta: proto.Uint64(10),
+					Total: proto.Uint64(10),
+				},
+			},
+		},
+	}
+
+	consumer, err := NewConsumer(&Config{RawConsumer: rc})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-consumer.Detects()
+	}()
+
+	// Stats can be called while consuming.
+	go consumer.Stats()
+
+	for i := 0; i < 2; i++ {
+		<-consumer.Events()
+	}
+	wg.Wait()
+
+	st := consumer.Stats()
+	if st.Received != 2 {
+		t.Fatalf("expects %d to be eq 2", st.Received)
+	}
+
+	if got := fmt.Sprint(st.ReceivedByType); got != "map[CounterEvent:1 LogMessage:1]" {
+		t.Fatalf("expects %s to be eq %s", got, "map[CounterEvent:1 LogMessage:1]")
+	}
+
+	if st.Alerts != 1 {
+		t.Fatalf("expects %d to be eq 1", st.Alerts)
+	}
+}
+
+func TestConsumer_statsRetriesAndReconnects(t *testing.T) {
+	c := &consumer{stats: &stats{}}
+	hooks := c.observeHooks(Hooks{})
+
+	// Retries by noaa must not be counted as supervised reconnects.
+	hooks.OnRetry(RetryEvent{Attempt: 1, Err: fmt.Errorf("EOF")})
+	hooks.OnRetry(RetryEvent{Attempt: 2, Err: fmt.Errorf("EOF")})
+	hooks.OnReconnect(ReconnectEvent{Attempt: 1})
+
+	st := c.Stats()
+	if st.Retries != 2 {
+		t.Fatalf("expects %d to be eq 2", st.Retries)
+	}
+
+	if st.Reconnects != 1 {
+		t.Fatalf("expects %d to be eq 1", st.Reconnects)
+	}
+}
+
+func TestStats_endpoints(t *testing.T) {
+	s := &stats{}
+
+	now := time.Now()
+	s.endpointConnected("wss://a", now)
+	s.endpointFailed("wss://b", now, fmt.Errorf("connection refused"))
+	s.endpointConnected("wss://b", now.Add(time.Second))
+	s.endpointFailed("wss://a", now.Add(time.Second), fmt.Errorf("EOF"))
+	s.endpointClosed("wss://b")
+	s.endpointConnected("", now)
+
+	st := s.snapshot()
+	if len(st.Endpoints) != 2 {
+		t.Fatalf("expects %d to be eq 2", len(st.Endpoints))
+	}
+
+	a := st.Endpoints["wss://a"]
+	if a.Healthy || a.Connects != 1 || a.Failures != 1 || a.LastError.Error() != "EOF" {
+		t.Fatalf("unexpected health: %#v", a)
+	}
+
+	b := st.Endpoints["wss://b"]
+	if b.Healthy || b.Connects != 1 || b.Failures != 1 || !b.LastConnected.Equal(now.Add(time.Second)) {
+		t.Fatalf("unexpected health: %#v", b)
+	}
+}
@@ -0,0 +1,515 @@
+package nozzle
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	noaaConsumer "github.com/cloudfoundry/noaa/consumer"
+	noaaErrors "github.com/cloudfoundry/noaa/errors"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// rawStreamConsumer implements RawConsumer. It opens one noaa Stream per
+// application instead of firehose and multiplexes them into one channel.
+// Applications can be added and removed while consuming.
+//
+// It can be consumed again after Close (the app set is kept), so it's
+// reused by supervised mode.
+type rawStreamConsumer struct {
+	dopplerAddr    string
+	token          string
+	insecure       bool
+	tlsConfig      *tls.Config
+	proxy          func(*http.Request) (*url.URL, error)
+	debugPrinter   noaaConsumer.DebugPrinter
+	idleTimeout    time.Duration
+	retryCount     int
+	tokenRefresher TokenSource
+	hooks          *Hooks
+
+	// backoff is used for restarting the stream of an application
+	// which gave up. If nil (Config.Reconnect is not set), the
+	// application is removed instead.
+	backoff *backoff
+
+	logger *log.Logger
+
+	// mu protects appGUIDs and session.
+	mu       sync.Mutex
+	appGUIDs map[string]struct{}
+	session  *streamSession
+}
+
+// streamConsumer is the consumer in stream mode. It implements
+// AppStreamer.
+type streamConsumer struct {
+	*consumer
+	streamer *rawStreamConsumer
+}
+
+// AddApp starts streaming the application.
+func (c *streamConsumer) AddApp(appGUID string) error {
+	return c.streamer.AddApp(appGUID)
+}
+
+// RemoveApp stops streaming the application.
+func (c *streamConsumer) RemoveApp(appGUID string) error {
+	return c.streamer.RemoveApp(appGUID)
+}
+
+// Apps returns the GUIDs of streamed applications.
+func (c *streamConsumer) Apps() []string {
+	return c.streamer.Apps()
+}
+
+// streamSession is the state between ConsumeContext and Close.
+type streamSession struct {
+	ctx     context.Context
+	eventCh chan *events.Envelope
+	errCh   chan error
+	doneCh  chan struct{}
+	wg      sync.WaitGroup
+
+	// closeOnce ensures the session is closed only once.
+	closeOnce sync.Once
+
+	streams map[string]*appStream
+}
+
+// appStream is the noaa Stream of an application.
+type appStream struct {
+	appGUID      string
+	noaaConsumer *noaaConsumer.Consumer
+
+	// doneCh is closed when the application is removed.
+	doneCh chan struct{}
+
+	// disconnectOnce ensures OnDisconnect hook is called only once.
+	disconnectOnce sync.Once
+
+	// connected is set to 1 when noaa connects to doppler.
+	connected int32
+
+	// finished is set to 1 when noaa gave up (it's already closed).
+	finished int32
+
+	// attempt and lostAt are the state of restarting the application
+	// carried over from the stream which gave up.
+	attempt int
+	lostAt  time.Time
+}
+
+func newRawStreamConsumer(config *Config) (*rawStreamConsumer, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := config.Hooks
+	c := &rawStreamConsumer{
+		dopplerAddr:    config.DopplerAddr,
+		token:          config.Token,
+		insecure:       config.Insecure,
+		tlsConfig:      tlsConfig,
+		proxy:          proxyFunc(config),
+		debugPrinter:   config.DebugPrinter,
+		logger:         config.Logger,
+		idleTimeout:    config.IdleTimeout,
+		retryCount:     config.RetryCount,
+		tokenRefresher: config.tokenFetcher,
+		hooks:          &hooks,
+		appGUIDs:       make(map[string]struct{}),
+	}
+
+	if config.Reconnect {
+		c.backoff = newBackoff(config)
+	}
+
+	for _, guid := range config.AppGUIDs {
+		if guid == "" {
+			return nil, fmt.Errorf("AppGUIDs must not contain empty GUID")
+		}
+		c.appGUIDs[guid] = struct{}{}
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *rawStreamConsumer) validate() error {
+	if c.dopplerAddr == "" {
+		return fmt.Errorf("DopplerAddr must not be empty")
+	}
+
+	if c.token == "" {
+		return fmt.Errorf("Token must not be empty")
+	}
+
+	return nil
+}
+
+func (c *rawStreamConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
+	return c.ConsumeContext(context.Background())
+}
+
+// ConsumeContext starts streaming all applications. The returned
+// channels are closed by Close (not when there is no application,
+// because applications can be added later, nor when the stream of an
+// application gives up, because other applications keep streaming).
+func (c *rawStreamConsumer) ConsumeContext(ctx context.Context) (<-chan *events.Envelope, <-chan error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.logger.Printf("[INFO] Start consuming streams of %d apps from Doppler (%s)",
+		len(c.appGUIDs), c.dopplerAddr)
+
+	s := &streamSession{
+		ctx:     ctx,
+		eventCh: make(chan *events.Envelope),
+		errCh:   make(chan error),
+		doneCh:  make(chan struct{}),
+		streams: make(map[string]*appStream),
+	}
+	c.session = s
+
+	for guid := range c.appGUIDs {
+		c.startLocked(s, guid, nil)
+	}
+
+	return s.eventCh, s.errCh
+}
+
+// Apps returns the GUIDs of streamed applications.
+func (c *rawStreamConsumer) Apps() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	guids := make([]string, 0, len(c.appGUIDs))
+	for guid := range c.appGUIDs {
+		guids = append(guids, guid)
+	}
+	sort.Strings(guids)
+	return guids
+}
+
+// AddApp starts streaming the application. If it's not consuming yet,
+// it's streamed when ConsumeContext is called.
+func (c *rawStreamConsumer) AddApp(appGUID string) error {
+	if appGUID == "" {
+		return fmt.Errorf("app GUID must not be empty")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.appGUIDs[appGUID]; ok {
+		return fmt.Errorf("app %s is already streamed", appGUID)
+	}
+	c.appGUIDs[appGUID] = struct{}{}
+
+	// If the session is finished, it's streamed when reconnecting.
+	if c.session != nil && c.session.streams != nil {
+		c.startLocked(c.session, appGUID, nil)
+	}
+
+	return nil
+}
+
+// RemoveApp stops streaming the application.
+func (c *rawStreamConsumer) RemoveApp(appGUID string) error {
+	c.mu.Lock()
+
+	if _, ok := c.appGUIDs[appGUID]; !ok {
+		c.mu.Unlock()
+		return fmt.Errorf("app %s is not streamed", appGUID)
+	}
+	delete(c.appGUIDs, appGUID)
+
+	var stream *appStream
+	if c.session != nil && c.session.streams != nil {
+		stream = c.session.streams[appGUID]
+		delete(c.session.streams, appGUID)
+	}
+	c.mu.Unlock()
+
+	// Hooks are called without lock (they may call AddApp).
+	if stream != nil {
+		c.stop(stream)
+	}
+
+	return nil
+}
+
+// startLocked opens noaa Stream of the application and forwards
+// events and errors from it. prev is the stream of the application
+// which gave up (nil if it's started first).
+func (c *rawStreamConsumer) startLocked(s *streamSession, appGUID string, prev *appStream) {
+	c.logger.Printf("[DEBUG] Start streaming app %s", appGUID)
+
+	tlsConfig := c.tlsConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{
+			InsecureSkipVerify: c.insecure,
+		}
+	}
+	nc := noaaConsumer.New(c.dopplerAddr, tlsConfig, c.proxy)
+
+	if c.debugPrinter != nil {
+		nc.SetDebugPrinter(c.debugPrinter)
+	}
+
+	nc.SetIdleTimeout(c.idleTimeout)
+
+	// The token may be refreshed in background after construction.
+	token := currentToken(c.tokenRefresher, c.token)
+
+	nc.SetMaxRetryCount(c.retryCount)
+	if c.tokenRefresher != nil {
+		nc.RefreshTokenFrom(&contextTokenRefresher{
+			ctx:     s.ctx,
+			fetcher: c.tokenRefresher,
+			token:   token,
+		})
+	}
+
+	stream := &appStream{
+		appGUID:      appGUID,
+		noaaConsumer: nc,
+		doneCh:       make(chan struct{}),
+	}
+
+	if prev != nil {
+		stream.attempt, stream.lostAt = prev.attempt, prev.lostAt
+	}
+
+	// failures is the number of failures in a row. It's reset
+	// when noaa (re)connects to doppler.
+	var failures int32
+	nc.SetOnConnectCallback(func() {
+		c.logger.Printf("[DEBUG] Connected to Doppler (%s) for app %s", c.dopplerAddr, appGUID)
+		atomic.StoreInt32(&failures, 0)
+		atomic.StoreInt32(&stream.connected, 1)
+		c.hooks.onConnect(ConnectEvent{
+			Addr:    c.dopplerAddr,
+			AppGUID: appGUID,
+			Time:    time.Now(),
+		})
+	})
+
+	eventCh, errCh := nc.Stream(appGUID, token)
+	s.streams[appGUID] = stream
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		c.forward(s, stream, eventCh, errCh, &failures)
+	}()
+}
+
+// stop closes noaa Stream of the application.
+func (c *rawStreamConsumer) stop(stream *appStream) {
+	c.logger.Printf("[DEBUG] Stop streaming app %s", stream.appGUID)
+
+	close(stream.doneCh)
+	if atomic.LoadInt32(&stream.finished) == 1 {
+		// noaa is already closed by giving up.
+		c.disconnected(stream, nil)
+		return
+	}
+
+	if err := stream.noaaConsumer.Close(); err != nil {
+		c.logger.Printf("[ERROR] Failed to close stream of app %s: %s", stream.appGUID, err)
+	}
+	c.disconnected(stream, nil)
+}
+
+// forward forwards events and errors from the stream until the stream is
+// finished, the application is removed or the session is closed.
+func (c *rawStreamConsumer) forward(s *streamSession, stream *appStream, eventCh <-chan *events.Envelope, errCh <-chan error, failures *int32) {
+	var lastErr error
+	for eventCh != nil || errCh != nil {
+		select {
+		case event, ok := <-eventCh:
+			if !ok {
+				eventCh = nil
+				continue
+			}
+
+			select {
+			case s.eventCh <- event:
+			case <-stream.doneCh:
+				return
+			case <-s.doneCh:
+				return
+			}
+		case err, ok := <-errCh:
+			if !ok {
+				errCh = nil
+				continue
+			}
+
+			c.logger.Printf("[ERROR] Stream of app %s: %s", stream.appGUID, err)
+			lastErr = err
+			if _, ok := err.(noaaErrors.NonRetryableError); ok || err == noaaConsumer.ErrMaxRetriesReached {
+				c.disconnected(stream, err)
+			} else {
+				c.hooks.onRetry(RetryEvent{
+					Addr:    c.dopplerAddr,
+					AppGUID: stream.appGUID,
+					Time:    time.Now(),
+					Attempt: int(atomic.AddInt32(failures, 1)),
+					Err:     err,
+				})
+			}
+
+			select {
+			case s.errCh <- err:
+			case <-stream.doneCh:
+				return
+			case <-s.doneCh:
+				return
+			}
+		case <-stream.doneCh:
+			return
+		case <-s.doneCh:
+			return
+		}
+	}
+
+	// The stream gave up. Only this application is restarted (or
+	// removed), other applications keep streaming.
+	atomic.StoreInt32(&stream.finished, 1)
+	c.restart(s, stream, lastErr)
+}
+
+// restart restarts the stream of the application which gave up after
+// backoff. If it's not enabled (Config.Reconnect) or it passed
+// ReconnectMaxElapsedTime, the application is removed and the error is
+// sent to the error channel.
+func (c *rawStreamConsumer) restart(s *streamSession, stream *appStream, lastErr error) {
+	c.disconnected(stream, lastErr)
+
+	// Attempts are counted until noaa connects again.
+	attempt, lostAt := 1, time.Now()
+	if stream.attempt > 0 && atomic.LoadInt32(&stream.connected) == 0 {
+		attempt, lostAt = stream.attempt+1, stream.lostAt
+	}
+
+	var delay time.Duration
+	elapsed := time.Since(lostAt)
+	giveUp := c.backoff == nil
+	if !giveUp {
+		delay = c.backoff.delay(attempt)
+		giveUp = c.backoff.maxElapsedTime > 0 && elapsed+delay > c.backoff.maxElapsedTime
+	}
+
+	if giveUp {
+		c.mu.Lock()
+		active := s.streams != nil && s.streams[stream.appGUID] == stream
+		if active {
+			delete(s.streams, stream.appGUID)
+			delete(c.appGUIDs, stream.appGUID)
+		}
+		c.mu.Unlock()
+
+		if !active {
+			return
+		}
+
+		c.logger.Printf("[ERROR] Stream of app %s gave up, stop streaming it", stream.appGUID)
+		select {
+		case s.errCh <- fmt.Errorf("stream of app %s gave up and it's removed: %v", stream.appGUID, lastErr):
+		case <-s.doneCh:
+		}
+		return
+	}
+
+	c.logger.Printf("[INFO] Stream of app %s is finished, restart it in %s (attempt %d)", stream.appGUID, delay, attempt)
+	c.hooks.onReconnect(ReconnectEvent{
+		AppGUID: stream.appGUID,
+		Attempt: attempt,
+		Delay:   delay,
+		Elapsed: elapsed,
+		Err:     lastErr,
+	})
+
+	select {
+	case <-time.After(delay):
+	case <-stream.doneCh:
+		return
+	case <-s.doneCh:
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The application may be removed (or the session may be closed)
+	// while waiting.
+	if s.streams == nil || s.streams[stream.appGUID] != stream {
+		return
+	}
+
+	stream.attempt, stream.lostAt = attempt, lostAt
+	c.startLocked(s, stream.appGUID, stream)
+}
+
+func (c *rawStreamConsumer) disconnected(stream *appStream, err error) {
+	stream.disconnectOnce.Do(func() {
+		c.hooks.onDisconnect(DisconnectEvent{
+			Addr:    c.dopplerAddr,
+			AppGUID: stream.appGUID,
+			Time:    time.Now(),
+			Err:     err,
+		})
+	})
+}
+
+// Close closes all streams and the channels returned by ConsumeContext.
+func (c *rawStreamConsumer) Close() error {
+	c.logger.Printf("[INFO] Stop consuming app streams")
+
+	c.mu.Lock()
+	s := c.session
+	if s == nil {
+		c.mu.Unlock()
+		return fmt.Errorf("no connection with doppler")
+	}
+	c.session = nil
+	c.mu.Unlock()
+
+	c.closeSession(s)
+	return nil
+}
+
+// closeSession closes all streams of the session and the channels.
+// It waits until the session is closed if it's already being closed.
+func (c *rawStreamConsumer) closeSession(s *streamSession) {
+	s.closeOnce.Do(func() {
+		c.mu.Lock()
+		close(s.doneCh)
+		streams := s.streams
+		s.streams = nil
+		c.mu.Unlock()
+
+		for _, stream := range streams {
+			c.stop(stream)
+		}
+
+		// Wait for forwarders not to send on closed channels.
+		s.wg.Wait()
+		close(s.eventCh)
+		close(s.errCh)
+	})
+}
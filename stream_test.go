@@ -0,0 +1,297 @@
+package nozzle
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+func TestRawStreamConsumer_implement(t *testing.T) {
+	var _ RawConsumer = &rawStreamConsumer{}
+	var _ RawContextConsumer = &rawStreamConsumer{}
+}
+
+func testReceiveApp(t *testing.T, eventCh <-chan *events.Envelope) string {
+	select {
+	case event := <-eventCh:
+		return event.GetLogMessage().GetAppId()
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expects event to be received")
+	}
+	return ""
+}
+
+func TestRawStreamConsumer_consume(t *testing.T) {
+	t.Parallel()
+
+	authToken := "n98ubNOIUog9gOPUbvqiur"
+	ts := NewAppStreamServer(t, authToken)
+	defer ts.Close()
+
+	disconnectCh := make(chan DisconnectEvent, 3)
+	hooks := Hooks{
+		OnDisconnect: func(e DisconnectEvent) {
+			disconnectCh <- e
+		},
+	}
+
+	consumer, err := newRawStreamConsumer(&Config{
+		DopplerAddr: strings.Replace(ts.URL, "http:", "ws:", 1),
+		Token:       authToken,
+		AppGUIDs:    []string{"app-1", "app-2"},
+		Logger:      log.New(ioutil.Discard, "", log.LstdFlags),
+		Hooks:       hooks,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	eventCh, _ := consumer.Consume()
+
+	// Streams are multiplexed into one channel.
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		got[testReceiveApp(t, eventCh)] = true
+	}
+
+	if !got["app-1"] || !got["app-2"] {
+		t.Fatalf("expects %v to have app-1 and app-2", got)
+	}
+
+	// Add the app while consuming.
+	if err := consumer.AddApp("app-3"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if guid := testReceiveApp(t, eventCh); guid != "app-3" {
+		t.Fatalf("expects %q to be eq %q", guid, "app-3")
+	}
+
+	if err := consumer.AddApp("app-3"); err == nil {
+		t.Fatalf("expects error to be occurred")
+	}
+
+	if err := consumer.RemoveApp("app-1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	select {
+	case e := <-disconnectCh:
+		if e.AppGUID != "app-1" || e.Err != nil {
+			t.Fatalf("expects %#v to be disconnected app-1", e)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expects OnDisconnect to be called")
+	}
+
+	if err := consumer.RemoveApp("app-1"); err == nil {
+		t.Fatalf("expects error to be occurred")
+	}
+
+	expect := []string{"app-2", "app-3"}
+	if apps := consumer.Apps(); !reflect.DeepEqual(apps, expect) {
+		t.Fatalf("expects %v to be eq %v", apps, expect)
+	}
+
+	if err := consumer.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, ok := <-eventCh; ok {
+		t.Fatalf("expects channel to be closed")
+	}
+
+	if err := consumer.Close(); err == nil {
+		t.Fatalf("expects error to be occurred")
+	}
+}
+
+func TestRawStreamConsumer_giveUp(t *testing.T) {
+	t.Parallel()
+
+	authToken := "n98ubNOIUog9gOPUbvqiur"
+	appServer := NewAppStreamServer(t, authToken)
+	defer appServer.Close()
+
+	// The stream of bad-app is always rejected (e.g., it's deleted).
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/apps/bad-app/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		appServer.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		reconnect bool
+	}{
+		{reconnect: false},
+		{reconnect: true},
+	}
+
+	for i, tc := range cases {
+		var mu sync.Mutex
+		var disconnected []string
+		var reconnects int
+		consumer, err := newRawStreamConsumer(&Config{
+			DopplerAddr:             strings.Replace(ts.URL, "http:", "ws:", 1),
+			Token:                   authToken,
+			AppGUIDs:                []string{"good-app", "bad-app"},
+			RetryCount:              1,
+			Reconnect:               tc.reconnect,
+			ReconnectInterval:       10 * time.Millisecond,
+			ReconnectMaxElapsedTime: 200 * time.Millisecond,
+			Logger:                  log.New(ioutil.Discard, "", log.LstdFlags),
+			Hooks: Hooks{
+				OnDisconnect: func(e DisconnectEvent) {
+					mu.Lock()
+					defer mu.Unlock()
+					disconnected = append(disconnected, e.AppGUID)
+				},
+				OnReconnect: func(e ReconnectEvent) {
+					mu.Lock()
+					defer mu.Unlock()
+					if e.AppGUID == "bad-app" {
+						reconnects++
+					}
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("#%d err: %s", i, err)
+		}
+
+		eventCh, errCh := consumer.Consume()
+		giveUpCh := make(chan error, 1)
+		go func() {
+			for err := range errCh {
+				if strings.Contains(err.Error(), "gave up and it's removed") {
+					giveUpCh <- err
+				}
+			}
+		}()
+
+		if guid := testReceiveApp(t, eventCh); guid != "good-app" {
+			t.Fatalf("#%d expects %q to be eq %q", i, guid, "good-app")
+		}
+
+		select {
+		case err := <-giveUpCh:
+			if !strings.Contains(err.Error(), "bad-app") {
+				t.Fatalf("#%d expects %q to contain bad-app", i, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("#%d expects the stream of bad-app to give up", i)
+		}
+
+		// Only the application which gave up is removed.
+		if apps := consumer.Apps(); !reflect.DeepEqual(apps, []string{"good-app"}) {
+			t.Fatalf("#%d expects %v to be eq %v", i, apps, []string{"good-app"})
+		}
+
+		// Consuming is continued.
+		if err := consumer.AddApp("app-3"); err != nil {
+			t.Fatalf("#%d err: %s", i, err)
+		}
+
+		if guid := testReceiveApp(t, eventCh); guid != "app-3" {
+			t.Fatalf("#%d expects %q to be eq %q", i, guid, "app-3")
+		}
+
+		mu.Lock()
+		for _, guid := range disconnected {
+			if guid != "bad-app" {
+				t.Fatalf("#%d expects only bad-app to be disconnected: %v", i, disconnected)
+			}
+		}
+
+		if len(disconnected) == 0 {
+			t.Fatalf("#%d expects OnDisconnect to be called for bad-app", i)
+		}
+
+		if (reconnects > 0) != tc.reconnect {
+			t.Fatalf("#%d expects bad-app to be restarted %v times with reconnect %v", i, reconnects, tc.reconnect)
+		}
+		mu.Unlock()
+
+		if err := consumer.Close(); err != nil {
+			t.Fatalf("#%d err: %s", i, err)
+		}
+	}
+}
+
+func TestRawStreamConsumer_validate(t *testing.T) {
+	cases := []struct {
+		config  *Config
+		success bool
+	}{
+		{
+			config: &Config{
+				DopplerAddr: "wss://doppler.example.com",
+				Token:       "token",
+				AppGUIDs:    []string{"app-1"},
+			},
+			success: true,
+		},
+		{
+			config: &Config{
+				Token:    "token",
+				AppGUIDs: []string{"app-1"},
+			},
+			success: false,
+		},
+		{
+			config: &Config{
+				DopplerAddr: "wss://doppler.example.com",
+				Token:       "token",
+				AppGUIDs:    []string{""},
+			},
+			success: false,
+		},
+	}
+
+	for i, tc := range cases {
+		_, err := newRawStreamConsumer(tc.config)
+		if (err == nil) != tc.success {
+			t.Fatalf("#%d expects success to be %v: %v", i, tc.success, err)
+		}
+	}
+}
+
+func TestConsumer_appStreamer(t *testing.T) {
+	consumer, err := NewConsumer(&Config{RawConsumer: &replayRawConsumer{}})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, ok := consumer.(AppStreamer); ok {
+		t.Fatalf("expects AppStreamer not to be implemented")
+	}
+
+	consumer, err = NewConsumer(&Config{
+		DopplerAddr: "wss://doppler.example.com",
+		Token:       "token",
+		AppGUIDs:    []string{"app-1"},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	streamer, ok := consumer.(AppStreamer)
+	if !ok {
+		t.Fatalf("expects AppStreamer to be implemented in stream mode")
+	}
+
+	if apps := streamer.Apps(); !reflect.DeepEqual(apps, []string{"app-1"}) {
+		t.Fatalf("expects %v to be eq %v", apps, []string{"app-1"})
+	}
+}
@@ -0,0 +1,364 @@
+package nozzle
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	// defaultReconnectInterval is the initial interval of reconnecting.
+	defaultReconnectInterval = 1 * time.Second
+
+	// defaultReconnectMaxInterval is the maximum interval of reconnecting.
+	defaultReconnectMaxInterval = 1 * time.Minute
+
+	// reconnectJitter is the randomization factor of the interval.
+	// The interval is randomized in [interval*(1-jitter), interval*(1+jitter)].
+	reconnectJitter = 0.5
+)
+
+// backoff calculates the interval of reconnecting. The interval
+// grows exponentially with jitter.
+type backoff struct {
+	interval       time.Duration
+	maxInterval    time.Duration
+	maxElapsedTime time.Duration
+
+	// random returns a number in [0.0,1.0) (for testing).
+	random func() float64
+}
+
+// delay returns the interval before the given attempt (starts from 1).
+func (b *backoff) delay(attempt int) time.Duration {
+	d := b.interval
+	for i := 1; i < attempt && d < b.maxInterval; i++ {
+		d *= 2
+	}
+
+	if d > b.maxInterval {
+		d = b.maxInterval
+	}
+
+	delta := reconnectJitter * float64(d)
+	return time.Duration(float64(d) - delta + b.random()*2*delta)
+}
+
+// supervisedRawConsumer implements RawConsumer. It wraps RawConsumer
+// and re-creates it when the connection is lost (e.g., noaa gave up
+// retrying). Events and errors from all connections are sent to
+// the same channels.
+type supervisedRawConsumer struct {
+	// newRawConsumer creates new RawConsumer for reconnecting.
+	newRawConsumer func() (RawConsumer, error)
+
+	backoff *backoff
+	hooks   *Hooks
+	logger  *log.Logger
+
+	// mu protects the following fields.
+	mu      sync.Mutex
+	current RawConsumer
+	doneCh  chan struct{}
+	stopped bool
+}
+
+// Consume starts consuming with supervising.
+func (s *supervisedRawConsumer) Consume() (<-chan *events.Envelope, <-chan error) {
+	return s.ConsumeContext(context.Background())
+}
+
+// ConsumeContext starts consuming with supervising. It stops
+// reconnecting when the given context is done.
+func (s *supervisedRawConsumer) ConsumeContext(ctx context.Context) (<-chan *events.Envelope, <-chan error) {
+	eventCh, errCh := make(chan *events.Envelope), make(chan error)
+	doneCh := s.start()
+
+	go func() {
+		defer close(eventCh)
+		defer close(errCh)
+
+		s.supervise(ctx, errCh, func(rc RawConsumer, received func()) (<-chan error, <-chan struct{}) {
+			var upstream <-chan *events.Envelope
+			var upstreamErrCh <-chan error
+			if c, ok := rc.(RawContextConsumer); ok {
+				upstream, upstreamErrCh = c.ConsumeContext(ctx)
+			} else {
+				upstream, upstreamErrCh = rc.Consume()
+			}
+
+			forwardDoneCh := make(chan struct{})
+			go func() {
+				defer close(forwardDoneCh)
+				for event := range upstream {
+					received()
+					select {
+					case eventCh <- event:
+					case <-doneCh:
+						return
+					}
+				}
+			}()
+
+			return upstreamErrCh, forwardDoneCh
+		})
+	}()
+
+	return eventCh, errCh
+}
+
+// ConsumeV2Context is same as ConsumeContext but for V2 envelopes.
+func (s *supervisedRawConsumer) ConsumeV2Context(ctx context.Context) (<-chan *loggregator_v2.Envelope, <-chan error) {
+	eventCh, errCh := make(chan *loggregator_v2.Envelope), make(chan error)
+	doneCh := s.start()
+
+	go func() {
+		defer close(eventCh)
+		defer close(errCh)
+
+		s.supervise(ctx, errCh, func(rc RawConsumer, received func()) (<-chan error, <-chan struct{}) {
+			var upstream <-chan *loggregator_v2.Envelope
+			var upstreamErrCh <-chan error
+			if c, ok := rc.(RawV2Consumer); ok {
+				upstream, upstreamErrCh = c.ConsumeV2Context(ctx)
+			} else {
+				var v1Upstream <-chan *events.Envelope
+				if c, ok := rc.(RawContextConsumer); ok {
+					v1Upstream, upstreamErrCh = c.ConsumeContext(ctx)
+				} else {
+					v1Upstream, upstreamErrCh = rc.Consume()
+				}
+
+				v2Upstream := make(chan *loggregator_v2.Envelope)
+				go func() {
+					defer close(v2Upstream)
+					for event := range v1Upstream {
+						select {
+						case v2Upstream <- ToV2(event):
+						case <-doneCh:
+							return
+						}
+					}
+				}()
+				upstream = v2Upstream
+			}
+
+			forwardDoneCh := make(chan struct{})
+			go func() {
+				defer close(forwardDoneCh)
+				for event := range upstream {
+					received()
+					select {
+					case eventCh <- event:
+					case <-doneCh:
+						return
+					}
+				}
+			}()
+
+			return upstreamErrCh, forwardDoneCh
+		})
+	}()
+
+	return eventCh, errCh
+}
+
+// start initializes doneCh and returns it.
+func (s *supervisedRawConsumer) start() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.doneCh = make(chan struct{})
+	s.stopped = false
+	return s.doneCh
+}
+
+// supervise runs the connection by connect and re-creates it
+// when it's lost. connect starts consuming by the given RawConsumer
+// and returns its error channel and the channel which is closed when
+// forwarding events is finished. The connection is considered lost
+// when the error channel is closed. received must be called when
+// an event is received.
+//
+// It returns when the consumer is closed, ctx is done or it gives
+// up reconnecting (after maxElapsedTime).
+func (s *supervisedRawConsumer) supervise(ctx context.Context, errCh chan<- error, connect func(RawConsumer, func()) (<-chan error, <-chan struct{})) {
+	s.mu.Lock()
+	rc, doneCh := s.current, s.doneCh
+	s.mu.Unlock()
+
+	attempt := 0
+	var lostAt time.Time
+	var lastErr error
+	for {
+		if rc != nil {
+			// connected is set when any event is received
+			// by this connection.
+			var connected bool
+			var connectedMu sync.Mutex
+			received := func() {
+				connectedMu.Lock()
+				connected = true
+				connectedMu.Unlock()
+			}
+
+			upstreamErrCh, forwardDoneCh := connect(rc, received)
+			for err := range upstreamErrCh {
+				lastErr = err
+				select {
+				case errCh <- err:
+				case <-doneCh:
+				}
+			}
+
+			// Connection is lost. Close it before reconnecting. It's
+			// detached from current under the lock so that it's closed
+			// only once by either this or Close.
+			s.mu.Lock()
+			lost := !s.stopped && s.current == rc
+			if lost {
+				s.current = nil
+			}
+			s.mu.Unlock()
+
+			if lost {
+				if err := rc.Close(); err != nil {
+					s.logger.Printf("[DEBUG] Failed to close lost connection: %s", err)
+				}
+			}
+
+			// Wait until forwarding events is finished not to send
+			// events to closed channel.
+			<-forwardDoneCh
+
+			connectedMu.Lock()
+			if connected {
+				// Reset backoff when the connection worked.
+				attempt = 0
+			}
+			connectedMu.Unlock()
+		}
+
+		if s.isStopped() || ctx.Err() != nil {
+			return
+		}
+
+		attempt++
+		if attempt == 1 {
+			lostAt = time.Now()
+		}
+
+		delay := s.backoff.delay(attempt)
+		elapsed := time.Since(lostAt)
+		if max := s.backoff.maxElapsedTime; max > 0 && elapsed+delay > max {
+			s.logger.Printf("[ERROR] Give up reconnecting after %s (%d attempts)", elapsed, attempt-1)
+			select {
+			case errCh <- fmt.Errorf("gave up reconnecting after %s (%d attempts): %v", elapsed, attempt-1, lastErr):
+			case <-doneCh:
+			}
+			return
+		}
+
+		s.logger.Printf("[INFO] Connection is lost, reconnect in %s (attempt %d)", delay, attempt)
+		s.hooks.onReconnect(ReconnectEvent{
+			Attempt: attempt,
+			Delay:   delay,
+			Elapsed: elapsed,
+			Err:     lastErr,
+		})
+
+		select {
+		case <-time.After(delay):
+		case <-doneCh:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		var err error
+		rc, err = s.newRawConsumer()
+		if err != nil {
+			s.logger.Printf("[ERROR] Failed to re-create consumer: %s", err)
+			lastErr = err
+			rc = nil
+			continue
+		}
+
+		s.mu.Lock()
+		if s.stopped {
+			s.mu.Unlock()
+			return
+		}
+		s.current = rc
+		s.mu.Unlock()
+	}
+}
+
+func (s *supervisedRawConsumer) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// Close stops supervising and closes current connection. If the
+// connection is lost and it's waiting for reconnecting, there is no
+// connection to close.
+func (s *supervisedRawConsumer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.doneCh == nil || s.stopped {
+		return fmt.Errorf("no connection with firehose")
+	}
+
+	s.stopped = true
+	close(s.doneCh)
+
+	if s.current == nil {
+		return nil
+	}
+
+	return s.current.Close()
+}
+
+// newSupervisedRawConsumer constructs supervisedRawConsumer. rc is used
+// for the first connection and newRawConsumer is used for reconnecting.
+func newSupervisedRawConsumer(config *Config, rc RawConsumer, newRawConsumer func() (RawConsumer, error)) *supervisedRawConsumer {
+	hooks := config.Hooks
+	return &supervisedRawConsumer{
+		newRawConsumer: newRawConsumer,
+		current:        rc,
+		backoff:        newBackoff(config),
+		hooks:          &hooks,
+		logger:         config.Logger,
+	}
+}
+
+// newBackoff returns backoff of reconnecting by the config.
+func newBackoff(config *Config) *backoff {
+	b := &backoff{
+		interval:       config.ReconnectInterval,
+		maxInterval:    config.ReconnectMaxInterval,
+		maxElapsedTime: config.ReconnectMaxElapsedTime,
+		random:         rand.Float64,
+	}
+
+	if b.interval == 0 {
+		b.interval = defaultReconnectInterval
+	}
+
+	if b.maxInterval == 0 {
+		b.maxInterval = defaultReconnectMaxInterval
+	}
+
+	if b.maxInterval < b.interval {
+		b.maxInterval = b.interval
+	}
+
+	return b
+}
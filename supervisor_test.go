@@ -0,0 +1,236 @@
+package nozzle
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestSupervisedRawConsumer_implement(t *testing.T) {
+	var _ RawConsumer = &supervisedRawConsumer{}
+	var _ RawContextConsumer = &supervisedRawConsumer{}
+	var _ RawV2Consumer = &supervisedRawConsumer{}
+}
+
+func TestBackoff_delay(t *testing.T) {
+	tests := []struct {
+		attempt  int
+		random   float64
+		expected time.Duration
+	}{
+		{1, 0.5, 1 * time.Second},
+		{2, 0.5, 2 * time.Second},
+		{3, 0.5, 4 * time.Second},
+		{4, 0.5, 8 * time.Second},
+		{5, 0.5, 10 * time.Second},
+		{10, 0.5, 10 * time.Second},
+		{1, 0.0, 500 * time.Millisecond},
+		{3, 0.0, 2 * time.Second},
+		{3, 0.75, 5 * time.Second},
+	}
+
+	for i, tt := range tests {
+		b := &backoff{
+			interval:    1 * time.Second,
+			maxInterval: 10 * time.Second,
+			random:      func() float64 { return tt.random },
+		}
+
+		if got := b.delay(tt.attempt); got != tt.expected {
+			t.Fatalf("#%d expects %s to be eq %s", i, got, tt.expected)
+		}
+	}
+}
+
+func TestConsumer_reconnect(t *testing.T) {
+	t.Parallel()
+
+	rc := &replayRawConsumer{
+		Events: []*events.Envelope{
+			{
+				Origin:    proto.String("fake-origin"),
+				EventType: events.Envelope_LogMessage.Enum(),
+			},
+		},
+	}
+
+	var mu sync.Mutex
+	var attempts []int
+	config := &Config{
+		RawConsumer:       rc,
+		Reconnect:         true,
+		ReconnectInterval: 10 * time.Millisecond,
+		Hooks: Hooks{
+			OnReconnect: func(e ReconnectEvent) {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts = append(attempts, e.Attempt)
+			},
+		},
+	}
+
+	consumer, err := NewConsumer(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	// Same events channel must be used across reconnects.
+	eventCh := consumer.Events()
+	for i := 0; i < 3; i++ {
+		select {
+		case event := <-eventCh:
+			if got, want := event.GetOrigin(), "fake-origin"; got != want {
+				t.Fatalf("#%d expects %q to be eq %q", i, got, want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("#%d expects event to be received after reconnect", i)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) < 2 {
+		t.Fatalf("expects OnReconnect to be called at least 2 times: %v", attempts)
+	}
+
+	// Connection worked every time, so attempt is reset.
+	for _, attempt := range attempts {
+		if attempt != 1 {
+			t.Fatalf("expects attempt %d to be eq 1", attempt)
+		}
+	}
+}
+
+func TestConsumer_reconnect_maxElapsedTime(t *testing.T) {
+	t.Parallel()
+
+	// No events are received, so backoff is never reset.
+	rc := &replayRawConsumer{}
+
+	config := &Config{
+		RawConsumer:             rc,
+		Reconnect:               true,
+		ReconnectInterval:       10 * time.Millisecond,
+		ReconnectMaxElapsedTime: 100 * time.Millisecond,
+	}
+
+	consumer, err := NewConsumer(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := consumer.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer consumer.Close()
+
+	select {
+	case err := <-consumer.Errors():
+		if !strings.Contains(err.Error(), "gave up reconnecting") {
+			t.Fatalf("expects %q to contain %q", err.Error(), "gave up reconnecting")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expects to give up reconnecting")
+	}
+}
+
+func TestConsumer_reconnect_newRawConsumerFailed(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var errs []error
+	config := &Config{
+		Hooks: Hooks{
+			OnReconnect: func(e ReconnectEvent) {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, e.Err)
+			},
+		},
+		Logger: defaultLogger,
+	}
+
+	s := newSupervisedRawConsumer(config, &replayRawConsumer{}, func() (RawConsumer, error) {
+		return nil, fmt.Errorf("failed to connect")
+	})
+	s.backoff.interval = 10 * time.Millisecond
+	s.backoff.maxElapsedTime = 200 * time.Millisecond
+
+	_, errCh := s.Consume()
+	for range errCh {
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) < 2 {
+		t.Fatalf("expects OnReconnect to be called at least 2 times: %v", errs)
+	}
+
+	if errs[1] == nil || errs[1].Error() != "failed to connect" {
+		t.Fatalf("expects %v to be failed to connect", errs[1])
+	}
+}
+
+func TestConsumer_reconnect_closeDuringBackoff(t *testing.T) {
+	t.Parallel()
+
+	reconnectCh := make(chan struct{}, 1)
+	config := &Config{
+		DopplerAddr:       "ws://127.0.0.1:1",
+		Token:             "n98ubNOIUog9gOPUbvqiur",
+		SubscriptionID:    "test-go-nozzle-A",
+		RetryCount:        1,
+		Reconnect:         true,
+		ReconnectInterval: 2 * time.Second,
+		Hooks: Hooks{
+			OnReconnect: func(e ReconnectEvent) {
+				select {
+				case reconnectCh <- struct{}{}:
+				default:
+				}
+			},
+		},
+	}
+
+	c, err := NewConsumer(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	go func() {
+		for range c.Errors() {
+		}
+	}()
+
+	select {
+	case <-reconnectCh:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expects OnReconnect to be called")
+	}
+
+	// The lost connection is already closed, so it's not closed again.
+	if err := c.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	sd := c.(*consumer).slowDetector.(*defaultSlowDetector)
+	select {
+	case <-sd.doneCh:
+	default:
+		t.Fatalf("expects slow detector to be stopped")
+	}
+}
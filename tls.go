@@ -0,0 +1,214 @@
+package nozzle
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// newTLSConfig returns tls.Config for the connections to doppler,
+// RLP gateway and UAA. It's based on Config.TLSConfig and the CA bundle
+// and the client certificate are loaded from the files. They are
+// reloaded when the files are changed.
+func newTLSConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	}
+
+	if config.Insecure {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, fmt.Errorf("both TLSCertFile and TLSKeyFile must be set")
+	}
+
+	if config.TLSCAFile == "" && config.TLSCertFile == "" {
+		return tlsConfig, nil
+	}
+
+	logger := config.Logger
+	if logger == nil {
+		logger = defaultLogger
+	}
+
+	r := &tlsReloader{
+		caFile:   config.TLSCAFile,
+		certFile: config.TLSCertFile,
+		keyFile:  config.TLSKeyFile,
+		logger:   logger,
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	if r.certFile != "" {
+		tlsConfig.GetClientCertificate = r.clientCertificate
+	}
+
+	// RootCAs can't be changed after the connection is configured, so
+	// the server certificate is verified by VerifyConnection with the
+	// latest CA bundle instead.
+	if r.caFile != "" && !tlsConfig.InsecureSkipVerify {
+		verify := tlsConfig.VerifyConnection
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if err := r.verify(cs); err != nil {
+				return err
+			}
+
+			if verify != nil {
+				return verify(cs)
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// hasTLSConfig returns true if TLS is configured by other than Insecure.
+func hasTLSConfig(config *Config) bool {
+	return config.TLSConfig != nil || config.TLSCAFile != "" || config.TLSCertFile != ""
+}
+
+// tlsReloader loads the CA bundle and the client certificate and
+// reloads them when the files are changed (checked on every handshake).
+type tlsReloader struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	logger   *log.Logger
+
+	// mu protects the following fields.
+	mu      sync.Mutex
+	rootCAs *x509.CertPool
+	cert    *tls.Certificate
+	stamps  map[string]fileStamp
+}
+
+// fileStamp is used for detecting the change of the file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// load loads the files.
+func (r *tlsReloader) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loadLocked()
+}
+
+func (r *tlsReloader) loadLocked() error {
+	stamps := make(map[string]fileStamp)
+	for _, path := range []string{r.caFile, r.certFile, r.keyFile} {
+		if path == "" {
+			continue
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %s", path, err)
+		}
+		stamps[path] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+	}
+
+	var rootCAs *x509.CertPool
+	if r.caFile != "" {
+		b, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA file: %s", err)
+		}
+
+		// The CA bundle is added to the system ones.
+		rootCAs, err = x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+
+		if !rootCAs.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificate found in CA file %s", r.caFile)
+		}
+	}
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %s", err)
+		}
+		cert = &c
+	}
+
+	r.rootCAs, r.cert, r.stamps = rootCAs, cert, stamps
+	return nil
+}
+
+// reload reloads the files if they are changed. If it's failed (e.g.,
+// the files are being replaced), the previous ones are kept.
+func (r *tlsReloader) reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := false
+	for path, stamp := range r.stamps {
+		fi, err := os.Stat(path)
+		if err != nil || !fi.ModTime().Equal(stamp.modTime) || fi.Size() != stamp.size {
+			changed = true
+			break
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	if err := r.loadLocked(); err != nil {
+		r.logger.Printf("[ERROR] Failed to reload TLS files: %s", err)
+		return
+	}
+	r.logger.Printf("[INFO] Reloaded TLS files")
+}
+
+// clientCertificate is used as tls.Config.GetClientCertificate.
+func (r *tlsReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.reload()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+// verify verifies the server certificate with the CA bundle.
+func (r *tlsReloader) verify(cs tls.ConnectionState) error {
+	r.reload()
+
+	r.mu.Lock()
+	rootCAs := r.rootCAs
+	r.mu.Unlock()
+
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no server certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         rootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,300 @@
+package nozzle
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate generates self-signed certificate (it's also CA) for
+// 127.0.0.1 and returns PEM encoded certificate and key.
+func testCertificate(t *testing.T, cn string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeTestFile writes the file and changes its modification time
+// to make sure that the change is detected.
+func writeTestFile(t *testing.T, path string, b []byte, modTime time.Time) {
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestNewTLSConfig_validate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-nozzle-tls")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPEM, keyPEM := testCertificate(t, "client")
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestFile(t, certFile, certPEM, time.Now())
+	writeTestFile(t, keyFile, keyPEM, time.Now())
+
+	invalidFile := filepath.Join(dir, "invalid.pem")
+	writeTestFile(t, invalidFile, []byte("invalid"), time.Now())
+
+	cases := []struct {
+		config *Config
+		errStr string
+	}{
+		{
+			config: &Config{TLSCAFile: certFile, TLSCertFile: certFile, TLSKeyFile: keyFile},
+		},
+		{
+			config: &Config{TLSCertFile: certFile},
+			errStr: "both TLSCertFile and TLSKeyFile must be set",
+		},
+		{
+			config: &Config{TLSCAFile: filepath.Join(dir, "not-found.pem")},
+			errStr: "failed to stat",
+		},
+		{
+			config: &Config{TLSCAFile: invalidFile},
+			errStr: "no certificate found",
+		},
+		{
+			config: &Config{TLSCertFile: certFile, TLSKeyFile: invalidFile},
+			errStr: "failed to load client certificate",
+		},
+	}
+
+	for i, tc := range cases {
+		_, err := newTLSConfig(tc.config)
+		if tc.errStr == "" {
+			if err != nil {
+				t.Fatalf("#%d err: %s", i, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), tc.errStr) {
+			t.Fatalf("#%d expects %v to contain %q", i, err, tc.errStr)
+		}
+	}
+}
+
+func TestNewTLSConfig_reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-nozzle-tls")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	serverCertPEM, serverKeyPEM := testCertificate(t, "doppler")
+	serverCert, err := tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The server responds the common name of the client certificate.
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	modTime := time.Now()
+	writeTestFile(t, caFile, serverCertPEM, modTime)
+	certPEM, keyPEM := testCertificate(t, "nozzle-1")
+	writeTestFile(t, certFile, certPEM, modTime)
+	writeTestFile(t, keyFile, keyPEM, modTime)
+
+	tlsConfig, err := newTLSConfig(&Config{
+		TLSCAFile:   caFile,
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   tlsConfig,
+			DisableKeepAlives: true,
+		},
+	}
+
+	get := func() (string, error) {
+		res, err := client.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		return readMessage(res.Body), nil
+	}
+
+	if cn, err := get(); err != nil || cn != "nozzle-1" {
+		t.Fatalf("expects %q to be eq %q: %v", cn, "nozzle-1", err)
+	}
+
+	// CA is changed, so the server can't be verified.
+	otherCAPEM, _ := testCertificate(t, "other-ca")
+	writeTestFile(t, caFile, otherCAPEM, modTime.Add(time.Second))
+
+	if _, err := get(); err == nil {
+		t.Fatalf("expects error to be occurred")
+	}
+
+	// CA and client certificate are rotated.
+	certPEM, keyPEM = testCertificate(t, "nozzle-2")
+	writeTestFile(t, caFile, serverCertPEM, modTime.Add(2*time.Second))
+	writeTestFile(t, certFile, certPEM, modTime.Add(2*time.Second))
+	writeTestFile(t, keyFile, keyPEM, modTime.Add(2*time.Second))
+
+	if cn, err := get(); err != nil || cn != "nozzle-2" {
+		t.Fatalf("expects %q to be eq %q: %v", cn, "nozzle-2", err)
+	}
+}
+
+func TestTokenFetcher_tls(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"np9q34bcanBIUI98b9q3vnaoirv","token_type":"bearer"}`))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "go-nozzle-tls")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	writeTestFile(t, caFile, caPEM, time.Now())
+
+	cases := []struct {
+		config  *Config
+		success bool
+	}{
+		{
+			config: &Config{
+				UaaAddr:      ts.URL,
+				ClientID:     "nozzle-client",
+				ClientSecret: "s3cret",
+				TLSCAFile:    caFile,
+			},
+			success: true,
+		},
+		{
+			config: &Config{
+				UaaAddr:   ts.URL,
+				Username:  "admin",
+				Password:  "passw0rd",
+				TLSCAFile: caFile,
+			},
+			success: true,
+		},
+		{
+			config: &Config{
+				UaaAddr:      ts.URL,
+				ClientID:     "nozzle-client",
+				ClientSecret: "s3cret",
+			},
+			success: false,
+		},
+	}
+
+	for i, tc := range cases {
+		tc.config.Logger = defaultLogger
+		fetcher, err := newTokenFetcher(tc.config)
+		if err != nil {
+			t.Fatalf("#%d err: %s", i, err)
+		}
+
+		token, err := fetcher.Fetch()
+		if (err == nil) != tc.success {
+			t.Fatalf("#%d expects success to be %v: %v", i, tc.success, err)
+		}
+
+		if tc.success && token != "bearer np9q34bcanBIUI98b9q3vnaoirv" {
+			t.Fatalf("#%d unexpected token: %q", i, token)
+		}
+	}
+}
+
+func TestRawConsumer_tlsConfig(t *testing.T) {
+	base := &tls.Config{ServerName: "doppler.example.com"}
+
+	consumer, err := newRawDefaultConsumer(&Config{
+		DopplerAddr:    "wss://doppler.example.com",
+		Token:          "token",
+		SubscriptionID: "go-nozzle",
+		TLSConfig:      base,
+		Insecure:       true,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if consumer.tlsConfig == base {
+		t.Fatalf("expects TLSConfig to be cloned")
+	}
+
+	if consumer.tlsConfig.ServerName != "doppler.example.com" || !consumer.tlsConfig.InsecureSkipVerify {
+		t.Fatalf("unexpected TLS config: %#v", consumer.tlsConfig)
+	}
+
+	if base.InsecureSkipVerify {
+		t.Fatalf("expects TLSConfig not to be modified")
+	}
+}
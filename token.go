@@ -1,26 +1,47 @@
 package nozzle
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
-
-	"github.com/cloudfoundry-incubator/uaago"
 )
 
 const (
 	defaultUAATimeout = 30 * time.Second
 )
 
-// tokenFetcher is the interface for fetching access token
-// From UAA server. By default, defaultTokenFetcher
-// (which is implemented with https://github.com/cloudfoundry-incubator/uaago)
-// is used
-type tokenFetcher interface {
-	// Fetch fetches the token from Uaa and return it. If any, returns error.
+// TokenSource is the interface for fetching access token. By default,
+// the token is fetched from UAA server by defaultTokenFetcher
+// (which sends the same request as https://github.com/cloudfoundry-incubator/uaago).
+// You can supply the token from your own secret store by setting it to
+// Config.TokenSource.
+//
+// The token must have its type as prefix (e.g., "bearer xxx").
+type TokenSource interface {
+	// Fetch fetches the token and return it. If any, returns error.
 	Fetch() (string, error)
+
+	// RefreshAuthToken fetches new token. It's called when the token
+	// is rejected by doppler (e.g., it's expired).
 	RefreshAuthToken() (string, error)
+}
+
+// contextTokenFetcher is implemented by TokenSource which can cancel
+// fetching the token when the context is done.
+type contextTokenFetcher interface {
+	// FetchContext is same as Fetch but it's canceled when the given
+	// context is done.
+	FetchContext(ctx context.Context) (string, error)
 
+	// RefreshAuthTokenContext is same as RefreshAuthToken but it's
+	// canceled when the given context is done.
+	RefreshAuthTokenContext(ctx context.Context) (string, error)
 }
 
 type defaultTokenFetcher struct {
@@ -28,41 +49,30 @@ type defaultTokenFetcher struct {
 	username string
 	password string
 	timeout  time.Duration
-	insecure bool
+	hooks    *Hooks
 	logger   *log.Logger
+
+	// client is used for requesting UAA with TLS, proxy and dialer
+	// of the config.
+	client *http.Client
 }
 
 // Fetch gets access token from UAA server. This auth token
 // is s used for accessing traffic-controller. It retuns error if any.
 func (tf *defaultTokenFetcher) Fetch() (string, error) {
-	tf.logger.Printf("[INFO] Getting auth token of %q from UAA (%s)", tf.username, tf.uaaAddr)
-	client, err := uaago.NewClient(tf.uaaAddr)
-	if err != nil {
-		return "", err
-	}
-
-	resCh, errCh := make(chan string), make(chan error)
-	go func() {
-		token, err := client.GetAuthToken(tf.username, tf.password, tf.insecure)
-		if err != nil {
-			errCh <- err
-		}
-		resCh <- token
-	}()
+	return tf.FetchContext(context.Background())
+}
 
-	timeout := defaultUAATimeout
-	if tf.timeout != 0 {
-		timeout = tf.timeout
-	}
+// FetchContext is same as Fetch but it stops waiting for the response
+// from UAA server and returns ctx.Err() when the given context is done.
+func (tf *defaultTokenFetcher) FetchContext(ctx context.Context) (string, error) {
+	tf.logger.Printf("[INFO] Getting auth token of %q from UAA (%s)", tf.username, tf.uaaAddr)
+	return fetchToken(ctx, tf.requestToken, tf.uaaAddr, tf.username, tf.hooks)
+}
 
-	select {
-	case err := <-errCh:
-		return "", err
-	case <-time.After(timeout):
-		return "", fmt.Errorf("request timeout: %s", timeout)
-	case token := <-resCh:
-		return token, nil
-	}
+// requestToken requests the token of the user to UAA.
+func (tf *defaultTokenFetcher) requestToken(ctx context.Context) (string, error) {
+	return requestToken(ctx, tf.client, tf.uaaAddr, tf.username, tf.password, tf.timeout)
 }
 
 func (tf *defaultTokenFetcher) validate() error {
@@ -85,17 +95,106 @@ func (tf *defaultTokenFetcher) validate() error {
 // implement the interface of new noaa token_refresher
 // to get a new token when the existing one is expired
 func (tf *defaultTokenFetcher) RefreshAuthToken() (string, error) {
-	return tf.Fetch()
+	return tf.RefreshAuthTokenContext(context.Background())
+}
+
+// RefreshAuthTokenContext fetches new token and calls OnTokenRefresh hook.
+func (tf *defaultTokenFetcher) RefreshAuthTokenContext(ctx context.Context) (string, error) {
+	return refreshToken(ctx, tf.FetchContext, tf.uaaAddr, tf.username, tf.hooks, tf.logger)
+}
+
+// fetchToken fetches the token by request and calls OnTokenFetch hook.
+func fetchToken(ctx context.Context, request func(context.Context) (string, error), uaaAddr, username string, hooks *Hooks) (string, error) {
+	start := time.Now()
+	token, err := request(ctx)
+	hooks.onTokenFetch(TokenFetchEvent{
+		UaaAddr:  uaaAddr,
+		Username: username,
+		Time:     time.Now(),
+		Duration: time.Since(start),
+		Err:      err,
+	})
+
+	return token, err
+}
+
+// refreshToken fetches new token by fetch and calls OnTokenRefresh hook.
+func refreshToken(ctx context.Context, fetch func(context.Context) (string, error), uaaAddr, username string, hooks *Hooks, logger *log.Logger) (string, error) {
+	start := time.Now()
+	token, err := fetch(ctx)
+	if err != nil {
+		logger.Printf("[ERROR] Failed to refresh auth token: %s", err)
+	} else {
+		logger.Printf("[INFO] Refreshed auth token (%s)", maskString(token))
+	}
+
+	event := TokenRefreshEvent{
+		UaaAddr:  uaaAddr,
+		Username: username,
+		Time:     time.Now(),
+		Duration: time.Since(start),
+		Err:      err,
+	}
+
+	if err == nil {
+		event.Expiry, _ = tokenExpiry(token)
+	}
+
+	hooks.onTokenRefresh(event)
+
+	return token, err
+}
+
+// contextTokenRefresher is passed to noaa consumer as token refresher.
+// It binds refreshing token to the context of consuming.
+type contextTokenRefresher struct {
+	ctx     context.Context
+	fetcher TokenSource
+
+	// token is the token used for the connection. It's updated
+	// when it's refreshed.
+	token string
+}
+
+// RefreshAuthToken refreshes the token. If the fetcher can handle
+// the context, refreshing is canceled when the context is done.
+// If the fetcher caches the token and it already has the newer
+// one, it's returned without requesting UAA.
+func (r *contextTokenRefresher) RefreshAuthToken() (string, error) {
+	if err := r.ctx.Err(); err != nil {
+		return "", err
+	}
+
+	var token string
+	var err error
+	if c, ok := r.fetcher.(*tokenCache); ok {
+		token, err = c.refreshStale(r.ctx, r.token)
+	} else {
+		token, err = refreshWith(r.ctx, r.fetcher)
+	}
+
+	if err == nil {
+		r.token = token
+	}
+
+	return token, err
 }
 
 func newDefaultTokenFetcher(config *Config) (*defaultTokenFetcher, error) {
+	client, err := newTokenClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := config.Hooks
 	fetcher := &defaultTokenFetcher{
 		uaaAddr:  config.UaaAddr,
 		timeout:  config.UaaTimeout,
 		username: config.Username,
 		password: config.Password,
-		insecure: config.Insecure,
+		hooks:    &hooks,
 		logger:   config.Logger,
+		client:   client,
 	}
 
 	if err := fetcher.validate(); err != nil {
@@ -104,3 +203,186 @@ func newDefaultTokenFetcher(config *Config) (*defaultTokenFetcher, error) {
 
 	return fetcher, nil
 }
+
+// newTokenFetcher returns TokenSource for the credentials in the config.
+// If ClientID or ClientSecret is set, they are used. Otherwise, Username
+// and Password are used. Both are requested by client_credentials grant.
+func newTokenFetcher(config *Config) (TokenSource, error) {
+	hasClient := config.ClientID != "" || config.ClientSecret != ""
+	hasUser := config.Username != "" || config.Password != ""
+
+	switch {
+	case hasClient && hasUser:
+		return nil, fmt.Errorf("both ClientID/ClientSecret and Username/Password can not be set")
+	case hasClient:
+		return newClientCredentialsTokenFetcher(config)
+	default:
+		return newDefaultTokenFetcher(config)
+	}
+}
+
+// clientCredentialsTokenFetcher implements TokenSource. It fetches the
+// token from UAA by client_credentials grant with the UAA client
+// (it needs doppler.firehose authority).
+type clientCredentialsTokenFetcher struct {
+	uaaAddr      string
+	clientID     string
+	clientSecret string
+	timeout      time.Duration
+	hooks        *Hooks
+	logger       *log.Logger
+
+	// client is used for requesting UAA with TLS, proxy and dialer
+	// of the config.
+	client *http.Client
+}
+
+// Fetch gets access token from UAA server.
+func (tf *clientCredentialsTokenFetcher) Fetch() (string, error) {
+	return tf.FetchContext(context.Background())
+}
+
+// FetchContext is same as Fetch but it's canceled when the given
+// context is done.
+func (tf *clientCredentialsTokenFetcher) FetchContext(ctx context.Context) (string, error) {
+	tf.logger.Printf("[INFO] Getting auth token of client %q from UAA (%s)", tf.clientID, tf.uaaAddr)
+	return fetchToken(ctx, tf.requestToken, tf.uaaAddr, tf.clientID, tf.hooks)
+}
+
+// requestToken requests the token of the UAA client to UAA.
+func (tf *clientCredentialsTokenFetcher) requestToken(ctx context.Context) (string, error) {
+	return requestToken(ctx, tf.client, tf.uaaAddr, tf.clientID, tf.clientSecret, tf.timeout)
+}
+
+// requestToken requests the token to UAA by client_credentials grant.
+// It's shared by both of the fetchers (Username and Password are used as
+// the client ID and secret like uaago).
+func requestToken(ctx context.Context, client *http.Client, uaaAddr, clientID, clientSecret string, timeout time.Duration) (string, error) {
+	if timeout == 0 {
+		timeout = defaultUAATimeout
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {clientID},
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimRight(uaaAddr, "/")+"/oauth/token",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.Do(req.WithContext(reqCtx))
+	if err != nil {
+		// Distinguish the cancellation by the caller and the timeout.
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		if reqCtx.Err() != nil {
+			return "", fmt.Errorf("request timeout: %s", timeout)
+		}
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("UAA returned %d: %s", res.StatusCode, readMessage(res.Body))
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode UAA response: %s", err)
+	}
+
+	if body.AccessToken == "" {
+		return "", fmt.Errorf("UAA returned empty access token")
+	}
+
+	// Same format as uaago (e.g., "bearer xxx").
+	tokenType := body.TokenType
+	if tokenType == "" {
+		tokenType = "bearer"
+	}
+
+	return tokenType + " " + body.AccessToken, nil
+}
+
+// RefreshAuthToken fetches new token. It's called by noaa when
+// the token is expired.
+func (tf *clientCredentialsTokenFetcher) RefreshAuthToken() (string, error) {
+	return tf.RefreshAuthTokenContext(context.Background())
+}
+
+// RefreshAuthTokenContext fetches new token and calls OnTokenRefresh hook.
+func (tf *clientCredentialsTokenFetcher) RefreshAuthTokenContext(ctx context.Context) (string, error) {
+	return refreshToken(ctx, tf.FetchContext, tf.uaaAddr, tf.clientID, tf.hooks, tf.logger)
+}
+
+func (tf *clientCredentialsTokenFetcher) validate() error {
+	if tf.uaaAddr == "" {
+		return fmt.Errorf("UaaAddr must not be empty")
+	}
+
+	if tf.clientID == "" {
+		return fmt.Errorf("ClientID must not be empty")
+	}
+
+	if tf.clientSecret == "" {
+		return fmt.Errorf("ClientSecret must not be empty")
+	}
+
+	return nil
+}
+
+func newClientCredentialsTokenFetcher(config *Config) (*clientCredentialsTokenFetcher, error) {
+	client, err := newTokenClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := config.Hooks
+	fetcher := &clientCredentialsTokenFetcher{
+		uaaAddr:      config.UaaAddr,
+		clientID:     config.ClientID,
+		clientSecret: config.ClientSecret,
+		timeout:      config.UaaTimeout,
+		hooks:        &hooks,
+		logger:       config.Logger,
+		client:       client,
+	}
+
+	if err := fetcher.validate(); err != nil {
+		return nil, err
+	}
+
+	return fetcher, nil
+}
+
+// newTokenClient returns http.Client to request UAA with TLS, proxy
+// (Config.Proxy or environment variables) and dialer of the config.
+func newTokenClient(config *Config) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUAAClient(config, tlsConfig), nil
+}
+
+// newUAAClient returns http.Client to request UAA.
+func newUAAClient(config *Config, tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: newHTTPTransport(config, tlsConfig),
+	}
+}
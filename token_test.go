@@ -1,8 +1,10 @@
 package nozzle
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -29,7 +31,7 @@ func (f *testTokenFetcher) RefreshAuthToken() (string, error) {
 }
 
 func TestDefaultTokenFetcher_implement(t *testing.T) {
-	var _ tokenFetcher = &defaultTokenFetcher{}
+	var _ TokenSource = &defaultTokenFetcher{}
 }
 
 func TestDefaultTokenFetcher_fetch(t *testing.T) {
@@ -231,3 +233,231 @@ func validRequest(r *http.Request) bool {
 
 	return true
 }
+
+func TestDefaultTokenFetcher_fetchContext(t *testing.T) {
+	t.Parallel()
+
+	// Create server it just waits for cancellation of client
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(1 * time.Second)
+	}))
+	defer ts.Close()
+
+	config := &Config{
+		UaaAddr:  ts.URL,
+		Username: "admin",
+		Password: "ncq9Bcpq8gbpqi",
+		Logger:   defaultLogger,
+	}
+
+	fetcher, err := newDefaultTokenFetcher(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := fetcher.FetchContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect %v to be eq %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDefaultTokenFetcher_refreshHook(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	var got []TokenRefreshEvent
+	var fetches []TokenFetchEvent
+	config := &Config{
+		UaaAddr:  ts.URL,
+		Username: "gonozzle",
+		Password: "passw0rd",
+		Logger:   defaultLogger,
+		Hooks: Hooks{
+			OnTokenRefresh: func(e TokenRefreshEvent) {
+				got = append(got, e)
+			},
+			OnTokenFetch: func(e TokenFetchEvent) {
+				fetches = append(fetches, e)
+			},
+		},
+	}
+
+	fetcher, err := newDefaultTokenFetcher(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Fetch is not refreshing.
+	fetcher.Fetch()
+	if len(got) != 0 {
+		t.Fatalf("expects OnTokenRefresh not to be called: %v", got)
+	}
+
+	// Fetch is observed by OnTokenFetch.
+	if len(fetches) != 1 || fetches[0].Err == nil || fetches[0].UaaAddr != ts.URL {
+		t.Fatalf("expects OnTokenFetch to be called with error: %v", fetches)
+	}
+
+	refresher := &contextTokenRefresher{
+		ctx:     context.Background(),
+		fetcher: fetcher,
+	}
+	if _, err := refresher.RefreshAuthToken(); err == nil {
+		t.Fatalf("expects to be failed")
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("expects OnTokenRefresh to be called once: %v", got)
+	}
+
+	if len(fetches) != 2 {
+		t.Fatalf("expects OnTokenFetch to be called by refreshing: %v", fetches)
+	}
+
+	if got[0].UaaAddr != ts.URL || got[0].Username != "gonozzle" || got[0].Err == nil {
+		t.Fatalf("expects %#v to have UaaAddr, Username and Err", got[0])
+	}
+}
+
+func TestClientCredentialsTokenFetcher_fetch(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth/token" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		authValue := "Basic " + base64.StdEncoding.EncodeToString([]byte("nozzle-client:s3cret"))
+		if authValue != r.Header.Get("Authorization") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte(`{"access_token":"np9q34bcanBIUI98b9q3vnaoirv","token_type":"bearer","expires_in":599}`))
+	}))
+	defer ts.Close()
+
+	// Both of the credentials are requested by the same
+	// client_credentials grant with or without custom transport.
+	cases := []struct {
+		config *Config
+		expect string
+	}{
+		{
+			config: &Config{ClientID: "nozzle-client", ClientSecret: "s3cret"},
+			expect: "*nozzle.clientCredentialsTokenFetcher",
+		},
+		{
+			config: &Config{Username: "nozzle-client", Password: "s3cret"},
+			expect: "*nozzle.defaultTokenFetcher",
+		},
+		{
+			config: &Config{ClientID: "nozzle-client", ClientSecret: "s3cret", Dialer: &net.Dialer{}},
+			expect: "*nozzle.clientCredentialsTokenFetcher",
+		},
+		{
+			config: &Config{Username: "nozzle-client", Password: "s3cret", Dialer: &net.Dialer{}},
+			expect: "*nozzle.defaultTokenFetcher",
+		},
+	}
+
+	for i, tc := range cases {
+		tc.config.UaaAddr = ts.URL
+		tc.config.Logger = defaultLogger
+
+		fetcher, err := newTokenFetcher(tc.config)
+		if err != nil {
+			t.Fatalf("#%d err: %s", i, err)
+		}
+
+		if got := fmt.Sprintf("%T", fetcher); got != tc.expect {
+			t.Fatalf("#%d expects %s to be eq %s", i, got, tc.expect)
+		}
+
+		token, err := fetcher.Fetch()
+		if err != nil {
+			t.Fatalf("#%d err: %s", i, err)
+		}
+
+		expect := "bearer np9q34bcanBIUI98b9q3vnaoirv"
+		if token != expect {
+			t.Fatalf("#%d expect %q to be eq %q", i, token, expect)
+		}
+	}
+
+	// Wrong secret.
+	fetcher, err := newTokenFetcher(&Config{
+		UaaAddr:      ts.URL,
+		ClientID:     "nozzle-client",
+		ClientSecret: "wrong",
+		Logger:       defaultLogger,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := fetcher.Fetch(); err == nil {
+		t.Fatalf("expect to be failed")
+	}
+}
+
+func TestNewTokenFetcher(t *testing.T) {
+	cases := []struct {
+		config *Config
+		errStr string
+	}{
+		{
+			config: &Config{
+				UaaAddr:  "https://uaa.cloudfoundry.net",
+				Username: "admin",
+				Password: "passw0rd",
+			},
+		},
+		{
+			config: &Config{
+				UaaAddr:      "https://uaa.cloudfoundry.net",
+				ClientID:     "nozzle-client",
+				ClientSecret: "s3cret",
+			},
+		},
+		{
+			config: &Config{
+				UaaAddr:  "https://uaa.cloudfoundry.net",
+				ClientID: "nozzle-client",
+			},
+			errStr: "ClientSecret must not be empty",
+		},
+		{
+			config: &Config{
+				UaaAddr:      "https://uaa.cloudfoundry.net",
+				ClientID:     "nozzle-client",
+				ClientSecret: "s3cret",
+				Username:     "admin",
+				Password:     "passw0rd",
+			},
+			errStr: "both ClientID/ClientSecret and Username/Password can not be set",
+		},
+	}
+
+	for i, tc := range cases {
+		tc.config.Logger = defaultLogger
+		_, err := newTokenFetcher(tc.config)
+		if tc.errStr == "" {
+			if err != nil {
+				t.Fatalf("#%d err: %s", i, err)
+			}
+			continue
+		}
+
+		if err == nil || err.Error() != tc.errStr {
+			t.Fatalf("#%d expects %v to be eq %q", i, err, tc.errStr)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package nozzle
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTokenRefreshSkew = 1 * time.Minute
+
+	// minTokenRetryInterval is the minimum interval to retry refreshing
+	// the token in background after it's failed.
+	minTokenRetryInterval = 1 * time.Second
+)
+
+// tokenCache implements TokenSource. It wraps another TokenSource,
+// caches the token and shares one in-flight request to UAA among
+// concurrent callers.
+//
+// If the token is JWT with exp claim, it's refreshed in background
+// before it's expired (while it's started) so that reconnecting doesn't
+// have to wait for doppler to reject the expired token.
+type tokenCache struct {
+	fetcher TokenSource
+	skew    time.Duration
+	logger  *log.Logger
+
+	// mu protects the following fields.
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+	call   *tokenCall
+
+	// users is the number of consumers which started background
+	// refreshing. It's stopped when all of them stop it.
+	users  int
+	timer  *time.Timer
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// tokenCall is an in-flight request to fetch the token.
+type tokenCall struct {
+	doneCh chan struct{}
+	token  string
+	err    error
+}
+
+func newTokenCache(fetcher TokenSource, skew time.Duration, logger *log.Logger) *tokenCache {
+	if skew == 0 {
+		skew = defaultTokenRefreshSkew
+	}
+
+	return &tokenCache{
+		fetcher: fetcher,
+		skew:    skew,
+		logger:  logger,
+	}
+}
+
+// Fetch returns the cached token if it's not expired yet. Otherwise it
+// fetches new token.
+func (c *tokenCache) Fetch() (string, error) {
+	return c.FetchContext(context.Background())
+}
+
+// FetchContext is same as Fetch but it's canceled when the given
+// context is done.
+func (c *tokenCache) FetchContext(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	if c.token != "" && !c.expiredLocked(time.Now()) {
+		token := c.token
+		c.mu.Unlock()
+		return token, nil
+	}
+	c.mu.Unlock()
+
+	return c.do(ctx, false)
+}
+
+// RefreshAuthToken fetches new token. If it's already being fetched by
+// others, it waits for it and returns the same token.
+func (c *tokenCache) RefreshAuthToken() (string, error) {
+	return c.RefreshAuthTokenContext(context.Background())
+}
+
+// RefreshAuthTokenContext is same as RefreshAuthToken but it's canceled
+// when the given context is done.
+func (c *tokenCache) RefreshAuthTokenContext(ctx context.Context) (string, error) {
+	return c.do(ctx, true)
+}
+
+// refreshStale refreshes the token which is rejected by doppler. If the
+// cache already has another token which is not expired (e.g., refreshed
+// in background), it's returned without requesting UAA.
+func (c *tokenCache) refreshStale(ctx context.Context, rejected string) (string, error) {
+	c.mu.Lock()
+	if c.token != "" && c.token != rejected && !c.expiredLocked(time.Now()) {
+		token := c.token
+		c.mu.Unlock()
+		return token, nil
+	}
+	c.mu.Unlock()
+
+	return c.do(ctx, true)
+}
+
+// current returns the cached token. If nothing is cached, it returns
+// the given token.
+func (c *tokenCache) current(token string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token == "" {
+		return token
+	}
+	return c.token
+}
+
+// set caches the token which is obtained without the cache
+// (e.g., Config.Token).
+func (c *tokenCache) set(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = token
+	c.expiry, _ = tokenExpiry(token)
+	c.scheduleLocked()
+}
+
+// expiredLocked returns true if the token is expired (or will be
+// expired within skew).
+func (c *tokenCache) expiredLocked(now time.Time) bool {
+	if c.expiry.IsZero() {
+		return false
+	}
+
+	skew := c.skew
+	if skew < 0 {
+		skew = 0
+	}
+
+	return !now.Before(c.expiry.Add(-skew))
+}
+
+// do fetches the token by the wrapped fetcher. Only one request is
+// in-flight at a time and concurrent callers wait for its result.
+func (c *tokenCache) do(ctx context.Context, refresh bool) (string, error) {
+	c.mu.Lock()
+	if call := c.call; call != nil {
+		c.mu.Unlock()
+		select {
+		case <-call.doneCh:
+			return call.token, call.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	call := &tokenCall{doneCh: make(chan struct{})}
+	c.call = call
+	c.mu.Unlock()
+
+	if refresh {
+		call.token, call.err = refreshWith(ctx, c.fetcher)
+	} else {
+		call.token, call.err = fetchWith(ctx, c.fetcher)
+	}
+
+	c.mu.Lock()
+	c.call = nil
+	if call.err == nil {
+		c.token = call.token
+		c.expiry, _ = tokenExpiry(call.token)
+		c.scheduleLocked()
+	}
+	c.mu.Unlock()
+
+	close(call.doneCh)
+	return call.token, call.err
+}
+
+// start starts refreshing the token in background.
+func (c *tokenCache) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.users++
+	if c.users > 1 {
+		return
+	}
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.scheduleLocked()
+}
+
+// stop stops refreshing the token in background.
+func (c *tokenCache) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.users == 0 {
+		return
+	}
+
+	c.users--
+	if c.users > 0 {
+		return
+	}
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.cancel()
+}
+
+// scheduleLocked schedules refreshing the token skew before it's
+// expired. Nothing is scheduled if it's not started or the expiry of
+// the token is unknown.
+func (c *tokenCache) scheduleLocked() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+
+	if c.users == 0 || c.expiry.IsZero() || c.skew < 0 {
+		return
+	}
+
+	d := time.Until(c.expiry.Add(-c.skew))
+	if d <= 0 {
+		// The token lives shorter than skew. Refresh it at the half
+		// of its lifetime not to refresh it in a loop.
+		d = time.Until(c.expiry) / 2
+	}
+
+	if d <= 0 {
+		// Already expired. It's refreshed when it's rejected.
+		return
+	}
+
+	c.timerLocked(d)
+}
+
+func (c *tokenCache) timerLocked(d time.Duration) {
+	ctx := c.ctx
+	c.timer = time.AfterFunc(d, func() {
+		c.refreshBackground(ctx)
+	})
+}
+
+// refreshBackground refreshes the token before it's expired. If it's
+// failed, it's retried while the current token is valid.
+func (c *tokenCache) refreshBackground(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	c.logger.Printf("[INFO] Refreshing auth token before it's expired")
+	if _, err := c.do(ctx, true); err != nil {
+		c.logger.Printf("[ERROR] Failed to refresh auth token in background: %s", err)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if ctx.Err() != nil || c.users == 0 {
+			return
+		}
+
+		if d := time.Until(c.expiry) / 2; d >= minTokenRetryInterval {
+			c.timerLocked(d)
+		}
+	}
+}
+
+// fetchWith fetches the token by fetcher. If the fetcher can handle
+// the context, fetching is canceled when the context is done.
+func fetchWith(ctx context.Context, fetcher TokenSource) (string, error) {
+	if f, ok := fetcher.(contextTokenFetcher); ok {
+		return f.FetchContext(ctx)
+	}
+	return fetcher.Fetch()
+}
+
+// refreshWith refreshes the token by fetcher. If the fetcher can handle
+// the context, refreshing is canceled when the context is done.
+func refreshWith(ctx context.Context, fetcher TokenSource) (string, error) {
+	if f, ok := fetcher.(contextTokenFetcher); ok {
+		return f.RefreshAuthTokenContext(ctx)
+	}
+	return fetcher.RefreshAuthToken()
+}
+
+// currentToken returns the latest token of the fetcher if it caches the
+// token (it may be refreshed in background). Otherwise it returns the
+// given token.
+func currentToken(fetcher TokenSource, token string) string {
+	if c, ok := fetcher.(*tokenCache); ok {
+		return c.current(token)
+	}
+	return token
+}
+
+// tokenExpiry returns the expiry of the token from exp claim of JWT.
+// The token may have its type as prefix (e.g., "bearer xxx.yyy.zzz").
+// It returns false if the token is not JWT or doesn't have exp claim.
+func tokenExpiry(token string) (time.Time, bool) {
+	if i := strings.LastIndex(token, " "); i >= 0 {
+		token = token[i+1:]
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		Exp float64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp <= 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(claims.Exp), 0), true
+}
@@ -0,0 +1,239 @@
+package nozzle
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testJWT returns the bearer token (JWT) which is expired at exp.
+func testJWT(exp time.Time, id int) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims := base64.RawURLEncoding.EncodeToString(
+		[]byte(fmt.Sprintf(`{"jti":"%d","exp":%d}`, id, exp.Unix())))
+	return "bearer " + header + "." + claims + ".c2lnbmF0dXJl"
+}
+
+// countTokenFetcher returns new JWT which lives for ttl on every call.
+// If blockCh is not nil, it waits for it before returning the token.
+type countTokenFetcher struct {
+	ttl     time.Duration
+	blockCh chan struct{}
+	count   int32
+}
+
+func (f *countTokenFetcher) Fetch() (string, error) {
+	if f.blockCh != nil {
+		<-f.blockCh
+	}
+	n := atomic.AddInt32(&f.count, 1)
+	return testJWT(time.Now().Add(f.ttl), int(n)), nil
+}
+
+func (f *countTokenFetcher) RefreshAuthToken() (string, error) {
+	return f.Fetch()
+}
+
+func TestTokenCache_implement(t *testing.T) {
+	var _ TokenSource = &tokenCache{}
+	var _ contextTokenFetcher = &tokenCache{}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	exp := time.Unix(1700000000, 0)
+
+	cases := []struct {
+		token  string
+		expect time.Time
+		ok     bool
+	}{
+		{testJWT(exp, 1), exp, true},
+		{"bearer " + base64.RawURLEncoding.EncodeToString([]byte(`{}`)) + ".e30.sig", time.Time{}, false},
+		{"bearer h." + base64.StdEncoding.EncodeToString([]byte(`{"exp":1700000000}`)) + ".sig", exp, true},
+		{"bearer not-jwt", time.Time{}, false},
+		{"bearer a.!!!.c", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+
+	for i, tc := range cases {
+		got, ok := tokenExpiry(tc.token)
+		if ok != tc.ok || !got.Equal(tc.expect) {
+			t.Fatalf("#%d expects %s (%v) to be eq %s (%v)", i, got, ok, tc.expect, tc.ok)
+		}
+	}
+}
+
+func TestTokenCache_fetch(t *testing.T) {
+	fetcher := &countTokenFetcher{ttl: time.Hour}
+	cache := newTokenCache(fetcher, 0, defaultLogger)
+
+	token1, err := cache.Fetch()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Cached token is returned.
+	token2, err := cache.Fetch()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if token1 != token2 || fetcher.count != 1 {
+		t.Fatalf("expects token to be cached (fetched %d times)", fetcher.count)
+	}
+
+	// Another token is already cached, so it's not rejected one.
+	token3, err := cache.refreshStale(context.Background(), "bearer old-token")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if token3 != token1 || fetcher.count != 1 {
+		t.Fatalf("expects cached token to be returned (fetched %d times)", fetcher.count)
+	}
+
+	// Cached token is rejected.
+	token4, err := cache.RefreshAuthToken()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if token4 == token1 || fetcher.count != 2 {
+		t.Fatalf("expects new token to be fetched (fetched %d times)", fetcher.count)
+	}
+
+	if got := currentToken(cache, "bearer old-token"); got != token4 {
+		t.Fatalf("expects %q to be eq %q", got, token4)
+	}
+}
+
+func TestTokenCache_expired(t *testing.T) {
+	// The token lives shorter than skew, so it's always expired.
+	fetcher := &countTokenFetcher{ttl: 30 * time.Second}
+	cache := newTokenCache(fetcher, time.Minute, defaultLogger)
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Fetch(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	if fetcher.count != 2 {
+		t.Fatalf("expects %d to be eq 2", fetcher.count)
+	}
+}
+
+func TestTokenCache_singleFlight(t *testing.T) {
+	fetcher := &countTokenFetcher{
+		ttl:     time.Hour,
+		blockCh: make(chan struct{}),
+	}
+	cache := newTokenCache(fetcher, 0, defaultLogger)
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := cache.RefreshAuthToken()
+			if err != nil {
+				t.Errorf("err: %s", err)
+			}
+			tokens[i] = token
+		}(i)
+	}
+
+	// Wait for the first call to be in-flight.
+	for {
+		cache.mu.Lock()
+		inflight := cache.call != nil
+		cache.mu.Unlock()
+		if inflight {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(fetcher.blockCh)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&fetcher.count); n > 2 {
+		t.Fatalf("expects concurrent calls to share the request (fetched %d times)", n)
+	}
+
+	for i, token := range tokens {
+		if token == "" {
+			t.Fatalf("#%d expects token to be returned", i)
+		}
+	}
+}
+
+func TestTokenCache_background(t *testing.T) {
+	t.Parallel()
+
+	// The token is refreshed 1 second before it's expired.
+	fetcher := &countTokenFetcher{ttl: 2 * time.Second}
+	cache := newTokenCache(fetcher, 1*time.Second, defaultLogger)
+
+	token, err := cache.Fetch()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cache.start()
+	defer cache.stop()
+
+	timeout := time.After(5 * time.Second)
+	for atomic.LoadInt32(&fetcher.count) < 3 {
+		select {
+		case <-timeout:
+			t.Fatalf("expects token to be refreshed in background (fetched %d times)",
+				atomic.LoadInt32(&fetcher.count))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if got := cache.current(""); got == token {
+		t.Fatalf("expects token to be refreshed")
+	}
+}
+
+func TestTokenCache_disabled(t *testing.T) {
+	fetcher := &countTokenFetcher{ttl: time.Hour}
+	cache := newTokenCache(fetcher, -1, defaultLogger)
+
+	if _, err := cache.Fetch(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cache.start()
+	defer cache.stop()
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.timer != nil {
+		t.Fatalf("expects refreshing not to be scheduled")
+	}
+}
+
+func TestConsumer_tokenExpiry(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	consumer, err := NewConsumer(&Config{
+		RawConsumer: &replayRawConsumer{},
+		Token:       testJWT(exp, 1),
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if got := consumer.Stats().TokenExpiry; !got.Equal(exp) {
+		t.Fatalf("expects %s to be eq %s", got, exp)
+	}
+}
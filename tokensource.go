@@ -0,0 +1,137 @@
+package nozzle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewStaticTokenSource returns TokenSource which always returns the
+// given token. It can't refresh the token, so RefreshAuthToken returns
+// error.
+func NewStaticTokenSource(token string) TokenSource {
+	return &staticTokenSource{token: bearerToken(token)}
+}
+
+type staticTokenSource struct {
+	token string
+}
+
+func (s *staticTokenSource) Fetch() (string, error) {
+	if s.token == "" {
+		return "", fmt.Errorf("static token is empty")
+	}
+	return s.token, nil
+}
+
+func (s *staticTokenSource) RefreshAuthToken() (string, error) {
+	return "", fmt.Errorf("static token can not be refreshed")
+}
+
+// NewFileTokenSource returns TokenSource which reads the token from the
+// file (e.g., the token injected by sidecar). The file is checked on
+// every call and re-read when it's changed (by its modification time
+// and size). RefreshAuthToken always re-reads it.
+func NewFileTokenSource(path string) TokenSource {
+	return &fileTokenSource{path: path}
+}
+
+type fileTokenSource struct {
+	path string
+
+	// mu protects the following fields.
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+func (s *fileTokenSource) Fetch() (string, error) {
+	return s.read(false)
+}
+
+func (s *fileTokenSource) RefreshAuthToken() (string, error) {
+	return s.read(true)
+}
+
+// read reads the token from the file if it's changed or force is true.
+func (s *fileTokenSource) read(force bool) (string, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat token file: %s", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !force && s.token != "" && fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return s.token, nil
+	}
+
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file: %s", err)
+	}
+
+	token := bearerToken(string(b))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", s.path)
+	}
+
+	s.token, s.modTime, s.size = token, fi.ModTime(), fi.Size()
+	return token, nil
+}
+
+// NewEnvTokenSource returns TokenSource which reads the token from the
+// environment variable. It's read on every call.
+func NewEnvTokenSource(name string) TokenSource {
+	return &envTokenSource{name: name}
+}
+
+type envTokenSource struct {
+	name string
+}
+
+func (s *envTokenSource) Fetch() (string, error) {
+	token := bearerToken(os.Getenv(s.name))
+	if token == "" {
+		return "", fmt.Errorf("environment variable %s is empty", s.name)
+	}
+	return token, nil
+}
+
+func (s *envTokenSource) RefreshAuthToken() (string, error) {
+	return s.Fetch()
+}
+
+// NewCachingTokenSource returns TokenSource which caches the token of
+// the given source. Concurrent callers share one in-flight request to
+// the source. Fetch returns the cached token until it's expired (exp
+// claim of JWT) and RefreshAuthToken always fetches new one.
+//
+// The same source can be shared by multiple consumers. When it's set
+// to Config.TokenSource, the consumer uses it as the cache (instead of
+// wrapping it again, so Config.TokenRefreshSkew is not used) and
+// refreshes the token in background skew before it's expired. skew is
+// same as Config.TokenRefreshSkew (0 is 1 minute and negative disables
+// refreshing in background). If logger is nil, logs are discarded.
+func NewCachingTokenSource(source TokenSource, skew time.Duration, logger *log.Logger) TokenSource {
+	if logger == nil {
+		logger = defaultLogger
+	}
+	return newTokenCache(source, skew, logger)
+}
+
+// bearerToken prefixes "bearer " to the token if it doesn't have
+// its type.
+func bearerToken(token string) string {
+	token = strings.TrimSpace(token)
+	if token == "" || strings.Contains(token, " ") {
+		return token
+	}
+	return "bearer " + token
+}
@@ -0,0 +1,219 @@
+package nozzle
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenSource_implement(t *testing.T) {
+	var _ TokenSource = &staticTokenSource{}
+	var _ TokenSource = &fileTokenSource{}
+	var _ TokenSource = &envTokenSource{}
+	var _ TokenSource = &tokenCache{}
+}
+
+func TestBearerToken(t *testing.T) {
+	cases := []struct {
+		in, expect string
+	}{
+		{"xxx.yyy.zzz", "bearer xxx.yyy.zzz"},
+		{"bearer xxx.yyy.zzz", "bearer xxx.yyy.zzz"},
+		{" xxx.yyy.zzz\n", "bearer xxx.yyy.zzz"},
+		{"\n", ""},
+	}
+
+	for i, tc := range cases {
+		if got := bearerToken(tc.in); got != tc.expect {
+			t.Fatalf("#%d expects %q to be eq %q", i, got, tc.expect)
+		}
+	}
+}
+
+func TestStaticTokenSource(t *testing.T) {
+	source := NewStaticTokenSource("n98ubNOIUog9gOPUbvqiur")
+
+	token, err := source.Fetch()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if expect := "bearer n98ubNOIUog9gOPUbvqiur"; token != expect {
+		t.Fatalf("expects %q to be eq %q", token, expect)
+	}
+
+	if _, err := source.RefreshAuthToken(); err == nil {
+		t.Fatalf("expects error to be occurred")
+	}
+
+	if _, err := NewStaticTokenSource("").Fetch(); err == nil {
+		t.Fatalf("expects error to be occurred")
+	}
+}
+
+func TestFileTokenSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-nozzle-token")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	source := NewFileTokenSource(path)
+
+	// The file doesn't exist yet.
+	if _, err := source.Fetch(); err == nil {
+		t.Fatalf("expects error to be occurred")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("token-1\n"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	token, err := source.Fetch()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if token != "bearer token-1" {
+		t.Fatalf("expects %q to be eq %q", token, "bearer token-1")
+	}
+
+	// Rotated by sidecar.
+	if err := ioutil.WriteFile(path, []byte("bearer token-22"), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	token, err = source.Fetch()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if token != "bearer token-22" {
+		t.Fatalf("expects %q to be eq %q", token, "bearer token-22")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(""), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := source.RefreshAuthToken(); err == nil {
+		t.Fatalf("expects error to be occurred")
+	}
+}
+
+func TestEnvTokenSource(t *testing.T) {
+	name := "GO_NOZZLE_TEST_TOKEN"
+	defer os.Unsetenv(name)
+
+	source := NewEnvTokenSource(name)
+
+	os.Unsetenv(name)
+	if _, err := source.Fetch(); err == nil {
+		t.Fatalf("expects error to be occurred")
+	}
+
+	os.Setenv(name, "token-1")
+	token, err := source.Fetch()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if token != "bearer token-1" {
+		t.Fatalf("expects %q to be eq %q", token, "bearer token-1")
+	}
+
+	os.Setenv(name, "token-2")
+	token, err = source.RefreshAuthToken()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if token != "bearer token-2" {
+		t.Fatalf("expects %q to be eq %q", token, "bearer token-2")
+	}
+}
+
+func TestCachingTokenSource(t *testing.T) {
+	fetcher := &countTokenFetcher{ttl: time.Hour}
+	source := NewCachingTokenSource(fetcher, 0, nil)
+
+	for i := 0; i < 3; i++ {
+		if _, err := source.Fetch(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&fetcher.count); n != 1 {
+		t.Fatalf("expects %d to be eq 1", n)
+	}
+
+	if _, err := source.RefreshAuthToken(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if n := atomic.LoadInt32(&fetcher.count); n != 2 {
+		t.Fatalf("expects %d to be eq 2", n)
+	}
+}
+
+func TestNewCachingTokenSource(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+
+	cases := []struct {
+		skew         time.Duration
+		logger       *log.Logger
+		expectSkew   time.Duration
+		expectLogger *log.Logger
+	}{
+		{0, nil, defaultTokenRefreshSkew, defaultLogger},
+		{5 * time.Minute, logger, 5 * time.Minute, logger},
+		{-1, logger, -1, logger},
+	}
+
+	for i, tc := range cases {
+		cache := NewCachingTokenSource(&countTokenFetcher{}, tc.skew, tc.logger).(*tokenCache)
+		if cache.skew != tc.expectSkew {
+			t.Fatalf("#%d expects %s to be eq %s", i, cache.skew, tc.expectSkew)
+		}
+
+		if cache.logger != tc.expectLogger {
+			t.Fatalf("#%d expects logger to be used", i)
+		}
+	}
+}
+
+func TestNewConsumer_tokenSource(t *testing.T) {
+	fetcher := &countTokenFetcher{ttl: time.Hour}
+	source := NewCachingTokenSource(fetcher, 0, nil)
+
+	// UaaAddr is not needed. The cache is shared by consumers.
+	for i := 0; i < 2; i++ {
+		config := &Config{
+			DopplerAddr:    "wss://doppler.example.com",
+			SubscriptionID: "go-nozzle",
+			TokenSource:    source,
+		}
+
+		c, err := NewConsumer(config)
+		if err != nil {
+			t.Fatalf("#%d err: %s", i, err)
+		}
+
+		if c.(*consumer).rawConsumer.(*rawDefaultConsumer).token == "" {
+			t.Fatalf("#%d expects token to be fetched", i)
+		}
+
+		if config.Token != "" || config.Logger != nil || config.tokenFetcher != nil {
+			t.Fatalf("#%d expects config not to be modified: %#v", i, config)
+		}
+	}
+
+	if n := atomic.LoadInt32(&fetcher.count); n != 1 {
+		t.Fatalf("expects %d to be eq 1", n)
+	}
+}